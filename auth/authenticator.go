@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrRealmMismatch      = errors.New("credentials of other realm")
+	ErrURIMismatch        = errors.New("digest uri does not match Request-URI")
+	ErrInvalidNonce       = errors.New("nonce was not issued by server")
+	ErrStaleNonce         = errors.New("nonce expired")
+	ErrNonceReplay        = errors.New("nonce count reused")
+	ErrInvalidResponse    = errors.New("digest response does not match")
+)
+
+// Authenticator challenges requests with Digest authentication (RFC 2617, RFC 7616)
+type Authenticator struct {
+	Realm string
+	Store CredentialStore
+
+	// Algorithms offered in challenges, most preferred first
+	Algorithms []string
+	// NonceExpiry is lifetime of nonce, credentials with older nonce get stale challenge
+	NonceExpiry time.Duration
+	// Proxy makes authenticator answer 407 with Proxy-Authenticate instead of 401
+	Proxy bool
+
+	methods map[message.RequestMethod]bool
+	secret  []byte
+
+	mu        sync.Mutex
+	counts    map[string]nonceCount
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+type nonceCount struct {
+	issued time.Time
+	nc     uint32
+}
+
+// New creates authenticator of realm challenging requests of methods.
+// ACK and CANCEL are never challenged as they can not be resubmitted (RFC 3261 22.1).
+func New(realm string, store CredentialStore, methods ...message.RequestMethod) *Authenticator {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	a := &Authenticator{
+		Realm:       realm,
+		Store:       store,
+		Algorithms:  []string{AlgorithmSHA256, AlgorithmMD5},
+		NonceExpiry: 5 * time.Minute,
+		methods:     make(map[message.RequestMethod]bool),
+		secret:      secret,
+		counts:      make(map[string]nonceCount),
+		now:         time.Now,
+	}
+	for _, m := range methods {
+		if m == message.ACK || m == message.CANCEL {
+			continue
+		}
+		a.methods[m] = true
+	}
+	return a
+}
+
+// Requires checks if requests of method are challenged
+func (a *Authenticator) Requires(method message.RequestMethod) bool {
+	return a.methods[method]
+}
+
+// Wrap returns handler which passes authenticated requests to next and
+// answers others with challenge. Requests of not configured methods are passed as they are.
+// e.g. srv.OnRegister(a.Wrap(registrar.Handler()))
+func (a *Authenticator) Wrap(next message.RequestHandler) message.RequestHandler {
+	return func(ctx context.Context, req *message.Message) *message.Message {
+		if !a.Requires(message.RequestMethod(req.Msg.Method)) {
+			return next(ctx, req)
+		}
+		if _, res := a.Authenticate(req); res != nil {
+			return res
+		}
+		return next(ctx, req)
+	}
+}
+
+// Authenticate validates credentials of request. It returns authenticated username,
+// or response which should be sent instead: challenge or 400 for malformed credentials.
+func (a *Authenticator) Authenticate(req *message.Message) (string, *message.Message) {
+	creds, err := a.Verify(req)
+	switch {
+	case err == nil:
+		return creds.Username, nil
+	case errors.Is(err, ErrStaleNonce):
+		return "", a.challenge(req, true)
+	case errors.Is(err, ErrURIMismatch), errors.Is(err, ErrNotDigest):
+		return "", message.NewResponse(req, 400, "Bad Request")
+	case errors.Is(err, ErrMissingCredentials):
+	default:
+		slog.Info("authentication failed", "err", err, "realm", a.Realm, "user", username(creds))
+	}
+	return "", a.challenge(req, false)
+}
+
+// Verify validates Authorization (Proxy-Authorization for proxy) header of request
+func (a *Authenticator) Verify(req *message.Message) (*Credentials, error) {
+	header := req.Msg.Authorization
+	if a.Proxy {
+		header = req.Msg.ProxyAuthorization
+	}
+	if header == "" {
+		return nil, ErrMissingCredentials
+	}
+
+	creds, err := ParseCredentials(header)
+	if err != nil {
+		return nil, err
+	}
+	if creds.Realm != a.Realm {
+		return creds, ErrRealmMismatch
+	}
+	if !a.uriMatches(req, creds.URI) {
+		return creds, ErrURIMismatch
+	}
+	if !IsSupported(creds.Algorithm) {
+		return creds, ErrUnsupportedAlgorithm
+	}
+	if creds.Qop != "" && creds.Qop != QopAuth {
+		return creds, ErrUnsupportedQop
+	}
+
+	issued, nonceErr := a.checkNonce(creds.Nonce)
+	if nonceErr != nil && !errors.Is(nonceErr, ErrStaleNonce) {
+		return creds, nonceErr
+	}
+
+	password, err := a.Store.Password(a.Realm, creds.Username)
+	if err != nil {
+		return creds, err
+	}
+	expected, err := creds.Digest(req.Msg.Method, password)
+	if err != nil {
+		return creds, err
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(creds.Response)) != 1 {
+		return creds, ErrInvalidResponse
+	}
+	// Nonce is reported stale only for valid digest, so stale challenge tells
+	// nothing to client without password (RFC 7616 3.3)
+	if nonceErr != nil {
+		return creds, nonceErr
+	}
+
+	// Nonce count is checked after digest, so forged requests can not burn counts.
+	// Credentials without qop have no count, their nonce can be used once.
+	if creds.Qop == "" {
+		if !a.useCount(creds.Nonce, 1, issued) {
+			return creds, fmt.Errorf("%w: %w", ErrStaleNonce, ErrNonceReplay)
+		}
+	} else if !a.useCount(creds.Nonce, creds.NC, issued) {
+		return creds, ErrNonceReplay
+	}
+
+	return creds, nil
+}
+
+// challenge creates 401 or 407 response with challenge for each algorithm
+func (a *Authenticator) challenge(req *message.Message, stale bool) *message.Message {
+	status, phrase, name := 401, "Unauthorized", "WWW-Authenticate"
+	if a.Proxy {
+		status, phrase, name = 407, "Proxy Authentication Required", "Proxy-Authenticate"
+	}
+	res := message.NewResponse(req, status, phrase)
+
+	nonce := a.newNonce()
+	// Additional challenges are extension headers as gosip keeps single value of header
+	var extra *sip.XHeader
+	for i := len(a.Algorithms) - 1; i >= 0; i-- {
+		c := &Challenge{
+			Realm:     a.Realm,
+			Nonce:     nonce,
+			Algorithm: a.Algorithms[i],
+			Qop:       QopAuth,
+			Stale:     stale,
+		}
+		if i > 0 {
+			extra = &sip.XHeader{Name: name, Value: []byte(c.String()), Next: extra}
+			continue
+		}
+		if a.Proxy {
+			res.Msg.ProxyAuthenticate = c.String()
+		} else {
+			res.Msg.WWWAuthenticate = c.String()
+		}
+	}
+	res.Msg.XHeader = extra
+
+	return res
+}
+
+// newNonce creates nonce of issue time, random bytes and their HMAC
+func (a *Authenticator) newNonce() string {
+	buf := make([]byte, 16, 16+sha256.Size)
+	binary.BigEndian.PutUint64(buf, uint64(a.now().UnixNano()))
+	if _, err := rand.Read(buf[8:]); err != nil {
+		panic(err)
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(buf)
+	return hex.EncodeToString(mac.Sum(buf)[:32])
+}
+
+// checkNonce validates nonce and returns its issue time
+func (a *Authenticator) checkNonce(nonce string) (time.Time, error) {
+	buf, err := hex.DecodeString(nonce)
+	if err != nil || len(buf) != 32 {
+		return time.Time{}, ErrInvalidNonce
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(buf[:16])
+	if !hmac.Equal(mac.Sum(nil)[:16], buf[16:]) {
+		return time.Time{}, ErrInvalidNonce
+	}
+
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	if a.now().Sub(issued) > a.NonceExpiry {
+		return issued, ErrStaleNonce
+	}
+	return issued, nil
+}
+
+// useCount records nonce count. Count must grow with every request using same nonce.
+func (a *Authenticator) useCount(nonce string, nc uint32, issued time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep()
+
+	c := a.counts[nonce]
+	if nc <= c.nc {
+		return false
+	}
+	a.counts[nonce] = nonceCount{issued: issued, nc: nc}
+	return true
+}
+
+// sweep forgets counts of expired nonces. Must be called with lock held.
+func (a *Authenticator) sweep() {
+	now := a.now()
+	if now.Sub(a.lastSweep) < a.NonceExpiry {
+		return
+	}
+	a.lastSweep = now
+	for nonce, c := range a.counts {
+		if now.Sub(c.issued) > a.NonceExpiry {
+			delete(a.counts, nonce)
+		}
+	}
+}
+
+// uriMatches compares digest uri with Request-URI (RFC 2617 3.2.2.5)
+func (a *Authenticator) uriMatches(req *message.Message, uri string) bool {
+	if uri == req.Msg.Request.String() {
+		return true
+	}
+	parsed, err := sip.ParseURI([]byte(uri))
+	if err != nil {
+		return false
+	}
+	return parsed.String() == req.Msg.Request.String()
+}
+
+func username(creds *Credentials) string {
+	if creds == nil {
+		return ""
+	}
+	return creds.Username
+}
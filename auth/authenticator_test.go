@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+func newRegister() *message.Message {
+	uri := &sip.URI{Scheme: "sip", Host: "example.com"}
+	return &message.Message{Msg: &sip.Msg{
+		Method:     string(message.REGISTER),
+		Request:    uri,
+		Via:        &sip.Via{Transport: "UDP", Host: "192.0.2.1", Port: 5060, Param: &sip.Param{Name: "branch", Value: "z9hG4bK1"}},
+		From:       &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}, Param: &sip.Param{Name: "tag", Value: "a1"}},
+		To:         &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}},
+		CallID:     "call-1@192.0.2.1",
+		CSeq:       1,
+		CSeqMethod: string(message.REGISTER),
+	}}
+}
+
+// authorize sets credentials of alice answering nonce to request
+func authorize(req *message.Message, nonce string, password string, qop string, nc uint32) {
+	creds := &Credentials{
+		Username:  "alice",
+		Realm:     "example.com",
+		Nonce:     nonce,
+		URI:       req.Msg.Request.String(),
+		Algorithm: AlgorithmMD5,
+		Qop:       qop,
+		NC:        nc,
+	}
+	if qop != "" {
+		creds.CNonce = "0a4f113b"
+	}
+	creds.Response, _ = creds.Digest(req.Msg.Method, password)
+	req.Msg.Authorization = creds.String()
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		qop      string
+		password string
+		// age is age of nonce when credentials are verified
+		age time.Duration
+		// replay sends the same credentials again
+		replay bool
+		want   []error
+	}{
+		{name: "qop", qop: QopAuth, password: "secret"},
+		{name: "no qop", password: "secret"},
+		{name: "qop replayed", qop: QopAuth, password: "secret", replay: true, want: []error{ErrNonceReplay}},
+		{name: "no qop replayed", password: "secret", replay: true, want: []error{ErrNonceReplay, ErrStaleNonce}},
+		{name: "wrong password", qop: QopAuth, password: "guess", want: []error{ErrInvalidResponse}},
+		{name: "expired nonce", qop: QopAuth, password: "secret", age: 10 * time.Minute, want: []error{ErrStaleNonce}},
+		{name: "expired nonce with wrong password", qop: QopAuth, password: "guess", age: 10 * time.Minute, want: []error{ErrInvalidResponse}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			a := New("example.com", NewMemoryStore(map[string]string{"alice": "secret"}), message.REGISTER)
+			a.Algorithms = []string{AlgorithmMD5}
+			a.now = func() time.Time { return now }
+
+			_, res := a.Authenticate(newRegister())
+			challenge, err := ParseChallenge(res.Msg.WWWAuthenticate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(tt.age)
+
+			req := newRegister()
+			authorize(req, challenge.Nonce, tt.password, tt.qop, 1)
+			_, err = a.Verify(req)
+			if tt.replay {
+				if err != nil {
+					t.Fatalf("first use failed: %v", err)
+				}
+				_, err = a.Verify(req)
+			}
+
+			if len(tt.want) == 0 && err != nil {
+				t.Errorf("verify failed: %v", err)
+			}
+			for _, want := range tt.want {
+				if !errors.Is(err, want) {
+					t.Errorf("error %v, want %v", err, want)
+				}
+			}
+			if errors.Is(err, ErrInvalidResponse) {
+				if _, res := a.Authenticate(req); res == nil || challengeOf(t, res).Stale {
+					t.Errorf("invalid digest got stale challenge")
+				}
+			}
+		})
+	}
+}
+
+func challengeOf(t *testing.T, res *message.Message) *Challenge {
+	c, err := ParseChallenge(res.Msg.WWWAuthenticate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/shend/simplesip/message"
+)
+
+// Digest algorithms (RFC 7616 3.3, RFC 8760)
+const (
+	AlgorithmMD5    = "MD5"
+	AlgorithmSHA256 = "SHA-256"
+)
+
+const QopAuth = "auth"
+
+var (
+	ErrNotDigest            = errors.New("authentication scheme is not Digest")
+	ErrUnsupportedAlgorithm = errors.New("unsupported digest algorithm")
+	ErrUnsupportedQop       = errors.New("unsupported qop")
+)
+
+// Challenge is WWW-Authenticate or Proxy-Authenticate header value
+type Challenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string
+	// Qop is comma separated list of offered qop values
+	Qop   string
+	Stale bool
+}
+
+// ParseChallenge parses Digest challenge
+func ParseChallenge(s string) (*Challenge, error) {
+	params, err := parseDigest(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Challenge{
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		Opaque:    params["opaque"],
+		Algorithm: params["algorithm"],
+		Qop:       params["qop"],
+		Stale:     strings.EqualFold(params["stale"], "true"),
+	}, nil
+}
+
+func (c *Challenge) String() string {
+	var b strings.Builder
+	b.WriteString("Digest realm=")
+	b.WriteString(strconv.Quote(c.Realm))
+	b.WriteString(", nonce=")
+	b.WriteString(strconv.Quote(c.Nonce))
+	if c.Opaque != "" {
+		b.WriteString(", opaque=")
+		b.WriteString(strconv.Quote(c.Opaque))
+	}
+	if c.Algorithm != "" {
+		b.WriteString(", algorithm=")
+		b.WriteString(c.Algorithm)
+	}
+	if c.Qop != "" {
+		b.WriteString(", qop=")
+		b.WriteString(strconv.Quote(c.Qop))
+	}
+	if c.Stale {
+		b.WriteString(", stale=true")
+	}
+	return b.String()
+}
+
+// HasQop checks if challenge offers qop value
+func (c *Challenge) HasQop(qop string) bool {
+	for _, v := range strings.Split(c.Qop, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), qop) {
+			return true
+		}
+	}
+	return false
+}
+
+// Credentials is Authorization or Proxy-Authorization header value
+type Credentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm string
+	Opaque    string
+	Qop       string
+	CNonce    string
+	// NC is nonce count, sent as 8 hex digits
+	NC uint32
+}
+
+// ParseCredentials parses Digest credentials
+func ParseCredentials(s string) (*Credentials, error) {
+	params, err := parseDigest(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &Credentials{
+		Username:  params["username"],
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		URI:       params["uri"],
+		Response:  params["response"],
+		Algorithm: params["algorithm"],
+		Opaque:    params["opaque"],
+		Qop:       params["qop"],
+		CNonce:    params["cnonce"],
+	}
+	if nc, ok := params["nc"]; ok {
+		n, err := strconv.ParseUint(nc, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nc err=%w", err)
+		}
+		c.NC = uint32(n)
+	}
+	return c, nil
+}
+
+func (c *Credentials) String() string {
+	var b strings.Builder
+	b.WriteString("Digest username=")
+	b.WriteString(strconv.Quote(c.Username))
+	b.WriteString(", realm=")
+	b.WriteString(strconv.Quote(c.Realm))
+	b.WriteString(", nonce=")
+	b.WriteString(strconv.Quote(c.Nonce))
+	b.WriteString(", uri=")
+	b.WriteString(strconv.Quote(c.URI))
+	b.WriteString(", response=")
+	b.WriteString(strconv.Quote(c.Response))
+	if c.Algorithm != "" {
+		b.WriteString(", algorithm=")
+		b.WriteString(c.Algorithm)
+	}
+	if c.Opaque != "" {
+		b.WriteString(", opaque=")
+		b.WriteString(strconv.Quote(c.Opaque))
+	}
+	if c.Qop != "" {
+		b.WriteString(", qop=")
+		b.WriteString(c.Qop)
+		b.WriteString(", nc=")
+		fmt.Fprintf(&b, "%08x", c.NC)
+		b.WriteString(", cnonce=")
+		b.WriteString(strconv.Quote(c.CNonce))
+	}
+	return b.String()
+}
+
+// Digest computes response of credentials for request method and password
+func (c *Credentials) Digest(method string, password string) (string, error) {
+	return c.DigestHA1(method, HA1(c.Algorithm, c.Username, c.Realm, password))
+}
+
+// DigestHA1 computes response of credentials from precomputed HA1
+func (c *Credentials) DigestHA1(method string, ha1 string) (string, error) {
+	h := hasher(c.Algorithm)
+	if h == nil {
+		return "", ErrUnsupportedAlgorithm
+	}
+
+	ha2 := hexHash(h, method+":"+c.URI)
+	switch c.Qop {
+	case "":
+		return hexHash(h, ha1+":"+c.Nonce+":"+ha2), nil
+	case QopAuth:
+		nc := fmt.Sprintf("%08x", c.NC)
+		return hexHash(h, ha1+":"+c.Nonce+":"+nc+":"+c.CNonce+":"+c.Qop+":"+ha2), nil
+	default:
+		return "", ErrUnsupportedQop
+	}
+}
+
+// HA1 computes hash of username, realm and password. Unknown algorithm yields empty string
+func HA1(algorithm string, username string, realm string, password string) string {
+	h := hasher(algorithm)
+	if h == nil {
+		return ""
+	}
+	return hexHash(h, username+":"+realm+":"+password)
+}
+
+// IsSupported checks if digest algorithm is supported. Empty algorithm means MD5
+func IsSupported(algorithm string) bool {
+	return hasher(algorithm) != nil
+}
+
+func hasher(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(algorithm) {
+	case "", AlgorithmMD5:
+		return md5.New
+	case AlgorithmSHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+func hexHash(h func() hash.Hash, s string) string {
+	d := h()
+	d.Write([]byte(s))
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// parseDigest parses comma separated auth-params of Digest scheme
+func parseDigest(s string) (map[string]string, error) {
+	h, err := message.ParseAuthHeader(s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(h.Scheme, "Digest") {
+		return nil, ErrNotDigest
+	}
+	return h.Params, nil
+}
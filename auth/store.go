@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// CredentialStore provides passwords of users
+type CredentialStore interface {
+	// Password returns password of username in realm, ErrUnknownUser if there is no such user
+	Password(realm string, username string) (string, error)
+}
+
+// MemoryStore is in-memory CredentialStore. Same users are used for all realms
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewMemoryStore creates store of users with passwords
+func NewMemoryStore(users map[string]string) *MemoryStore {
+	s := &MemoryStore{users: make(map[string]string, len(users))}
+	for username, password := range users {
+		s.users[username] = password
+	}
+	return s
+}
+
+// Set adds user or changes its password
+func (s *MemoryStore) Set(username string, password string) {
+	s.mu.Lock()
+	s.users[username] = password
+	s.mu.Unlock()
+}
+
+// Delete removes user
+func (s *MemoryStore) Delete(username string) {
+	s.mu.Lock()
+	delete(s.users, username)
+	s.mu.Unlock()
+}
+
+func (s *MemoryStore) Password(realm string, username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	password, ok := s.users[username]
+	if !ok {
+		return "", ErrUnknownUser
+	}
+	return password, nil
+}
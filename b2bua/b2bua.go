@@ -0,0 +1,251 @@
+package b2bua
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip"
+	"github.com/shend/simplesip/message"
+)
+
+// Leg is side of bridged call
+type Leg int
+
+const (
+	// LegA is leg of caller, its INVITE is received by B2BUA
+	LegA Leg = iota
+	// LegB is leg of callee, its INVITE is sent by B2BUA
+	LegB
+)
+
+func (l Leg) String() string {
+	if l == LegA {
+		return "A"
+	}
+	return "B"
+}
+
+// Other returns opposite leg
+func (l Leg) Other() Leg {
+	return 1 - l
+}
+
+// B2BUA is back-to-back user agent (RFC 3261 6). INVITE received on leg A is bridged
+// into new INVITE of leg B with its own Call-ID and tags. Responses are relayed back,
+// BYE, CANCEL and requests within dialog like re-INVITE, UPDATE and INFO are relayed
+// to the other leg.
+//
+// Register its handler for all relayed methods, e.g.
+//
+//	b := b2bua.New(srv, route)
+//	srv.OnInvite(b.Handler())
+//	srv.OnAck(b.Handler())
+//	srv.OnCancel(b.Handler())
+//	srv.OnBye(b.Handler())
+//	srv.OnUpdate(b.Handler())
+//	srv.OnInfo(b.Handler())
+type B2BUA struct {
+	srv *simplesip.Server
+	// Route returns Request-URI of leg B for INVITE of leg A. simplesip.ErrNoRoute is answered with 404.
+	Route simplesip.Router
+
+	// RewriteSDP can change SDP body relayed from leg to the other one, e.g. to anchor media
+	RewriteSDP func(c *Call, from Leg, sdp []byte) []byte
+	// RewriteRequest can change headers of request relayed from leg before it is sent
+	RewriteRequest func(c *Call, from Leg, req *message.Message)
+	// RewriteResponse can change headers of response relayed from leg before it is sent
+	RewriteResponse func(c *Call, from Leg, res *message.Message)
+
+	mu sync.Mutex
+	// pending are calls by Call-ID and From tag of INVITE of leg A, until it is answered
+	pending map[string]*Call
+	// calls are calls by dialog ID of both legs
+	calls map[string]*Call
+}
+
+// New creates B2BUA bridging INVITE of srv to Request-URI returned by route.
+// Hooks can be set before serving.
+func New(srv *simplesip.Server, route simplesip.Router) *B2BUA {
+	return &B2BUA{
+		srv:     srv,
+		Route:   route,
+		pending: make(map[string]*Call),
+		calls:   make(map[string]*Call),
+	}
+}
+
+// Handler returns request handler relaying requests between legs
+func (b *B2BUA) Handler() message.RequestHandler {
+	return b.handleRequest
+}
+
+// Calls returns bridged calls
+func (b *B2BUA) Calls() []*Call {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := make(map[*Call]bool)
+	calls := make([]*Call, 0, len(b.pending)+len(b.calls)/2)
+	for _, m := range []map[string]*Call{b.pending, b.calls} {
+		for _, c := range m {
+			if !seen[c] {
+				seen[c] = true
+				calls = append(calls, c)
+			}
+		}
+	}
+	return calls
+}
+
+func (b *B2BUA) handleRequest(ctx context.Context, req *message.Message) *message.Message {
+	method := message.RequestMethod(req.Msg.Method)
+
+	if method == message.CANCEL {
+		// Transaction layer already answered CANCEL and INVITE of leg A
+		if c := b.getPending(pendingKey(req)); c != nil {
+			c.cancel()
+		}
+		return nil
+	}
+
+	// To tag is set by request middleware, so new INVITE is told by unknown dialog
+	c, from := b.lookup(req)
+	if c == nil {
+		switch method {
+		case message.INVITE:
+			return b.invite(req)
+		case message.ACK:
+			return nil
+		}
+		return message.NewResponse(req, 481, "Call/Transaction Does Not Exist")
+	}
+
+	switch method {
+	case message.ACK:
+		c.ack(from, req)
+		return nil
+	case message.BYE:
+		b.remove(c)
+		go c.bye(from.Other())
+		return message.NewResponse(req, 200, "OK")
+	}
+
+	go c.relay(from, req)
+	return nil
+}
+
+// invite starts new call with INVITE of leg A
+func (b *B2BUA) invite(req *message.Message) *message.Message {
+	if n, ok := req.MaxForwards(); ok && n == 0 {
+		return message.NewResponse(req, 483, "Too Many Hops")
+	}
+
+	target, err := b.Route(req)
+	if err != nil || target == nil {
+		if errors.Is(err, simplesip.ErrNoRoute) || target == nil {
+			return message.NewResponse(req, 404, "Not Found")
+		}
+		slog.Error("route INVITE failed", "err", err)
+		return message.NewResponse(req, 500, "Server Internal Error")
+	}
+
+	c, err := newCall(b, req, target)
+	if err != nil {
+		slog.Error("create call failed", "err", err)
+		return message.NewResponse(req, 500, "Server Internal Error")
+	}
+
+	b.mu.Lock()
+	b.pending[pendingKey(req)] = c
+	b.mu.Unlock()
+
+	go c.connect()
+	return nil
+}
+
+// lookup returns call of request within dialog and leg it was received on
+func (b *B2BUA) lookup(req *message.Message) (*Call, Leg) {
+	id, err := req.MakeDialogIDFromMessage()
+	if err != nil {
+		return nil, LegA
+	}
+
+	b.mu.Lock()
+	c := b.calls[id]
+	b.mu.Unlock()
+	if c == nil {
+		return nil, LegA
+	}
+	return c, c.legOf(id)
+}
+
+func (b *B2BUA) getPending(key string) *Call {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending[key]
+}
+
+// bind maps dialog ID to call, replacing previous dialog of leg, e.g. early dialog of other fork
+func (b *B2BUA) bind(c *Call, old string, id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old != "" && b.calls[old] == c {
+		delete(b.calls, old)
+	}
+	b.calls[id] = c
+}
+
+// settle removes call from pending once INVITE of leg A is answered
+func (b *B2BUA) settle(c *Call) {
+	key := pendingKey(c.invite)
+	b.mu.Lock()
+	if b.pending[key] == c {
+		delete(b.pending, key)
+	}
+	b.mu.Unlock()
+}
+
+// remove forgets call
+func (b *B2BUA) remove(c *Call) {
+	b.settle(c)
+	b.mu.Lock()
+	for id, other := range b.calls {
+		if other == c {
+			delete(b.calls, id)
+		}
+	}
+	b.mu.Unlock()
+}
+
+// payload copies body relayed from leg, SDP goes through RewriteSDP
+func (b *B2BUA) payload(c *Call, from Leg, p sip.Payload) sip.Payload {
+	if p == nil {
+		return nil
+	}
+	data := append([]byte(nil), p.Data()...)
+	if p.ContentType() == "application/sdp" && b.RewriteSDP != nil {
+		data = b.RewriteSDP(c, from, data)
+	}
+	return &sip.MiscPayload{T: p.ContentType(), D: data}
+}
+
+func (b *B2BUA) rewriteRequest(c *Call, from Leg, req *message.Message) {
+	if b.RewriteRequest != nil {
+		b.RewriteRequest(c, from, req)
+	}
+}
+
+func (b *B2BUA) rewriteResponse(c *Call, from Leg, res *message.Message) {
+	if b.RewriteResponse != nil {
+		b.RewriteResponse(c, from, res)
+	}
+}
+
+// pendingKey identifies INVITE of leg A and its CANCEL
+func pendingKey(req *message.Message) string {
+	return req.GetCallID() + "|" + req.GetFromTag()
+}
@@ -0,0 +1,350 @@
+package b2bua
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip"
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+const (
+	sdpA = "v=0\r\no=a 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n"
+	sdpB = "v=0\r\no=b 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 6000 RTP/AVP 0\r\n"
+)
+
+// received is message read by peer
+type received struct {
+	msg  *message.Message
+	addr net.Addr
+}
+
+// peer is user agent of leg driven by test over UDP socket
+type peer struct {
+	t    *testing.T
+	conn net.PacketConn
+	port int
+	// queue are messages read while waiting for other ones
+	queue []received
+}
+
+func newPeer(t *testing.T) *peer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &peer{t: t, conn: conn, port: conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+func (p *peer) uri(user string) *sip.URI {
+	return &sip.URI{Scheme: "sip", User: user, Host: "127.0.0.1", Port: uint16(p.port)}
+}
+
+// expect returns first message matching what, others are kept for later
+func (p *peer) expect(what string, match func(m *message.Message) bool) (*message.Message, net.Addr) {
+	p.t.Helper()
+	for i, r := range p.queue {
+		if match(r.msg) {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return r.msg, r.addr
+		}
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			p.t.Fatalf("waiting for %s: %v", what, err)
+		}
+		// Native parser keeps SDP as text
+		msg, err := parser.NewNativeParser().ParseMsg(bytes.Clone(buf[:n]))
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if match(msg) {
+			return msg, addr
+		}
+		p.queue = append(p.queue, received{msg: msg, addr: addr})
+	}
+}
+
+// expectRequest returns next request of method
+func (p *peer) expectRequest(method message.RequestMethod) (*message.Message, net.Addr) {
+	p.t.Helper()
+	return p.expect(string(method), func(m *message.Message) bool {
+		return !m.Msg.IsResponse() && m.Msg.Method == string(method)
+	})
+}
+
+// expectResponse returns response of status to request of method
+func (p *peer) expectResponse(method message.RequestMethod, status int) *message.Message {
+	p.t.Helper()
+	res, _ := p.expect(string(method)+" response", func(m *message.Message) bool {
+		return m.Msg.IsResponse() && m.Msg.CSeqMethod == string(method) && m.Msg.Status == status
+	})
+	return res
+}
+
+func (p *peer) write(msg *message.Message, addr net.Addr) {
+	p.t.Helper()
+	var buf bytes.Buffer
+	msg.Append(&buf)
+	if _, err := p.conn.WriteTo(buf.Bytes(), addr); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// request creates request of peer within dialog
+func (p *peer) request(method message.RequestMethod, target *sip.URI, from *sip.Addr, to *sip.Addr, callID string, cseq int) *message.Message {
+	return message.NewRequest(method, target).
+		From(from).
+		To(to).
+		CallID(callID).
+		CSeq(cseq).
+		Via("127.0.0.1", p.port).
+		Transport("UDP").
+		Build()
+}
+
+// testB2BUA is B2BUA served on UDP with peers of both legs
+type testB2BUA struct {
+	t    *testing.T
+	b    *B2BUA
+	srv  *simplesip.Server
+	addr net.Addr
+	a    *peer
+	bob  *peer
+}
+
+// newTestB2BUA serves B2BUA, hooks can set its hooks before
+func newTestB2BUA(t *testing.T, hooks func(b *B2BUA)) *testB2BUA {
+	srv, err := simplesip.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := &testB2BUA{t: t, srv: srv, addr: conn.LocalAddr(), a: newPeer(t), bob: newPeer(t)}
+	tb.b = New(srv, func(req *message.Message) (*sip.URI, error) {
+		return tb.bob.uri("bob"), nil
+	})
+	for _, method := range []message.RequestMethod{message.INVITE, message.ACK, message.CANCEL, message.BYE, message.UPDATE, message.INFO} {
+		srv.OnMethod(method, tb.b.Handler())
+	}
+	if hooks != nil {
+		hooks(tb.b)
+	}
+	go srv.ServeUDP(conn)
+	return tb
+}
+
+// waitCalls waits until B2BUA has n calls
+func (tb *testB2BUA) waitCalls(n int) {
+	tb.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tb.b.Calls()) != n {
+		if time.Now().After(deadline) {
+			tb.t.Fatalf("%d calls, want %d", len(tb.b.Calls()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testCall is call bridged from peer a to peer bob
+type testCall struct {
+	// invite is INVITE sent by a, ok is its 2xx
+	invite *message.Message
+	ok     *message.Message
+	// inviteB is INVITE received by bob, okB is its 2xx
+	inviteB *message.Message
+	okB     *message.Message
+}
+
+// call sends INVITE of leg A and returns it with INVITE received on leg B
+func (tb *testB2BUA) call() (invite *message.Message, inviteB *message.Message, addrB net.Addr) {
+	tb.t.Helper()
+	invite = message.NewRequest(message.INVITE, &sip.URI{Scheme: "sip", User: "bob", Host: "example.com"}).
+		From(&sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}}).
+		Contact(&sip.Addr{Uri: tb.a.uri("alice")}).
+		Via("127.0.0.1", tb.a.port).
+		Transport("UDP").
+		SDP([]byte(sdpA)).
+		Build()
+	tb.a.write(invite, tb.addr)
+	inviteB, addrB = tb.bob.expectRequest(message.INVITE)
+	return invite, inviteB, addrB
+}
+
+// establish bridges call answered by bob with 2xx
+func (tb *testB2BUA) establish() *testCall {
+	tb.t.Helper()
+	invite, inviteB, addrB := tb.call()
+	tb.bob.write(message.NewRinging(inviteB), addrB)
+	okB := message.NewOK(inviteB, []byte(sdpB))
+	okB.Msg.Contact = &sip.Addr{Uri: tb.bob.uri("bob")}
+	tb.bob.write(okB, addrB)
+
+	tb.a.expectResponse(message.INVITE, 180)
+	ok := tb.a.expectResponse(message.INVITE, 200)
+	// INVITE of leg A carried offer, so leg B is acknowledged right away
+	tb.bob.expectRequest(message.ACK)
+	ack := tb.a.request(message.ACK, ok.Msg.Contact.Uri, invite.Msg.From, ok.Msg.To, invite.GetCallID(), invite.Msg.CSeq)
+	tb.a.write(ack, tb.addr)
+	return &testCall{invite: invite, ok: ok, inviteB: inviteB, okB: okB}
+}
+
+// requestA creates request of peer a within dialog of leg A
+func (tb *testB2BUA) requestA(c *testCall, method message.RequestMethod, cseq int) *message.Message {
+	return tb.a.request(method, c.ok.Msg.Contact.Uri, c.invite.Msg.From, c.ok.Msg.To, c.invite.GetCallID(), cseq)
+}
+
+// requestB creates request of peer bob within dialog of leg B
+func (tb *testB2BUA) requestB(c *testCall, method message.RequestMethod, cseq int) *message.Message {
+	return tb.bob.request(method, c.inviteB.Msg.Contact.Uri, c.okB.Msg.To, c.inviteB.Msg.From, c.inviteB.GetCallID(), cseq)
+}
+
+func TestBridgeAnswered(t *testing.T) {
+	tb := newTestB2BUA(t, func(b *B2BUA) {
+		b.RewriteSDP = func(c *Call, from Leg, sdp []byte) []byte {
+			if from == LegA {
+				return bytes.ReplaceAll(sdp, []byte("4000"), []byte("5000"))
+			}
+			return sdp
+		}
+	})
+	c := tb.establish()
+
+	a, b := c.invite.Msg, c.inviteB.Msg
+	if b.CallID == a.CallID || c.inviteB.GetFromTag() == c.invite.GetFromTag() {
+		t.Errorf("leg B reuses Call-ID %q or From tag %q of leg A", b.CallID, c.inviteB.GetFromTag())
+	}
+	if b.From.Uri.User != "alice" || b.Request.User != "bob" || b.Request.Port != uint16(tb.bob.port) {
+		t.Errorf("leg B From %s Request-URI %s", b.From, b.Request)
+	}
+	if n, _ := c.inviteB.MaxForwards(); n != 69 {
+		t.Errorf("leg B Max-Forwards %d, want 69", n)
+	}
+	if body := string(b.Payload.Data()); !strings.Contains(body, "m=audio 5000") {
+		t.Errorf("leg B offer not rewritten:\n%s", body)
+	}
+
+	ok := c.ok.Msg
+	if ok.Payload == nil || !strings.Contains(string(ok.Payload.Data()), "m=audio 6000") {
+		t.Errorf("leg A answer %v, want SDP of leg B", ok.Payload)
+	}
+	if ok.Contact == nil || ok.Contact.Uri.Port == uint16(tb.bob.port) {
+		t.Errorf("leg A Contact %v, want B2BUA", ok.Contact)
+	}
+	tb.waitCalls(1)
+}
+
+func TestCancelWhileRinging(t *testing.T) {
+	tb := newTestB2BUA(t, nil)
+	invite, inviteB, addrB := tb.call()
+	tb.bob.write(message.NewRinging(inviteB), addrB)
+	tb.a.expectResponse(message.INVITE, 180)
+
+	cancel := invite.Clone()
+	cancel.Msg.Method = string(message.CANCEL)
+	cancel.Msg.CSeqMethod = string(message.CANCEL)
+	cancel.Msg.Payload = nil
+	tb.a.write(&cancel, tb.addr)
+	tb.a.expectResponse(message.CANCEL, 200)
+	tb.a.expectResponse(message.INVITE, 487)
+
+	cancelB, addrB := tb.bob.expectRequest(message.CANCEL)
+	if cancelB.GetBranch() != inviteB.GetBranch() {
+		t.Errorf("CANCEL branch %q, want %q of INVITE", cancelB.GetBranch(), inviteB.GetBranch())
+	}
+	tb.bob.write(message.NewResponse(cancelB, 200, ""), addrB)
+	tb.bob.write(message.NewResponse(inviteB, 487, ""), addrB)
+	tb.bob.expectRequest(message.ACK)
+	tb.waitCalls(0)
+}
+
+func TestByeRelayed(t *testing.T) {
+	tests := []struct {
+		name string
+		from Leg
+	}{
+		{name: "from leg A", from: LegA},
+		{name: "from leg B", from: LegB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestB2BUA(t, nil)
+			c := tb.establish()
+			tb.waitCalls(1)
+
+			sender, receiver := tb.a, tb.bob
+			bye := tb.requestA(c, message.BYE, c.invite.Msg.CSeq+1)
+			wantCallID := c.inviteB.GetCallID()
+			if tt.from == LegB {
+				sender, receiver = tb.bob, tb.a
+				bye = tb.requestB(c, message.BYE, 1)
+				wantCallID = c.invite.GetCallID()
+			}
+
+			sender.write(bye, tb.addr)
+			sender.expectResponse(message.BYE, 200)
+			relayed, addr := receiver.expectRequest(message.BYE)
+			if relayed.GetCallID() != wantCallID {
+				t.Errorf("BYE relayed with Call-ID %q, want %q", relayed.GetCallID(), wantCallID)
+			}
+			receiver.write(message.NewResponse(relayed, 200, ""), addr)
+
+			tb.waitCalls(0)
+			deadline := time.Now().Add(5 * time.Second)
+			for tb.srv.Dialogs().Len() != 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("%d dialogs left", tb.srv.Dialogs().Len())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestReInviteRelayed(t *testing.T) {
+	tb := newTestB2BUA(t, nil)
+	c := tb.establish()
+
+	hold := strings.Replace(sdpA, "m=audio 4000 RTP/AVP 0\r\n", "m=audio 4000 RTP/AVP 0\r\na=sendonly\r\n", 1)
+	reinvite := tb.requestA(c, message.INVITE, c.invite.Msg.CSeq+1)
+	reinvite.SetSDP([]byte(hold))
+	tb.a.write(reinvite, tb.addr)
+
+	relayed, addrB := tb.bob.expectRequest(message.INVITE)
+	if relayed.GetCallID() != c.inviteB.GetCallID() || relayed.GetToTag() != c.okB.GetToTag() {
+		t.Errorf("re-INVITE outside dialog of leg B, Call-ID %q To tag %q", relayed.GetCallID(), relayed.GetToTag())
+	}
+	if relayed.Msg.CSeq <= c.inviteB.Msg.CSeq {
+		t.Errorf("re-INVITE CSeq %d, want above %d", relayed.Msg.CSeq, c.inviteB.Msg.CSeq)
+	}
+	if relayed.Msg.Payload == nil || !strings.Contains(string(relayed.Msg.Payload.Data()), "a=sendonly") {
+		t.Errorf("re-INVITE offer %v, want hold", relayed.Msg.Payload)
+	}
+
+	tb.bob.write(message.NewOK(relayed, []byte(sdpB)), addrB)
+	ok := tb.a.expectResponse(message.INVITE, 200)
+	if ok.Msg.CSeq != reinvite.Msg.CSeq || ok.GetToTag() != c.ok.GetToTag() {
+		t.Errorf("2xx of re-INVITE CSeq %d To tag %q", ok.Msg.CSeq, ok.GetToTag())
+	}
+	if ack, _ := tb.bob.expectRequest(message.ACK); ack.Msg.CSeq != relayed.Msg.CSeq {
+		t.Errorf("ACK CSeq %d, want %d", ack.Msg.CSeq, relayed.Msg.CSeq)
+	}
+	tb.a.write(tb.requestA(c, message.ACK, reinvite.Msg.CSeq), tb.addr)
+	tb.waitCalls(1)
+}
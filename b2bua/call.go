@@ -0,0 +1,361 @@
+package b2bua
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/dialog"
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/transaction"
+	"github.com/shend/simplesip/transport"
+)
+
+// Call is pair of legs bridged by B2BUA
+type Call struct {
+	b      *B2BUA
+	invite *message.Message
+	target *sip.URI
+
+	mu   sync.Mutex
+	legs [2]leg
+	// stop cancels INVITE of leg B
+	stop     context.CancelFunc
+	canceled bool
+}
+
+// leg is state of one side of call
+type leg struct {
+	dialog *dialog.Dialog
+	// contact is our Contact within dialog of leg
+	contact *sip.Addr
+	// ack sends ACK of 2xx on other leg once ACK with answer arrives on this leg
+	ack func(payload sip.Payload)
+}
+
+func newCall(b *B2BUA, req *message.Message, target *sip.URI) (*Call, error) {
+	host, port, err := b.srv.TransportLayer().LocalAddr(req.Transport, req.Source)
+	if err != nil {
+		return nil, fmt.Errorf("resolve local address failed err=%w", err)
+	}
+	uri := &sip.URI{
+		Scheme: "sip",
+		User:   req.Msg.Request.User,
+		Host:   host,
+		Port:   uint16(port),
+	}
+	if req.Transport != transport.TransportUDP {
+		uri.Param = &sip.URIParam{Name: "transport", Value: transport.NetworkToLower(req.Transport)}
+	}
+
+	c := &Call{
+		b:      b,
+		invite: req,
+		target: target,
+	}
+	c.legs[LegA].contact = &sip.Addr{Uri: uri}
+	return c, nil
+}
+
+// Invite returns INVITE received on leg A
+func (c *Call) Invite() *message.Message {
+	return c.invite
+}
+
+// Target returns Request-URI of INVITE of leg B
+func (c *Call) Target() *sip.URI {
+	return c.target
+}
+
+// Dialog returns dialog of leg, nil until leg has one
+func (c *Call) Dialog(l Leg) *dialog.Dialog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.legs[l].dialog
+}
+
+// Hangup ends call with BYE on both legs
+func (c *Call) Hangup() {
+	c.b.remove(c)
+	c.cancel()
+	c.bye(LegA)
+	c.bye(LegB)
+}
+
+// connect sends INVITE of leg B and relays its responses to leg A
+func (c *Call) connect() {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	c.mu.Lock()
+	if c.canceled {
+		c.mu.Unlock()
+		c.b.remove(c)
+		return
+	}
+	c.stop = stop
+	c.mu.Unlock()
+
+	req := c.newInvite()
+	c.b.rewriteRequest(c, LegA, req)
+	ch, err := c.b.srv.Request(ctx, req)
+	if err != nil {
+		slog.Error("send INVITE of leg B failed", "err", err, "target", c.target.String())
+		c.respond(message.NewResponse(c.invite, 500, "Server Internal Error"))
+		c.b.remove(c)
+		return
+	}
+	c.mu.Lock()
+	c.legs[LegB].contact = req.Msg.Contact
+	c.mu.Unlock()
+
+	established, answered := false, false
+	for res := range ch {
+		status := res.Msg.Status
+		if status == 100 {
+			continue
+		}
+		if status < 300 {
+			c.bind(LegB, message.MakeDialogID(res.GetCallID(), res.GetFromTag(), res.GetToTag()))
+		}
+
+		if status >= 200 && status < 300 && c.isCanceled() {
+			// Leg A is gone already, so leg B is ended right away. 2xx arriving after
+			// stop is not delivered, Request acknowledges and ends it itself.
+			if err := c.b.srv.Ack(req, res); err != nil {
+				slog.Error("send ACK of leg B failed", "err", err)
+			}
+			c.bye(LegB)
+			break
+		}
+		if status >= 200 && status < 300 {
+			c.acknowledge(LegA, c.invite, req, res)
+			established = true
+		}
+
+		out := c.response(c.invite, res, LegB)
+		c.respond(out)
+		if status < 300 {
+			c.bind(LegA, message.MakeDialogID(out.GetCallID(), out.GetToTag(), out.GetFromTag()))
+		}
+		answered = status >= 200
+	}
+
+	if !answered {
+		// INVITE of leg A is answered with 487 by transaction layer on CANCEL, not on Hangup
+		if tx := c.b.srv.TransactionLayer().FindServerTx(c.invite); tx != nil && tx.State() == transaction.StateProceeding {
+			c.respond(message.NewResponse(c.invite, 487, "Request Terminated"))
+		}
+	}
+	c.b.settle(c)
+	if !established {
+		c.b.remove(c)
+	}
+}
+
+// cancel stops INVITE of leg B after CANCEL of leg A
+func (c *Call) cancel() {
+	c.mu.Lock()
+	c.canceled = true
+	stop := c.stop
+	c.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+func (c *Call) isCanceled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.canceled
+}
+
+// relay sends request received within dialog of leg from to the other leg and relays its responses back
+func (c *Call) relay(from Leg, req *message.Message) {
+	to := from.Other()
+	d := c.Dialog(to)
+	if d == nil {
+		c.respond(message.NewResponse(req, 481, "Call/Transaction Does Not Exist"))
+		return
+	}
+
+	out := d.NewRequest(message.RequestMethod(req.Msg.Method))
+	out.Msg.Payload = c.b.payload(c, from, req.Msg.Payload)
+	out.Msg.XHeader = copyXHeader(req.Msg.XHeader)
+	switch message.RequestMethod(req.Msg.Method) {
+	case message.INVITE, message.UPDATE:
+		c.mu.Lock()
+		if contact := c.legs[to].contact; contact != nil {
+			out.Msg.Contact = contact.Copy()
+		}
+		c.mu.Unlock()
+	}
+	c.b.rewriteRequest(c, from, out)
+
+	ch, err := c.b.srv.Request(context.Background(), out)
+	if err != nil {
+		slog.Error("relay request failed", "err", err, "method", req.Msg.Method, "leg", to)
+		c.respond(message.NewResponse(req, 500, "Server Internal Error"))
+		return
+	}
+
+	for res := range ch {
+		status := res.Msg.Status
+		if status == 100 {
+			continue
+		}
+		if status >= 200 && status < 300 && req.Msg.Method == string(message.INVITE) {
+			c.acknowledge(from, req, out, res)
+		}
+		c.respond(c.response(req, res, to))
+	}
+}
+
+// bye sends BYE within dialog of leg
+func (c *Call) bye(l Leg) {
+	d := c.Dialog(l)
+	if d == nil || d.State() == dialog.StateTerminated {
+		return
+	}
+
+	ch, err := c.b.srv.Request(context.Background(), d.NewBye())
+	if err != nil {
+		slog.Error("send BYE failed", "err", err, "leg", l)
+		return
+	}
+	for res := range ch {
+		if res.Msg.Status >= 300 {
+			// Session is over once BYE is sent, whatever the response (RFC 3261 15.1.1)
+			slog.Debug("BYE rejected", "status", res.Msg.Status, "leg", l)
+			c.b.srv.Dialogs().Remove(d)
+		}
+	}
+}
+
+// acknowledge sends ACK of 2xx of INVITE sent to other leg than from. When INVITE
+// received on leg from had no offer, 2xx carries offer and ACK waits for answer
+// carried by ACK of leg from.
+func (c *Call) acknowledge(from Leg, received *message.Message, sent *message.Message, res *message.Message) {
+	if received.Msg.Payload != nil {
+		if err := c.b.srv.Ack(sent, res); err != nil {
+			slog.Error("send ACK failed", "err", err, "leg", from.Other())
+		}
+		return
+	}
+
+	c.mu.Lock()
+	c.legs[from].ack = func(payload sip.Payload) {
+		if err := c.b.srv.AckWithPayload(sent, res, payload); err != nil {
+			slog.Error("send ACK failed", "err", err, "leg", from.Other())
+		}
+	}
+	c.mu.Unlock()
+}
+
+// ack handles ACK of 2xx received on leg from
+func (c *Call) ack(from Leg, req *message.Message) {
+	c.mu.Lock()
+	send := c.legs[from].ack
+	c.legs[from].ack = nil
+	c.mu.Unlock()
+
+	if send != nil {
+		send(c.b.payload(c, from, req.Msg.Payload))
+	}
+}
+
+// bind sets dialog of leg once it exists
+func (c *Call) bind(l Leg, id string) {
+	d := c.b.srv.Dialogs().Get(id)
+	if d == nil {
+		return
+	}
+
+	c.mu.Lock()
+	var old string
+	if prev := c.legs[l].dialog; prev != nil {
+		old = prev.ID
+	}
+	c.legs[l].dialog = d
+	c.mu.Unlock()
+
+	if old != id {
+		c.b.bind(c, old, id)
+	}
+}
+
+// legOf returns leg of dialog ID
+func (c *Call) legOf(id string) Leg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d := c.legs[LegB].dialog; d != nil && d.ID == id {
+		return LegB
+	}
+	return LegA
+}
+
+// newInvite creates INVITE of leg B with own Call-ID and tags, From and To of leg A are kept
+func (c *Call) newInvite() *message.Message {
+	a := c.invite.Msg
+	req := &message.Message{
+		Msg: &sip.Msg{
+			Method:  string(message.INVITE),
+			Request: c.target.Copy(),
+			From:    &sip.Addr{Uri: a.From.Uri.Copy(), Display: a.From.Display},
+			To:      &sip.Addr{Uri: a.To.Uri.Copy(), Display: a.To.Display},
+			Payload: c.b.payload(c, LegA, a.Payload),
+			XHeader: copyXHeader(a.XHeader),
+		},
+	}
+	req.DecrementMaxForwards()
+	return req
+}
+
+// response translates response received on leg from into response of req received on other leg
+func (c *Call) response(req *message.Message, res *message.Message, from Leg) *message.Message {
+	status, phrase := res.Msg.Status, res.Msg.Phrase
+	if status == 401 || status == 407 {
+		// Challenge of leg B can not be answered by credentials of leg A
+		status, phrase = 403, "Forbidden"
+	}
+
+	out := message.NewResponse(req, status, phrase)
+	out.Msg.Payload = c.b.payload(c, from, res.Msg.Payload)
+	out.Msg.XHeader = copyXHeader(res.Msg.XHeader)
+	out.Msg.Warning = res.Msg.Warning
+	out.Msg.RetryAfter = res.Msg.RetryAfter
+	if status > 100 && status < 300 {
+		switch message.RequestMethod(req.Msg.Method) {
+		case message.INVITE, message.UPDATE:
+			c.mu.Lock()
+			if contact := c.legs[from.Other()].contact; contact != nil {
+				out.Msg.Contact = contact.Copy()
+			}
+			c.mu.Unlock()
+		}
+	}
+	c.b.rewriteResponse(c, from, out)
+	return out
+}
+
+// respond sends response on leg of req
+func (c *Call) respond(res *message.Message) {
+	if err := c.b.srv.WriteResponse(res); err != nil {
+		slog.Error("relay response failed", "err", err, "status", res.Msg.Status)
+	}
+}
+
+// copyXHeader copies extension headers, as Msg.Copy shares them
+func copyXHeader(h *sip.XHeader) *sip.XHeader {
+	var head *sip.XHeader
+	tail := &head
+	for ; h != nil; h = h.Next {
+		x := &sip.XHeader{Name: h.Name, Value: append([]byte(nil), h.Value...)}
+		*tail = x
+		tail = &x.Next
+	}
+	return head
+}
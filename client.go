@@ -0,0 +1,433 @@
+package simplesip
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	jartsip "github.com/jart/gosip/sip"
+	jartutil "github.com/jart/gosip/util"
+
+	"github.com/shend/simplesip/dialog"
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/transaction"
+	"github.com/shend/simplesip/transport"
+)
+
+var (
+	ErrInvalidRequest = errors.New("request must have method, Request-URI and From header")
+)
+
+// Request sends request through client transaction and returns channel of responses.
+// Provisional responses are followed by single final response, then channel is closed.
+// Timeout and transport failure are reported as 408 and 503 responses (RFC 3261 8.1.3.1).
+//
+// Missing Via, branch, Call-ID, From tag, To, CSeq and Contact of INVITE, SUBSCRIBE
+// and REFER are filled in. When ctx is
+// canceled channel is closed and pending INVITE is canceled. 2xx of INVITE must be
+// acknowledged with Ack, unless it arrives after ctx is canceled; it is then
+// acknowledged and its dialog ended with BYE by Request itself.
+func (srv *Server) Request(ctx context.Context, req *message.Message) (<-chan *message.Message, error) {
+	if err := srv.prepareRequest(req); err != nil {
+		return nil, err
+	}
+
+	srv.auth.preauthorize(req)
+
+	subscribe := req.Msg.Method == string(message.SUBSCRIBE) && !dialog.IsInDialog(req)
+	if subscribe {
+		srv.dialogs.AddPendingSubscribe(req)
+	}
+
+	q := newResponseQueue(req)
+	if err := srv.sendRequest(req, q, subscribe, 0); err != nil {
+		if subscribe {
+			srv.dialogs.RemovePendingSubscribe(req)
+		}
+		return nil, err
+	}
+
+	out := make(chan *message.Message)
+	go srv.forwardResponses(ctx, q, out)
+
+	return out, nil
+}
+
+// RequestFunc sends request like Request and calls handler with every response of it,
+// final response included. Handler is called from own goroutine.
+func (srv *Server) RequestFunc(ctx context.Context, req *message.Message, handler message.ResponseHandler) error {
+	ch, err := srv.Request(ctx, req)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for res := range ch {
+			handler(res)
+		}
+	}()
+	return nil
+}
+
+// sendRequest sends request through client transaction delivering responses to q.
+// 401 and 407 are answered by resubmitting request with credentials when possible.
+func (srv *Server) sendRequest(req *message.Message, q *responseQueue, subscribe bool, attempt int) error {
+	tx, err := srv.tx.Request(req, func(res *message.Message, err error) {
+		if res != nil && (res.Msg.Status == 401 || res.Msg.Status == 407) {
+			if next := srv.auth.retry(req, res, attempt); next != nil {
+				if subscribe {
+					srv.dialogs.AddPendingSubscribe(next)
+				}
+				err := srv.sendRequest(next, q, subscribe, attempt+1)
+				if err == nil {
+					return
+				}
+				slog.Error("resubmit request with credentials failed", "err", err)
+			}
+		}
+
+		if res != nil {
+			if _, err := srv.dialogs.OnClientResponse(req, res); err != nil {
+				slog.Debug("dialog not created", "err", err)
+			}
+		}
+		if subscribe && (res == nil || res.Msg.Status >= 200) {
+			srv.dialogs.RemovePendingSubscribe(req)
+		}
+		q.push(res, err)
+	})
+	if err != nil {
+		return err
+	}
+
+	q.setTx(tx)
+	return nil
+}
+
+// Ack sends ACK for 2xx response of INVITE (RFC 3261 13.2.2.4).
+// ACK of 2xx is not part of INVITE transaction, it is sent directly to remote target.
+func (srv *Server) Ack(invite *message.Message, res *message.Message) error {
+	return srv.AckWithPayload(invite, res, nil)
+}
+
+// AckWithPayload sends ACK for 2xx response with payload, e.g. SDP answer to offer of 2xx
+func (srv *Server) AckWithPayload(invite *message.Message, res *message.Message, payload jartsip.Payload) error {
+	ack := &jartsip.Msg{
+		Method:     string(message.ACK),
+		Request:    invite.Msg.Request.Copy(),
+		From:       invite.Msg.From.Copy(),
+		To:         res.Msg.To.Copy(),
+		Route:      invite.Msg.Route.Copy(),
+		CallID:     invite.Msg.CallID,
+		CSeq:       res.Msg.CSeq,
+		CSeqMethod: string(message.ACK),
+		Payload:    payload,
+	}
+	if res.Msg.Contact != nil {
+		ack.Request = res.Msg.Contact.Uri.Copy()
+	}
+	if res.Msg.RecordRoute != nil {
+		ack.Route = res.Msg.RecordRoute.Reversed()
+	}
+	if invite.Msg.Via != nil {
+		via := invite.Msg.Via.Detach()
+		via.Param = message.RemoveParam(via.Param, "branch")
+		ack.Via = via.Branch()
+	}
+
+	return srv.SendAck(&message.Message{
+		Msg:       ack,
+		Transport: invite.Transport,
+	})
+}
+
+// SendAck sends ACK of 2xx built by hand or by Dialog.NewAck. It is sent directly
+// to remote target without transaction.
+func (srv *Server) SendAck(ack *message.Message) error {
+	if err := srv.prepareRequest(ack); err != nil {
+		return err
+	}
+	if ack.GetBranch() == "" {
+		ack.Msg.Via = ack.Msg.Via.Branch()
+	}
+
+	return srv.tp.WriteMsg(ack)
+}
+
+// prepareRequest fills missing headers and resolves destination of request
+func (srv *Server) prepareRequest(req *message.Message) error {
+	msg := req.Msg
+	if msg == nil || msg.Method == "" || msg.Request == nil || msg.From == nil {
+		return ErrInvalidRequest
+	}
+
+	if req.Destination == "" {
+		strictRoute(msg)
+	}
+
+	if req.Transport == "" {
+		req.Transport = requestTransport(msg)
+	}
+
+	if req.Destination == "" {
+		dst, err := requestDestination(msg, req.Transport)
+		if err != nil {
+			return err
+		}
+		req.Destination = dst
+	}
+
+	if msg.Via == nil {
+		msg.Via = &jartsip.Via{Param: &jartsip.Param{Name: "rport"}}
+	}
+	if msg.Via.Host == "" {
+		// Via of message.NewRequest carries branch and rport only
+		host, port, err := srv.tp.LocalAddr(req.Transport, req.Destination)
+		if err != nil {
+			return err
+		}
+		msg.Via.Transport = req.Transport
+		msg.Via.Host = host
+		msg.Via.Port = uint16(port)
+	}
+
+	if msg.To == nil {
+		msg.To = &jartsip.Addr{Uri: msg.Request.Copy()}
+	}
+	if req.GetFromTag() == "" {
+		msg.From = msg.From.Copy().Tag()
+	}
+	if msg.CallID == "" {
+		msg.CallID = jartutil.GenerateCallID()
+	}
+	if msg.CSeq == 0 {
+		msg.CSeq = 1
+	}
+	msg.CSeqMethod = msg.Method
+
+	if msg.Contact == nil {
+		switch message.RequestMethod(msg.Method) {
+		case message.INVITE, message.SUBSCRIBE, message.REFER:
+			msg.Contact = localContact(msg.From.Uri.User, req)
+		}
+	}
+
+	return nil
+}
+
+// requestTransport picks transport from top Route or Request-URI
+func requestTransport(msg *jartsip.Msg) string {
+	uri := msg.Request
+	if msg.Route != nil && msg.Route.Uri != nil {
+		uri = msg.Route.Uri
+	}
+	if msg.Request.Scheme == "sips" || uri.Scheme == "sips" {
+		return transport.TransportTLS
+	}
+	if p := uri.Param.Get("transport"); p != nil && p.Value != "" {
+		return strings.ToUpper(p.Value)
+	}
+	return transport.TransportUDP
+}
+
+// requestDestination resolves next hop from top Route or Request-URI
+func requestDestination(msg *jartsip.Msg, network string) (string, error) {
+	uri := msg.Request
+	if msg.Route != nil && msg.Route.Uri != nil {
+		uri = msg.Route.Uri
+	}
+	if uri.Host == "" {
+		return "", errors.New("missing host of next hop")
+	}
+
+	port := uri.Port
+	if port == 0 {
+		port = uri.GetPort()
+		if network == transport.TransportTLS || network == transport.TransportWSS {
+			port = 5061
+		}
+	}
+
+	return net.JoinHostPort(uri.Host, strconv.Itoa(int(port))), nil
+}
+
+// forwardResponses delivers queued responses to out until final response or ctx is done
+func (srv *Server) forwardResponses(ctx context.Context, q *responseQueue, out chan<- *message.Message) {
+	defer close(out)
+
+	for {
+		for {
+			res, ok := q.pop()
+			if !ok {
+				break
+			}
+			select {
+			case out <- res:
+			case <-ctx.Done():
+				go srv.abandonRequest(q, res)
+				return
+			}
+			if res.Msg.Status >= 200 {
+				return
+			}
+		}
+
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			go srv.abandonRequest(q, nil)
+			return
+		}
+	}
+}
+
+// abandonRequest cancels pending INVITE after ctx of Request is done and drains
+// responses until final one, starting with res not delivered yet unless it is nil.
+// 2xx of INVITE racing CANCEL has nobody to take it, so it is acknowledged and
+// its dialog is ended with BYE right away.
+func (srv *Server) abandonRequest(q *responseQueue, res *message.Message) {
+	canceled := false
+	for {
+		for res != nil {
+			if res.Msg.Status >= 200 {
+				req := q.currentTx().Request()
+				if res.Msg.Status < 300 && req.Msg.Method == string(message.INVITE) {
+					srv.hangup(req, res)
+				}
+				return
+			}
+			res, _ = q.pop()
+		}
+
+		if !canceled {
+			canceled = srv.cancelRequest(q)
+		}
+		<-q.notify
+		res, _ = q.pop()
+	}
+}
+
+// cancelRequest sends CANCEL for pending INVITE. CANCEL must not be sent before
+// provisional response is received (RFC 3261 9.1), it returns false when it
+// has to be called again after next response.
+func (srv *Server) cancelRequest(q *responseQueue) bool {
+	tx := q.currentTx()
+	req := tx.Request()
+	if req.Msg.Method != string(message.INVITE) {
+		return true
+	}
+
+	switch tx.State() {
+	case transaction.StateProceeding:
+		cancel := transaction.NewCancel(req)
+		if _, err := srv.tx.Request(cancel, nil); err != nil {
+			slog.Error("send CANCEL failed", "err", err)
+		}
+		return true
+	case transaction.StateCalling:
+		return false
+	}
+	return true
+}
+
+// hangup acknowledges 2xx of abandoned INVITE and ends its dialog with BYE
+func (srv *Server) hangup(invite *message.Message, res *message.Message) {
+	if err := srv.Ack(invite, res); err != nil {
+		slog.Error("send ACK of abandoned INVITE failed", "err", err)
+	}
+
+	d := srv.dialogs.Get(message.MakeDialogID(res.GetCallID(), res.GetFromTag(), res.GetToTag()))
+	if d == nil {
+		return
+	}
+	ch, err := srv.Request(context.Background(), d.NewBye())
+	if err != nil {
+		slog.Error("send BYE of abandoned INVITE failed", "err", err)
+		srv.dialogs.Remove(d)
+		return
+	}
+	for res := range ch {
+		if res.Msg.Status >= 300 {
+			// Session is over once BYE is sent, whatever the response (RFC 3261 15.1.1)
+			srv.dialogs.Remove(d)
+		}
+	}
+}
+
+// responseQueue buffers responses of client transaction, so transport is never blocked by slow reader
+type responseQueue struct {
+	mu sync.Mutex
+	// req and tx are last sent request and its transaction, they change when request is resubmitted
+	req    *message.Message
+	tx     *transaction.ClientTx
+	queue  []*message.Message
+	notify chan struct{}
+}
+
+func newResponseQueue(req *message.Message) *responseQueue {
+	return &responseQueue{
+		req:    req,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (q *responseQueue) setTx(tx *transaction.ClientTx) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// resubmitted request may be sent before Request of previous one returns
+	if q.tx != nil && tx.Request().Msg.CSeq < q.req.Msg.CSeq {
+		return
+	}
+	q.tx = tx
+	q.req = tx.Request()
+}
+
+func (q *responseQueue) currentTx() *transaction.ClientTx {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.tx
+}
+
+// push is transaction.ResponseHandler
+func (q *responseQueue) push(res *message.Message, err error) {
+	if err != nil {
+		res = q.failure(err)
+	}
+
+	q.mu.Lock()
+	q.queue = append(q.queue, res)
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *responseQueue) pop() (*message.Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) == 0 {
+		return nil, false
+	}
+	res := q.queue[0]
+	q.queue = q.queue[1:]
+	return res, true
+}
+
+// failure synthesizes final response for transaction error
+func (q *responseQueue) failure(err error) *message.Message {
+	status := 503
+	if errors.Is(err, transaction.ErrTimeout) {
+		status = 408
+	}
+
+	q.mu.Lock()
+	req := q.req
+	q.mu.Unlock()
+
+	return message.NewWarning(req, status, err.Error())
+}
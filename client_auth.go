@@ -0,0 +1,184 @@
+package simplesip
+
+import (
+	"strings"
+	"sync"
+
+	jartutil "github.com/jart/gosip/util"
+
+	"github.com/shend/simplesip/auth"
+	"github.com/shend/simplesip/message"
+)
+
+// maxAuthAttempts limits resubmissions of one request answered with challenge
+const maxAuthAttempts = 2
+
+// SetCredentials sets username and password used to answer challenges of realm.
+// Credentials of empty realm are used for realms without own credentials.
+func (srv *Server) SetCredentials(realm string, username string, password string) {
+	srv.auth.setCredentials(realm, username, password)
+}
+
+type clientCredentials struct {
+	username string
+	password string
+}
+
+// authSession is last challenge of realm, reused to authorize requests preemptively
+type authSession struct {
+	challenge *auth.Challenge
+	proxy     bool
+	nc        uint32
+}
+
+// clientAuth answers Digest challenges of outgoing requests
+type clientAuth struct {
+	mu          sync.Mutex
+	credentials map[string]clientCredentials
+	sessions    map[string]*authSession
+	// realms maps host of Request-URI to realm of its last challenge
+	realms map[string]string
+}
+
+func newClientAuth() *clientAuth {
+	return &clientAuth{
+		credentials: make(map[string]clientCredentials),
+		sessions:    make(map[string]*authSession),
+		realms:      make(map[string]string),
+	}
+}
+
+func (a *clientAuth) setCredentials(realm string, username string, password string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.credentials[realm] = clientCredentials{username: username, password: password}
+	delete(a.sessions, realm)
+}
+
+func (a *clientAuth) lookup(realm string) (clientCredentials, bool) {
+	if c, ok := a.credentials[realm]; ok {
+		return c, true
+	}
+	c, ok := a.credentials[""]
+	return c, ok
+}
+
+// preauthorize adds credentials computed from cached nonce of realm of Request-URI host
+func (a *clientAuth) preauthorize(req *message.Message) {
+	method := message.RequestMethod(req.Msg.Method)
+	if method == message.ACK || method == message.CANCEL {
+		return
+	}
+	if req.Msg.Authorization != "" || req.Msg.ProxyAuthorization != "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	realm, ok := a.realms[strings.ToLower(req.Msg.Request.Host)]
+	if !ok {
+		return
+	}
+	s, ok := a.sessions[realm]
+	if !ok {
+		return
+	}
+	if err := a.authorizeLocked(req, s); err != nil {
+		delete(a.sessions, realm)
+	}
+}
+
+// retry creates request resubmitted with credentials for challenge of res.
+// It returns nil when challenge can not be answered.
+func (a *clientAuth) retry(req *message.Message, res *message.Message, attempt int) *message.Message {
+	if attempt >= maxAuthAttempts {
+		return nil
+	}
+
+	header, proxy := res.Msg.WWWAuthenticate, false
+	if res.Msg.Status == 407 {
+		header, proxy = res.Msg.ProxyAuthenticate, true
+	}
+	challenge, err := auth.ParseChallenge(header)
+	if err != nil || !auth.IsSupported(challenge.Algorithm) {
+		return nil
+	}
+
+	// Same nonce without stale flag means our credentials were refused
+	if used := sentCredentials(req, proxy); used != nil && used.Nonce == challenge.Nonce && !challenge.Stale {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.lookup(challenge.Realm); !ok {
+		return nil
+	}
+
+	s := &authSession{challenge: challenge, proxy: proxy}
+	a.sessions[challenge.Realm] = s
+	a.realms[strings.ToLower(req.Msg.Request.Host)] = challenge.Realm
+
+	next := req.Clone()
+	next.Msg.CSeq++
+	next.Msg.Via.Param = message.RemoveParam(next.Msg.Via.Param, "branch")
+	if err := a.authorizeLocked(&next, s); err != nil {
+		return nil
+	}
+
+	return &next
+}
+
+// authorizeLocked sets Authorization or Proxy-Authorization of request. Must be called with lock held.
+func (a *clientAuth) authorizeLocked(req *message.Message, s *authSession) error {
+	c, ok := a.lookup(s.challenge.Realm)
+	if !ok {
+		return auth.ErrUnknownUser
+	}
+
+	creds := &auth.Credentials{
+		Username:  c.username,
+		Realm:     s.challenge.Realm,
+		Nonce:     s.challenge.Nonce,
+		URI:       req.Msg.Request.String(),
+		Algorithm: s.challenge.Algorithm,
+		Opaque:    s.challenge.Opaque,
+	}
+	if s.challenge.HasQop(auth.QopAuth) {
+		s.nc++
+		creds.Qop = auth.QopAuth
+		creds.NC = s.nc
+		creds.CNonce = jartutil.GenerateTag()
+	}
+
+	response, err := creds.Digest(req.Msg.Method, c.password)
+	if err != nil {
+		return err
+	}
+	creds.Response = response
+
+	if s.proxy {
+		req.Msg.ProxyAuthorization = creds.String()
+	} else {
+		req.Msg.Authorization = creds.String()
+	}
+	return nil
+}
+
+// sentCredentials returns credentials request was sent with
+func sentCredentials(req *message.Message, proxy bool) *auth.Credentials {
+	header := req.Msg.Authorization
+	if proxy {
+		header = req.Msg.ProxyAuthorization
+	}
+	if header == "" {
+		return nil
+	}
+	creds, err := auth.ParseCredentials(header)
+	if err != nil {
+		return nil
+	}
+	return creds
+}
@@ -0,0 +1,98 @@
+package simplesip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	jartsip "github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+func TestSendAckAddsVia(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerPort := peer.Addr().(*net.TCPAddr).Port
+
+	// ACK of Dialog.NewAck has no Via
+	ack := &message.Message{Msg: &jartsip.Msg{
+		Method: string(message.ACK),
+		Request: &jartsip.URI{
+			Scheme: "sip",
+			User:   "bob",
+			Host:   "127.0.0.1",
+			Port:   uint16(peerPort),
+			Param:  &jartsip.URIParam{Name: "transport", Value: "tcp"},
+		},
+		From:   &jartsip.Addr{Uri: &jartsip.URI{Scheme: "sip", User: "alice", Host: "example.com"}, Param: &jartsip.Param{Name: "tag", Value: "a1"}},
+		To:     &jartsip.Addr{Uri: &jartsip.URI{Scheme: "sip", User: "bob", Host: "example.com"}, Param: &jartsip.Param{Name: "tag", Value: "b1"}},
+		CallID: "ack-1@127.0.0.1",
+		CSeq:   1,
+	}}
+	if err := srv.SendAck(ack); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := peer.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(io.LimitReader(conn, int64(len(ackBytes(ack)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parser.NewParser().ParseMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	via := got.Msg.Via
+	if via.Host != "127.0.0.1" || via.Transport != "TCP" {
+		t.Errorf("Via %s %s, want local address", via.Transport, via.Host)
+	}
+	if !strings.HasPrefix(got.GetBranch(), "z9hG4bK") {
+		t.Errorf("Via branch %q", got.GetBranch())
+	}
+	if via.Param.Get("rport") == nil {
+		t.Errorf("Via has no rport")
+	}
+}
+
+// ackBytes returns message as written to connection
+func ackBytes(msg *message.Message) []byte {
+	var b bytes.Buffer
+	msg.Append(&b)
+	return b.Bytes()
+}
+
+func TestRequestWithoutFrom(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	uri := &jartsip.URI{Scheme: "sip", User: "bob", Host: "127.0.0.1", Port: 5060}
+	req := message.NewRequest(message.OPTIONS, uri).Build()
+	if _, err := srv.Request(context.Background(), req); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("request without From returned %v, want ErrInvalidRequest", err)
+	}
+}
@@ -0,0 +1,133 @@
+package dialog
+
+import (
+	"sync"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// State of dialog
+type State int
+
+const (
+	StateEarly State = iota
+	StateConfirmed
+	StateTerminated
+)
+
+func (s State) String() string {
+	switch s {
+	case StateEarly:
+		return "Early"
+	case StateConfirmed:
+		return "Confirmed"
+	case StateTerminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+// Dialog is peer-to-peer relationship between two UAs (RFC 3261 12)
+type Dialog struct {
+	// ID is made of Call-ID, local tag and remote tag
+	ID        string
+	CallID    string
+	LocalTag  string
+	RemoteTag string
+
+	// LocalURI and RemoteURI are From and To of requests sent within dialog
+	LocalURI  *sip.Addr
+	RemoteURI *sip.Addr
+
+	// UAC is true when dialog was created by our request
+	UAC bool
+	// Secure is true when dialog was created over sips URI
+	Secure bool
+	// Method of request which created dialog, INVITE or SUBSCRIBE
+	Method message.RequestMethod
+
+	mu           sync.Mutex
+	state        State
+	remoteTarget *sip.URI
+	routeSet     *sip.Addr
+	localCSeq    int
+	remoteCSeq   int
+}
+
+// State returns current state of dialog
+func (d *Dialog) State() State {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// RemoteTarget returns URI requests within dialog are sent to
+func (d *Dialog) RemoteTarget() *sip.URI {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remoteTarget.Copy()
+}
+
+// RouteSet returns Route headers of requests within dialog, nil if empty
+func (d *Dialog) RouteSet() *sip.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.routeSet.Copy()
+}
+
+// LocalCSeq returns CSeq of last request sent within dialog
+func (d *Dialog) LocalCSeq() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.localCSeq
+}
+
+// RemoteCSeq returns CSeq of last request received within dialog
+func (d *Dialog) RemoteCSeq() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remoteCSeq
+}
+
+// NextCSeq increments and returns local CSeq for new request within dialog
+func (d *Dialog) NextCSeq() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.localCSeq++
+	return d.localCSeq
+}
+
+func (d *Dialog) setState(s State) {
+	d.mu.Lock()
+	d.state = s
+	d.mu.Unlock()
+}
+
+// confirm moves early dialog to confirmed. UAC passes 2xx, as it refreshes
+// remote target and recomputes route set from Record-Route of 2xx (RFC 3261 12.1.2).
+func (d *Dialog) confirm(res *sip.Msg) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if res != nil && d.state == StateEarly {
+		d.routeSet = res.RecordRoute.Reversed()
+	}
+	if d.state == StateEarly {
+		d.state = StateConfirmed
+	}
+	if res != nil && res.Contact != nil {
+		d.remoteTarget = res.Contact.Uri.Copy()
+	}
+}
+
+// refreshTarget updates remote target on target refresh request like re-INVITE
+func (d *Dialog) refreshTarget(contact *sip.Addr) {
+	if contact == nil {
+		return
+	}
+	d.mu.Lock()
+	d.remoteTarget = contact.Uri.Copy()
+	d.mu.Unlock()
+}
@@ -0,0 +1,296 @@
+package dialog
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/shend/simplesip/message"
+)
+
+var (
+	ErrDialogNotFound   = errors.New("dialog does not exist")
+	ErrCSeqOutOfOrder   = errors.New("CSeq lower than remote CSeq of dialog")
+	ErrCannotCreate     = errors.New("message can not create dialog")
+	ErrMissingRemoteTag = errors.New("missing remote tag")
+)
+
+// Manager keeps dialogs created by INVITE and SUBSCRIBE
+type Manager struct {
+	mu      sync.RWMutex
+	dialogs map[string]*Dialog
+	// pending SUBSCRIBE requests waiting for NOTIFY, keyed by Call-ID and local tag
+	pending map[string]*message.Message
+}
+
+// NewManager creates empty dialog manager
+func NewManager() *Manager {
+	return &Manager{
+		dialogs: make(map[string]*Dialog),
+		pending: make(map[string]*message.Message),
+	}
+}
+
+// Get returns dialog by ID
+func (m *Manager) Get(id string) *Dialog {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dialogs[id]
+}
+
+// Lookup returns dialog of request received within dialog, nil if there is none
+func (m *Manager) Lookup(req *message.Message) *Dialog {
+	id, err := req.MakeDialogIDFromMessage()
+	if err != nil {
+		return nil
+	}
+	return m.Get(id)
+}
+
+// Len returns number of dialogs
+func (m *Manager) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.dialogs)
+}
+
+// Remove terminates and removes dialog
+func (m *Manager) Remove(d *Dialog) {
+	d.setState(StateTerminated)
+	m.mu.Lock()
+	if m.dialogs[d.ID] == d {
+		delete(m.dialogs, d.ID)
+	}
+	m.mu.Unlock()
+}
+
+// IsInDialog reports if request carries To tag and so must match existing dialog
+func IsInDialog(req *message.Message) bool {
+	return req.GetToTag() != ""
+}
+
+// OnRequest matches request received within dialog. It validates remote CSeq
+// and refreshes remote target. ErrDialogNotFound means 481 should be answered,
+// ErrCSeqOutOfOrder means 500.
+func (m *Manager) OnRequest(req *message.Message) (*Dialog, error) {
+	d := m.Lookup(req)
+	method := message.RequestMethod(req.Msg.Method)
+
+	if d == nil && method == message.NOTIFY {
+		// NOTIFY can arrive before 2xx of SUBSCRIBE
+		if sub := m.takePending(req.GetCallID(), req.GetToTag()); sub != nil {
+			return m.create(sub, req, true, false)
+		}
+	}
+
+	if d == nil {
+		return nil, ErrDialogNotFound
+	}
+
+	if method == message.ACK || method == message.CANCEL {
+		return d, nil
+	}
+
+	d.mu.Lock()
+	if d.remoteCSeq != 0 && req.Msg.CSeq < d.remoteCSeq {
+		d.mu.Unlock()
+		return d, ErrCSeqOutOfOrder
+	}
+	d.remoteCSeq = req.Msg.CSeq
+	d.mu.Unlock()
+
+	if method == message.INVITE || method == message.UPDATE || method == message.NOTIFY {
+		d.refreshTarget(req.Msg.Contact)
+	}
+
+	return d, nil
+}
+
+// OnResponse updates dialogs of UAS with response sent to req.
+// Dialog is created by 1xx with To tag and 2xx of INVITE or SUBSCRIBE.
+func (m *Manager) OnResponse(req *message.Message, res *message.Message) (*Dialog, error) {
+	return m.onResponse(req, res, false)
+}
+
+// OnClientResponse updates dialogs of UAC with response received for req
+func (m *Manager) OnClientResponse(req *message.Message, res *message.Message) (*Dialog, error) {
+	return m.onResponse(req, res, true)
+}
+
+func (m *Manager) onResponse(req *message.Message, res *message.Message, uac bool) (*Dialog, error) {
+	status := res.Msg.Status
+	method := message.RequestMethod(req.Msg.Method)
+
+	id := responseDialogID(res, uac)
+	d := m.Get(id)
+
+	switch method {
+	case message.INVITE, message.SUBSCRIBE:
+		if d != nil {
+			switch {
+			case status >= 200 && status < 300:
+				// Only UAC learns remote target from response
+				if uac {
+					d.confirm(res.Msg)
+				} else {
+					d.confirm(nil)
+				}
+			case status >= 300 && d.State() == StateEarly:
+				m.Remove(d)
+			}
+			return d, nil
+		}
+
+		if uac && status >= 300 {
+			m.removeEarly(req.GetCallID(), req.GetFromTag())
+		}
+
+		if status <= 100 || status >= 300 {
+			return nil, nil
+		}
+		if method == message.SUBSCRIBE && status < 200 {
+			return nil, nil
+		}
+		return m.create(req, res, uac, status < 200)
+	case message.BYE:
+		if d != nil && status >= 200 && status < 300 {
+			m.Remove(d)
+		}
+	}
+
+	// Dialog does not exist at remote side anymore (RFC 3261 12.2.1.2)
+	if d != nil && (status == 481 || status == 408) {
+		m.Remove(d)
+	}
+
+	return d, nil
+}
+
+// OnCancel removes early dialogs of UAS created for INVITE terminated by CANCEL.
+// Transaction layer answers such INVITE with 487, which OnResponse never sees.
+func (m *Manager) OnCancel(cancel *message.Message) {
+	callID, remoteTag := cancel.GetCallID(), cancel.GetFromTag()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, d := range m.dialogs {
+		if !d.UAC && d.CallID == callID && d.RemoteTag == remoteTag && d.State() == StateEarly {
+			d.setState(StateTerminated)
+			delete(m.dialogs, id)
+		}
+	}
+}
+
+// AddPendingSubscribe remembers outgoing SUBSCRIBE, so NOTIFY received before
+// its 2xx creates dialog
+func (m *Manager) AddPendingSubscribe(req *message.Message) {
+	m.mu.Lock()
+	m.pending[pendingKey(req.GetCallID(), req.GetFromTag())] = req
+	m.mu.Unlock()
+}
+
+// RemovePendingSubscribe forgets outgoing SUBSCRIBE when its transaction is over
+func (m *Manager) RemovePendingSubscribe(req *message.Message) {
+	m.mu.Lock()
+	delete(m.pending, pendingKey(req.GetCallID(), req.GetFromTag()))
+	m.mu.Unlock()
+}
+
+func (m *Manager) takePending(callID string, localTag string) *message.Message {
+	key := pendingKey(callID, localTag)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req := m.pending[key]
+	delete(m.pending, key)
+	return req
+}
+
+// create makes dialog from request and message of remote side. For UAC remote
+// message is response or NOTIFY, for UAS it is response we sent.
+func (m *Manager) create(req *message.Message, remote *message.Message, uac bool, early bool) (*Dialog, error) {
+	msg := req.Msg
+	d := &Dialog{
+		CallID: msg.CallID,
+		UAC:    uac,
+		Secure: msg.Request != nil && msg.Request.Scheme == "sips",
+		Method: message.RequestMethod(msg.Method),
+		state:  StateConfirmed,
+	}
+	if early {
+		d.state = StateEarly
+	}
+
+	if uac {
+		d.LocalTag = req.GetFromTag()
+		d.LocalURI = msg.From.Copy()
+		d.localCSeq = msg.CSeq
+		if remote.Msg.IsResponse() {
+			// Route set is Record-Route of response in reverse order
+			d.RemoteTag = remote.GetToTag()
+			d.RemoteURI = remote.Msg.To.Copy()
+			d.routeSet = remote.Msg.RecordRoute.Reversed()
+		} else {
+			// NOTIFY request from notifier
+			d.RemoteTag = remote.GetFromTag()
+			d.RemoteURI = remote.Msg.From.Copy()
+			d.routeSet = remote.Msg.RecordRoute.Copy()
+			d.remoteCSeq = remote.Msg.CSeq
+		}
+		if remote.Msg.Contact != nil {
+			d.remoteTarget = remote.Msg.Contact.Uri.Copy()
+		}
+	} else {
+		d.LocalTag = remote.GetToTag()
+		d.LocalURI = remote.Msg.To.Copy()
+		d.RemoteTag = req.GetFromTag()
+		d.RemoteURI = msg.From.Copy()
+		d.routeSet = msg.RecordRoute.Copy()
+		d.remoteCSeq = msg.CSeq
+		if msg.Contact != nil {
+			d.remoteTarget = msg.Contact.Uri.Copy()
+		}
+	}
+
+	if d.RemoteTag == "" {
+		return nil, ErrMissingRemoteTag
+	}
+	if d.LocalTag == "" {
+		return nil, ErrCannotCreate
+	}
+	d.LocalURI.Param = nil
+	d.RemoteURI.Param = nil
+	d.ID = message.MakeDialogID(d.CallID, d.LocalTag, d.RemoteTag)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.dialogs[d.ID]; ok {
+		return existing, nil
+	}
+	m.dialogs[d.ID] = d
+
+	return d, nil
+}
+
+// removeEarly removes early dialogs of UAC after non 2xx final response
+func (m *Manager) removeEarly(callID string, localTag string) {
+	prefix := message.MakeDialogID(callID, localTag, "")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, d := range m.dialogs {
+		if strings.HasPrefix(id, prefix) && d.State() == StateEarly {
+			d.setState(StateTerminated)
+			delete(m.dialogs, id)
+		}
+	}
+}
+
+// responseDialogID returns dialog ID from point of view of UAC or UAS
+func responseDialogID(res *message.Message, uac bool) string {
+	if uac {
+		return message.MakeDialogID(res.GetCallID(), res.GetFromTag(), res.GetToTag())
+	}
+	return message.MakeDialogID(res.GetCallID(), res.GetToTag(), res.GetFromTag())
+}
+
+func pendingKey(callID string, localTag string) string {
+	return callID + "|" + localTag
+}
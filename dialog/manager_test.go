@@ -0,0 +1,205 @@
+package dialog
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+var (
+	alice = &sip.URI{Scheme: "sip", User: "alice", Host: "192.0.2.1"}
+	bob   = &sip.URI{Scheme: "sip", User: "bob", Host: "192.0.2.2"}
+)
+
+// newTestInvite creates INVITE of alice to bob
+func newTestInvite() *message.Message {
+	return &message.Message{Msg: &sip.Msg{
+		Method:  string(message.INVITE),
+		Request: bob.Copy(),
+		Via: &sip.Via{
+			Transport: "UDP",
+			Host:      "192.0.2.1",
+			Port:      5060,
+			Param:     &sip.Param{Name: "branch", Value: "z9hG4bKinv1"},
+		},
+		From:       &sip.Addr{Uri: alice.Copy(), Param: &sip.Param{Name: "tag", Value: "a1"}},
+		To:         &sip.Addr{Uri: bob.Copy()},
+		Contact:    &sip.Addr{Uri: alice.Copy()},
+		CallID:     "call-1@192.0.2.1",
+		CSeq:       1,
+		CSeqMethod: string(message.INVITE),
+	}}
+}
+
+// newTestResponse creates response of bob with Contact
+func newTestResponse(req *message.Message, status int) *message.Message {
+	res := message.NewResponse(req, status, "")
+	res.Msg.Contact = &sip.Addr{Uri: bob.Copy()}
+	return res
+}
+
+// newTestInDialog creates request sent by alice within dialog established by res
+func newTestInDialog(res *message.Message, method message.RequestMethod, cseq int) *message.Message {
+	return &message.Message{Msg: &sip.Msg{
+		Method:     string(method),
+		Request:    bob.Copy(),
+		From:       res.Msg.From.Copy(),
+		To:         res.Msg.To.Copy(),
+		CallID:     res.Msg.CallID,
+		CSeq:       cseq,
+		CSeqMethod: string(method),
+	}}
+}
+
+func TestUASDialog(t *testing.T) {
+	m := NewManager()
+	invite := newTestInvite()
+
+	ringing := newTestResponse(invite, 180)
+	d, err := m.OnResponse(invite, ringing)
+	if err != nil || d == nil {
+		t.Fatalf("180 did not create dialog, err=%v", err)
+	}
+	if d.UAC || d.State() != StateEarly {
+		t.Errorf("dialog UAC=%v state %v, want UAS Early", d.UAC, d.State())
+	}
+	if d.LocalTag != ringing.GetToTag() || d.RemoteTag != "a1" {
+		t.Errorf("tags local=%q remote=%q", d.LocalTag, d.RemoteTag)
+	}
+	if got := d.RemoteTarget().String(); got != alice.String() {
+		t.Errorf("remote target %s, want %s", got, alice)
+	}
+
+	ok := newTestResponse(invite, 200)
+	if got, _ := m.OnResponse(invite, ok); got != d || d.State() != StateConfirmed {
+		t.Fatalf("200 did not confirm early dialog, state %v", d.State())
+	}
+
+	bye := newTestInDialog(ok, message.BYE, 2)
+	if got, err := m.OnRequest(bye); got != d || err != nil {
+		t.Fatalf("BYE did not match dialog, err=%v", err)
+	}
+	if d.RemoteCSeq() != 2 {
+		t.Errorf("remote CSeq %d, want 2", d.RemoteCSeq())
+	}
+	if _, err := m.OnResponse(bye, message.NewResponse(bye, 200, "")); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 0 || d.State() != StateTerminated {
+		t.Errorf("BYE left %d dialogs, state %v", m.Len(), d.State())
+	}
+}
+
+func TestUACDialog(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses are responses received for INVITE in order
+		statuses  []int
+		wantLen   int
+		wantState State
+	}{
+		{name: "early", statuses: []int{180}, wantLen: 1, wantState: StateEarly},
+		{name: "confirmed", statuses: []int{180, 200}, wantLen: 1, wantState: StateConfirmed},
+		{name: "confirmed without early", statuses: []int{200}, wantLen: 1, wantState: StateConfirmed},
+		{name: "rejected", statuses: []int{180, 486}, wantLen: 0, wantState: StateTerminated},
+		{name: "trying only", statuses: []int{100}, wantLen: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager()
+			invite := newTestInvite()
+			// Responses arrive with To tag of bob
+			invite.Msg.To.Param = &sip.Param{Name: "tag", Value: "b1"}
+			var d *Dialog
+			for _, status := range tt.statuses {
+				got, err := m.OnClientResponse(invite, newTestResponse(invite, status))
+				if err != nil {
+					t.Fatalf("%d: %v", status, err)
+				}
+				if d == nil {
+					d = got
+				}
+			}
+
+			if m.Len() != tt.wantLen {
+				t.Fatalf("%d dialogs, want %d", m.Len(), tt.wantLen)
+			}
+			if d == nil {
+				return
+			}
+			if !d.UAC || d.State() != tt.wantState {
+				t.Errorf("dialog UAC=%v state %v, want UAC %v", d.UAC, d.State(), tt.wantState)
+			}
+			if d.LocalTag != "a1" || d.RemoteTag != "b1" {
+				t.Errorf("tags local=%q remote=%q", d.LocalTag, d.RemoteTag)
+			}
+			if got := d.RemoteTarget().String(); got != bob.String() {
+				t.Errorf("remote target %s, want %s", got, bob)
+			}
+		})
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	m := NewManager()
+	invite := newTestInvite()
+	ok := newTestResponse(invite, 200)
+	if _, err := m.OnResponse(invite, ok); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := newTestInDialog(ok, message.BYE, 2)
+	unknown.Msg.From.Param = &sip.Param{Name: "tag", Value: "other"}
+
+	tests := []struct {
+		name string
+		req  *message.Message
+		want error
+	}{
+		{name: "in order", req: newTestInDialog(ok, message.INFO, 5)},
+		{name: "unknown dialog", req: unknown, want: ErrDialogNotFound},
+		{name: "lower CSeq", req: newTestInDialog(ok, message.INFO, 3), want: ErrCSeqOutOfOrder},
+		{name: "ACK ignores CSeq", req: newTestInDialog(ok, message.ACK, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.OnRequest(tt.req); !errors.Is(err, tt.want) {
+				t.Errorf("err %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnCancel(t *testing.T) {
+	m := NewManager()
+	early := newTestInvite()
+	if _, err := m.OnResponse(early, newTestResponse(early, 180)); err != nil {
+		t.Fatal(err)
+	}
+	confirmed := newTestInvite()
+	confirmed.Msg.CallID = "call-2@192.0.2.1"
+	if _, err := m.OnResponse(confirmed, newTestResponse(confirmed, 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invite := range []*message.Message{early, confirmed} {
+		cancel := invite.Clone()
+		cancel.Msg.Method = string(message.CANCEL)
+		cancel.Msg.CSeqMethod = string(message.CANCEL)
+		m.OnCancel(&cancel)
+	}
+
+	if m.Len() != 1 {
+		t.Fatalf("%d dialogs left, want confirmed one", m.Len())
+	}
+	for _, d := range m.dialogs {
+		if d.CallID != confirmed.Msg.CallID {
+			t.Errorf("dialog of %s left", d.CallID)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package dialog
+
+import (
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// NewRequest creates request within dialog with next local CSeq (RFC 3261 12.2.1.1).
+// It is sent by Server.Request, which fills in Via and Contact.
+func (d *Dialog) NewRequest(method message.RequestMethod) *message.Message {
+	return d.newRequest(method, d.NextCSeq())
+}
+
+// NewBye creates BYE ending dialog
+func (d *Dialog) NewBye() *message.Message {
+	return d.NewRequest(message.BYE)
+}
+
+// NewReInvite creates re-INVITE, with SDP offer unless sdp is nil
+func (d *Dialog) NewReInvite(sdp []byte) *message.Message {
+	req := d.NewRequest(message.INVITE)
+	if sdp != nil {
+		req.SetSDP(sdp)
+	}
+	return req
+}
+
+// NewAck creates ACK of 2xx of INVITE with CSeq cseq, with SDP answer unless sdp
+// is nil (RFC 3261 13.2.2.4). It is sent by Server.SendAck.
+func (d *Dialog) NewAck(cseq int, sdp []byte) *message.Message {
+	req := d.newRequest(message.ACK, cseq)
+	if sdp != nil {
+		req.SetSDP(sdp)
+	}
+	return req
+}
+
+func (d *Dialog) newRequest(method message.RequestMethod, cseq int) *message.Message {
+	return &message.Message{
+		Msg: &sip.Msg{
+			Method:  string(method),
+			Request: d.RemoteTarget(),
+			From:    &sip.Addr{Uri: d.LocalURI.Uri.Copy(), Display: d.LocalURI.Display, Param: &sip.Param{Name: "tag", Value: d.LocalTag}},
+			To:      &sip.Addr{Uri: d.RemoteURI.Uri.Copy(), Display: d.RemoteURI.Display, Param: &sip.Param{Name: "tag", Value: d.RemoteTag}},
+			Route:   d.RouteSet(),
+			CallID:  d.CallID,
+			CSeq:    cseq,
+		},
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/shend/simplesip"
 	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/middleware"
 	"github.com/shend/simplesip/transport"
 )
 
@@ -59,6 +60,7 @@ func ListenAndServe() {
 	srv.OnRegister(handleRegister)
 	srv.OnInvite(handleInvite)
 	srv.AddRequestMiddleware(handleServeRequest)
+	srv.Use(middleware.Recover(), middleware.Logging(), middleware.MaxForwards())
 
 	addr := fmt.Sprintf("%s:%d", "127.0.0.1", 5060)
 	srv.ListenAndServe(context.TODO(), "udp", addr)
@@ -68,67 +70,32 @@ func handleServeRequest(req *message.Message) {
 	slog.Debug("This is a request middleware")
 }
 
-func handleRegister(req *message.Message) *message.Message {
+func handleRegister(ctx context.Context, req *message.Message) *message.Message {
 	slog.Debug("Received REGISTER request")
 	return nil
 }
 
-func handleInvite(req *message.Message) *message.Message {
+func handleInvite(ctx context.Context, req *message.Message) *message.Message {
 	slog.Debug("Received INVITE request")
-	res := simplesip.NewResponseFromRequest(req, 200, "OK")
-	res.Msg.Payload = nil
+	res := message.NewResponse(req, 200, "OK")
 	return res
 }
 
 func SendInviteMsg() string {
-	invite := &sip.Msg{
-		Method:  sip.MethodInvite,
-		Request: &sip.URI{User: "echo", Host: "127.0.0.1", Port: 8888},
-		Via: &sip.Via{
-			Host: "sip.example.org",
-			Port: 8888,
-			Param: &sip.Param{
-				Name:  "branch",
-				Value: util.GenerateBranch(),
-				Next:  &sip.Param{Name: "rport"},
-			},
-		},
-		From: &sip.Addr{
-			Display: "Alice",
-			Uri: &sip.URI{
-				Scheme: "sip",
-				User:   "alic",
-				Host:   "sip.example.org",
-			},
-			Param: &sip.Param{Name: "tag", Value: util.GenerateTag()},
-		},
-		To: &sip.Addr{
-			Uri: &sip.URI{
-				Scheme: "sip",
-				User:   "bob",
-				Host:   "sip.example.org",
-			},
-		},
-		CallID:     util.GenerateCallID(),
-		CSeq:       1,
-		CSeqMethod: sip.MethodInvite,
-		Date:       time.Now().Format(time.RFC1123),
-		Contact: &sip.Addr{
-			Uri: &sip.URI{
-				Scheme: "sip",
-				User:   "alice",
-				Host:   "sip.example.org",
-				Port:   8888,
-			},
-		},
-		Payload: &sdp.SDP{
+	invite := message.NewRequest(message.INVITE, &sip.URI{User: "echo", Host: "127.0.0.1", Port: 8888}).
+		Via("sip.example.org", 8888).
+		From(&sip.Addr{Display: "Alice", Uri: &sip.URI{Scheme: "sip", User: "alic", Host: "sip.example.org"}}).
+		To(&sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "bob", Host: "sip.example.org"}}).
+		Contact(&sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "sip.example.org", Port: 8888}}).
+		Body(&sdp.SDP{
 			Origin: sdp.Origin{ID: util.GenerateOriginID()},
 			Audio: &sdp.Media{
 				Port:   51002,
 				Codecs: []sdp.Codec{sdp.ULAWCodec, sdp.DTMFCodec},
 			},
-		},
-	}
+		}).
+		Build()
+	invite.Msg.Date = time.Now().Format(time.RFC1123)
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8888")
 	if err != nil {
@@ -2,4 +2,4 @@ module github.com/shend/simplesip
 
 go 1.21
 
-require github.com/jart/gosip v0.0.0-20220818224804-29801cedf805 // indirect
+require github.com/jart/gosip v0.0.0-20220818224804-29801cedf805
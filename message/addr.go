@@ -0,0 +1,150 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jart/gosip/sip"
+)
+
+var ErrInvalidAddr = errors.New("invalid address")
+
+// ParseAddr parses comma separated list of name-addr or addr-spec with params,
+// as carried by From, To, Contact, Route and Record-Route (RFC 3261 20.10)
+func ParseAddr(s string) (*sip.Addr, error) {
+	var head *sip.Addr
+	tail := &head
+	for _, part := range splitList(s) {
+		addr, err := parseAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		*tail = addr
+		tail = &addr.Next
+	}
+	if head == nil {
+		return nil, ErrInvalidAddr
+	}
+	return head, nil
+}
+
+func parseAddr(s string) (*sip.Addr, error) {
+	s = strings.TrimSpace(s)
+	addr := &sip.Addr{}
+
+	uri, params := s, ""
+	display := ""
+	rest := s
+	if strings.HasPrefix(rest, `"`) {
+		end := closingQuote(rest)
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated display name of %q", ErrInvalidAddr, s)
+		}
+		display = unquote(rest[:end+1])
+		rest = rest[end+1:]
+	}
+	if i := strings.IndexByte(rest, '<'); i >= 0 {
+		j := strings.IndexByte(rest[i:], '>')
+		if j < 0 {
+			return nil, fmt.Errorf("%w: missing '>' of %q", ErrInvalidAddr, s)
+		}
+		if display == "" {
+			display = strings.TrimSpace(rest[:i])
+		}
+		uri, params = rest[i+1:i+j], rest[i+j+1:]
+	} else if display != "" {
+		return nil, fmt.Errorf("%w: missing '<' of %q", ErrInvalidAddr, s)
+	} else if i := strings.IndexByte(s, ';'); i >= 0 {
+		// Params of addr-spec belong to header, not URI
+		uri, params = s[:i], s[i:]
+	}
+
+	u, err := sip.ParseURI([]byte(strings.TrimSpace(uri)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q err=%w", ErrInvalidAddr, s, err)
+	}
+	addr.Uri = u
+	addr.Display = display
+	addr.Param = parseParams(params)
+	return addr, nil
+}
+
+// parseParams parses ";name=value" list. gosip writes params from the last one
+// in list, so they are prepended.
+func parseParams(s string) *sip.Param {
+	var head *sip.Param
+	for _, p := range strings.Split(s, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(p, "=")
+		head = &sip.Param{Name: strings.TrimSpace(name), Value: unquote(strings.TrimSpace(value)), Next: head}
+	}
+	return head
+}
+
+// splitList splits header value on commas outside of quoted strings and angle brackets
+func splitList(s string) []string {
+	var parts []string
+	quoted, angle := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			angle = true
+		case c == '>':
+			angle = false
+		case c == ',' && !angle:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, s[start:])
+
+	out := parts[:0]
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// closingQuote returns index of quote ending quoted string starting at s[0]
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// unquote removes quotes and escapes of quoted string, other values are returned as they are
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,149 @@
+package message
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/jart/gosip/sip"
+)
+
+// defaultMaxForwards is written to request without Max-Forwards (RFC 3261 8.1.1.6)
+const defaultMaxForwards = 70
+
+// stringHeaders are headers gosip keeps as string or number in fields of Msg,
+// in order they are written
+var stringHeaders = []string{
+	"User-Agent",
+	"Accept",
+	"Accept-Contact",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Alert-Info",
+	"Allow",
+	"Allow-Events",
+	"Authentication-Info",
+	"Authorization",
+	"Call-Info",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Date",
+	"Error-Info",
+	"Event",
+	"In-Reply-To",
+	"MIME-Version",
+	"Min-Expires",
+	"Organization",
+	"P-Asserted-Identity",
+	"Priority",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Require",
+	"Refer-To",
+	"Referred-By",
+	"Remote-Party-ID",
+	"Reply-To",
+	"Require",
+	"Retry-After",
+	"Server",
+	"Subject",
+	"Supported",
+	"Timestamp",
+	"Unsupported",
+	"Warning",
+	"WWW-Authenticate",
+}
+
+// appendMsg writes msg in wire format. It follows gosip, but headers gosip can
+// not represent, like Expires and Max-Forwards, are written from extension headers.
+func appendMsg(b *bytes.Buffer, msg *sip.Msg) {
+	if msg.IsResponse() {
+		appendVersion(b, msg)
+		b.WriteString(" ")
+		b.WriteString(strconv.Itoa(msg.Status))
+		b.WriteString(" ")
+		if msg.Phrase != "" {
+			b.WriteString(msg.Phrase)
+		} else {
+			b.WriteString(sip.Phrase(msg.Status))
+		}
+	} else {
+		b.WriteString(msg.Method)
+		b.WriteString(" ")
+		msg.Request.Append(b)
+		b.WriteString(" ")
+		appendVersion(b, msg)
+	}
+	b.WriteString("\r\n")
+
+	appendAddr(b, "From", msg.From)
+	appendAddr(b, "To", msg.To)
+	for v := msg.Via; v != nil; v = v.Next {
+		b.WriteString("Via: ")
+		v.Append(b)
+		b.WriteString("\r\n")
+	}
+	appendAddr(b, "Route", msg.Route)
+	appendAddr(b, "Record-Route", msg.RecordRoute)
+	appendAddr(b, "Contact", msg.Contact)
+	appendHeader(b, "Call-ID", msg.CallID)
+	appendHeader(b, "CSeq", strconv.Itoa(msg.CSeq)+" "+msg.CSeqMethod)
+	if !msg.IsResponse() && !hasXHeader(msg, "max-forwards") {
+		appendHeader(b, "Max-Forwards", strconv.Itoa(defaultMaxForwards))
+	}
+
+	for _, name := range stringHeaders {
+		if values := fields[CanonicalHeader(name)].get(msg); len(values) > 0 {
+			appendHeader(b, name, values[0])
+		}
+	}
+	msg.XHeader.Append(b)
+
+	var payload []byte
+	if msg.Payload != nil {
+		appendHeader(b, "Content-Type", msg.Payload.ContentType())
+		payload = msg.Payload.Data()
+	}
+	appendHeader(b, "Content-Length", strconv.Itoa(len(payload)))
+	b.WriteString("\r\n")
+	b.Write(payload)
+}
+
+func appendVersion(b *bytes.Buffer, msg *sip.Msg) {
+	b.WriteString("SIP/")
+	if msg.VersionMajor == 0 {
+		b.WriteString("2.0")
+		return
+	}
+	b.WriteString(strconv.Itoa(int(msg.VersionMajor)))
+	b.WriteString(".")
+	b.WriteString(strconv.Itoa(int(msg.VersionMinor)))
+}
+
+// appendAddr writes address list as single header, nothing when it is empty
+func appendAddr(b *bytes.Buffer, name string, addr *sip.Addr) {
+	if addr == nil {
+		return
+	}
+	b.WriteString(name)
+	b.WriteString(": ")
+	addr.Append(b)
+	b.WriteString("\r\n")
+}
+
+func appendHeader(b *bytes.Buffer, name string, value string) {
+	b.WriteString(name)
+	b.WriteString(": ")
+	b.WriteString(value)
+	b.WriteString("\r\n")
+}
+
+// hasXHeader reports if extension header of canonical name is present
+func hasXHeader(msg *sip.Msg, canonical string) bool {
+	for h := msg.XHeader; h != nil; h = h.Next {
+		if CanonicalHeader(h.Name) == canonical {
+			return true
+		}
+	}
+	return false
+}
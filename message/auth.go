@@ -0,0 +1,55 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AuthHeader is scheme and auth-params of Authorization, Proxy-Authorization or
+// challenge header (RFC 3261 25.1)
+type AuthHeader struct {
+	Scheme string
+	// Params are auth-params by lower case name, quoted values are unquoted
+	Params map[string]string
+}
+
+// ParseAuthHeader parses credentials or challenge, e.g. `Digest realm="example.com", nonce="..."`
+func ParseAuthHeader(s string) (*AuthHeader, error) {
+	s = strings.TrimSpace(s)
+	scheme, rest, _ := strings.Cut(s, " ")
+	if scheme == "" {
+		return nil, fmt.Errorf("missing auth scheme of %q", s)
+	}
+
+	params := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return &AuthHeader{Scheme: scheme, Params: params}, nil
+		}
+
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid auth-param %q", rest)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimLeft(value, " \t")
+
+		if strings.HasPrefix(value, `"`) {
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string of %q", name)
+			}
+			params[name] = unquote(value[:end+1])
+			rest = value[end+1:]
+			continue
+		}
+
+		end := strings.IndexByte(value, ',')
+		if end < 0 {
+			end = len(value)
+		}
+		params[name] = strings.TrimSpace(value[:end])
+		rest = value[end:]
+	}
+}
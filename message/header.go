@@ -0,0 +1,545 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jart/gosip/sip"
+)
+
+var (
+	ErrReadOnlyHeader = errors.New("header can not be set")
+	ErrNoHeader       = errors.New("header not present")
+)
+
+// compactForms are full names of compact header names (RFC 3261 7.3.3 and extensions)
+var compactForms = map[string]string{
+	"a": "accept-contact",
+	"b": "referred-by",
+	"c": "content-type",
+	"d": "request-disposition",
+	"e": "content-encoding",
+	"f": "from",
+	"i": "call-id",
+	"j": "reject-contact",
+	"k": "supported",
+	"l": "content-length",
+	"m": "contact",
+	"o": "event",
+	"r": "refer-to",
+	"s": "subject",
+	"t": "to",
+	"u": "allow-events",
+	"v": "via",
+	"x": "session-expires",
+	"y": "identity",
+}
+
+// CanonicalHeader returns lower case full name of header, compact form is expanded
+func CanonicalHeader(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if full, ok := compactForms[name]; ok {
+		return full
+	}
+	return name
+}
+
+// KnownHeader reports if header is kept in field of Msg rather than as extension header
+func KnownHeader(name string) bool {
+	_, ok := fields[CanonicalHeader(name)]
+	return ok
+}
+
+// field is header gosip parses into field of Msg
+type field struct {
+	get func(msg *sip.Msg) []string
+	set func(msg *sip.Msg, value string) error
+	add func(msg *sip.Msg, value string) error
+	del func(msg *sip.Msg)
+}
+
+// numberHeaders are headers of single number kept as extension headers, as gosip
+// can not tell them missing from 0. Value is largest number allowed.
+var numberHeaders = map[string]int{
+	"expires":      math.MaxInt32,
+	"max-forwards": 255,
+}
+
+var fields = map[string]field{
+	"accept":              stringField(func(m *sip.Msg) *string { return &m.Accept }),
+	"accept-contact":      stringField(func(m *sip.Msg) *string { return &m.AcceptContact }),
+	"accept-encoding":     stringField(func(m *sip.Msg) *string { return &m.AcceptEncoding }),
+	"accept-language":     stringField(func(m *sip.Msg) *string { return &m.AcceptLanguage }),
+	"alert-info":          stringField(func(m *sip.Msg) *string { return &m.AlertInfo }),
+	"allow":               stringField(func(m *sip.Msg) *string { return &m.Allow }),
+	"allow-events":        stringField(func(m *sip.Msg) *string { return &m.AllowEvents }),
+	"authentication-info": stringField(func(m *sip.Msg) *string { return &m.AuthenticationInfo }),
+	"authorization":       stringField(func(m *sip.Msg) *string { return &m.Authorization }),
+	"call-id":             stringField(func(m *sip.Msg) *string { return &m.CallID }),
+	"call-info":           stringField(func(m *sip.Msg) *string { return &m.CallInfo }),
+	"content-disposition": stringField(func(m *sip.Msg) *string { return &m.ContentDisposition }),
+	"content-encoding":    stringField(func(m *sip.Msg) *string { return &m.ContentEncoding }),
+	"content-language":    stringField(func(m *sip.Msg) *string { return &m.ContentLanguage }),
+	"date":                stringField(func(m *sip.Msg) *string { return &m.Date }),
+	"error-info":          stringField(func(m *sip.Msg) *string { return &m.ErrorInfo }),
+	"event":               stringField(func(m *sip.Msg) *string { return &m.Event }),
+	"in-reply-to":         stringField(func(m *sip.Msg) *string { return &m.InReplyTo }),
+	"mime-version":        stringField(func(m *sip.Msg) *string { return &m.MIMEVersion }),
+	"organization":        stringField(func(m *sip.Msg) *string { return &m.Organization }),
+	"priority":            stringField(func(m *sip.Msg) *string { return &m.Priority }),
+	"proxy-authenticate":  stringField(func(m *sip.Msg) *string { return &m.ProxyAuthenticate }),
+	"proxy-authorization": stringField(func(m *sip.Msg) *string { return &m.ProxyAuthorization }),
+	"proxy-require":       stringField(func(m *sip.Msg) *string { return &m.ProxyRequire }),
+	"refer-to":            stringField(func(m *sip.Msg) *string { return &m.ReferTo }),
+	"referred-by":         stringField(func(m *sip.Msg) *string { return &m.ReferredBy }),
+	"reply-to":            stringField(func(m *sip.Msg) *string { return &m.ReplyTo }),
+	"require":             stringField(func(m *sip.Msg) *string { return &m.Require }),
+	"retry-after":         stringField(func(m *sip.Msg) *string { return &m.RetryAfter }),
+	"server":              stringField(func(m *sip.Msg) *string { return &m.Server }),
+	"subject":             stringField(func(m *sip.Msg) *string { return &m.Subject }),
+	"supported":           stringField(func(m *sip.Msg) *string { return &m.Supported }),
+	"timestamp":           stringField(func(m *sip.Msg) *string { return &m.Timestamp }),
+	"unsupported":         stringField(func(m *sip.Msg) *string { return &m.Unsupported }),
+	"user-agent":          stringField(func(m *sip.Msg) *string { return &m.UserAgent }),
+	"warning":             stringField(func(m *sip.Msg) *string { return &m.Warning }),
+	"www-authenticate":    stringField(func(m *sip.Msg) *string { return &m.WWWAuthenticate }),
+
+	"from":                addrField(func(m *sip.Msg) **sip.Addr { return &m.From }, false),
+	"to":                  addrField(func(m *sip.Msg) **sip.Addr { return &m.To }, false),
+	"contact":             addrField(func(m *sip.Msg) **sip.Addr { return &m.Contact }, true),
+	"route":               addrField(func(m *sip.Msg) **sip.Addr { return &m.Route }, true),
+	"record-route":        addrField(func(m *sip.Msg) **sip.Addr { return &m.RecordRoute }, true),
+	"p-asserted-identity": addrField(func(m *sip.Msg) **sip.Addr { return &m.PAssertedIdentity }, true),
+	"remote-party-id":     addrField(func(m *sip.Msg) **sip.Addr { return &m.RemotePartyID }, true),
+	"min-expires":         intField(func(m *sip.Msg) *int { return &m.MinExpires }),
+	"cseq":                cseqField,
+	"via":                 viaField,
+	"content-type":        contentTypeField,
+	"content-length":      contentLengthField,
+}
+
+// Header returns first value of header, empty when it is not present. Name is
+// case-insensitive and can be compact form. Address lists are split into values.
+func (m *Message) Header(name string) string {
+	if values := m.Headers(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Headers returns all values of header, nil when it is not present
+func (m *Message) Headers(name string) []string {
+	name = CanonicalHeader(name)
+	var values []string
+	if f, ok := fields[name]; ok {
+		values = f.get(m.Msg)
+	}
+	// gosip writes extension headers from the last one in list
+	var ext []string
+	for h := m.Msg.XHeader; h != nil; h = h.Next {
+		if CanonicalHeader(h.Name) == name {
+			ext = append(ext, string(bytes.TrimSpace(h.Value)))
+		}
+	}
+	for i := len(ext) - 1; i >= 0; i-- {
+		values = append(values, ext[i])
+	}
+	return values
+}
+
+// HasHeader reports if header is present
+func (m *Message) HasHeader(name string) bool {
+	return len(m.Headers(name)) > 0
+}
+
+// SetHeader replaces all values of header with value. Address headers are
+// parsed, Via and Content-Length can not be set.
+func (m *Message) SetHeader(name string, value string) error {
+	canonical := CanonicalHeader(name)
+	f, ok := fields[canonical]
+	if !ok {
+		if err := checkNumber(canonical, value); err != nil {
+			return fmt.Errorf("set header %s failed err=%w", name, err)
+		}
+		m.RemoveHeader(name)
+		return m.AddHeader(name, value)
+	}
+	if err := f.set(m.Msg, value); err != nil {
+		return fmt.Errorf("set header %s failed err=%w", name, err)
+	}
+	m.removeXHeader(canonical)
+	return nil
+}
+
+// AddHeader adds value of header. Address is appended to list like Contact, other
+// values gosip keeps as string like Supported are joined with comma. Single value
+// like Max-Forwards or CSeq is replaced, number of Expires or Max-Forwards is checked.
+func (m *Message) AddHeader(name string, value string) error {
+	canonical := CanonicalHeader(name)
+	f, ok := fields[canonical]
+	if !ok {
+		if _, ok := numberHeaders[canonical]; ok {
+			if err := checkNumber(canonical, value); err != nil {
+				return fmt.Errorf("add header %s failed err=%w", name, err)
+			}
+			m.removeXHeader(canonical)
+		}
+		// Prepended header is written last
+		m.Msg.XHeader = &sip.XHeader{Name: name, Value: []byte(value), Next: m.Msg.XHeader}
+		return nil
+	}
+	if err := f.add(m.Msg, value); err != nil {
+		return fmt.Errorf("add header %s failed err=%w", name, err)
+	}
+	return nil
+}
+
+// RemoveHeader removes all values of header. Via and mandatory headers like
+// From or Call-ID are cleared too, message is invalid until they are set again.
+// Request without Max-Forwards is written with "Max-Forwards: 70".
+func (m *Message) RemoveHeader(name string) {
+	canonical := CanonicalHeader(name)
+	if f, ok := fields[canonical]; ok {
+		f.del(m.Msg)
+	}
+	m.removeXHeader(canonical)
+}
+
+func (m *Message) removeXHeader(canonical string) {
+	if !hasXHeader(m.Msg, canonical) {
+		return
+	}
+	var head *sip.XHeader
+	tail := &head
+	for h := m.Msg.XHeader; h != nil; h = h.Next {
+		if CanonicalHeader(h.Name) == canonical {
+			continue
+		}
+		x := &sip.XHeader{Name: h.Name, Value: h.Value}
+		*tail = x
+		tail = &x.Next
+	}
+	m.Msg.XHeader = head
+}
+
+// Contacts returns addresses of Contact header
+func (m *Message) Contacts() []*sip.Addr {
+	return addrList(m.Msg.Contact)
+}
+
+// Routes returns addresses of Route header
+func (m *Message) Routes() []*sip.Addr {
+	return addrList(m.Msg.Route)
+}
+
+// RecordRoutes returns addresses of Record-Route header
+func (m *Message) RecordRoutes() []*sip.Addr {
+	return addrList(m.Msg.RecordRoute)
+}
+
+// PAssertedIdentities returns addresses of P-Asserted-Identity header (RFC 3325)
+func (m *Message) PAssertedIdentities() []*sip.Addr {
+	return addrList(m.Msg.PAssertedIdentity)
+}
+
+// Supported returns option tags of Supported header
+func (m *Message) Supported() []string {
+	return tokenList(m.Headers("Supported"))
+}
+
+// Require returns option tags of Require header
+func (m *Message) Require() []string {
+	return tokenList(m.Headers("Require"))
+}
+
+// Allow returns methods of Allow header
+func (m *Message) Allow() []RequestMethod {
+	tokens := tokenList(m.Headers("Allow"))
+	methods := make([]RequestMethod, 0, len(tokens))
+	for _, t := range tokens {
+		methods = append(methods, RequestMethod(strings.ToUpper(t)))
+	}
+	return methods
+}
+
+// Supports reports if option tag is listed by Supported or Require header
+func (m *Message) Supports(option string) bool {
+	for _, list := range [][]string{m.Supported(), m.Require()} {
+		for _, t := range list {
+			if strings.EqualFold(t, option) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Expires returns value of Expires header, false when it is missing or invalid
+func (m *Message) Expires() (int, bool) {
+	return m.number("Expires")
+}
+
+// SetExpires sets Expires header, 0 included
+func (m *Message) SetExpires(seconds int) {
+	m.setNumber("Expires", seconds)
+}
+
+// MaxForwards returns value of Max-Forwards header, false when it is missing or invalid
+func (m *Message) MaxForwards() (int, bool) {
+	return m.number("Max-Forwards")
+}
+
+// SetMaxForwards sets Max-Forwards header, 0 included
+func (m *Message) SetMaxForwards(n int) {
+	m.setNumber("Max-Forwards", n)
+}
+
+func (m *Message) number(name string) (int, bool) {
+	n, err := parseNumber(m.Header(name))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func (m *Message) setNumber(name string, n int) {
+	m.removeXHeader(CanonicalHeader(name))
+	m.Msg.XHeader = &sip.XHeader{Name: name, Value: []byte(strconv.Itoa(n)), Next: m.Msg.XHeader}
+}
+
+// Authorization returns credentials of Authorization header
+func (m *Message) Authorization() (*AuthHeader, error) {
+	if m.Msg.Authorization == "" {
+		return nil, ErrNoHeader
+	}
+	return ParseAuthHeader(m.Msg.Authorization)
+}
+
+// ProxyAuthorization returns credentials of Proxy-Authorization header
+func (m *Message) ProxyAuthorization() (*AuthHeader, error) {
+	if m.Msg.ProxyAuthorization == "" {
+		return nil, ErrNoHeader
+	}
+	return ParseAuthHeader(m.Msg.ProxyAuthorization)
+}
+
+func stringField(ptr func(m *sip.Msg) *string) field {
+	return field{
+		get: func(m *sip.Msg) []string {
+			if v := *ptr(m); v != "" {
+				return []string{v}
+			}
+			return nil
+		},
+		set: func(m *sip.Msg, value string) error {
+			*ptr(m) = value
+			return nil
+		},
+		add: func(m *sip.Msg, value string) error {
+			// gosip keeps single value, values of list headers are joined
+			if p := ptr(m); *p != "" {
+				*p += ", " + value
+			} else {
+				*p = value
+			}
+			return nil
+		},
+		del: func(m *sip.Msg) {
+			*ptr(m) = ""
+		},
+	}
+}
+
+func addrField(ptr func(m *sip.Msg) **sip.Addr, list bool) field {
+	return field{
+		get: func(m *sip.Msg) []string {
+			var values []string
+			for _, a := range addrList(*ptr(m)) {
+				values = append(values, a.String())
+			}
+			return values
+		},
+		set: func(m *sip.Msg, value string) error {
+			addr, err := ParseAddr(value)
+			if err != nil {
+				return err
+			}
+			if !list && addr.Next != nil {
+				return fmt.Errorf("%w: single address expected", ErrInvalidAddr)
+			}
+			*ptr(m) = addr
+			return nil
+		},
+		add: func(m *sip.Msg, value string) error {
+			addr, err := ParseAddr(value)
+			if err != nil {
+				return err
+			}
+			p := ptr(m)
+			if !list || *p == nil {
+				*p = addr
+				return nil
+			}
+			(*p).Last().Next = addr
+			return nil
+		},
+		del: func(m *sip.Msg) {
+			*ptr(m) = nil
+		},
+	}
+}
+
+func intField(ptr func(m *sip.Msg) *int) field {
+	return singleField(field{
+		get: func(m *sip.Msg) []string {
+			if v := *ptr(m); v > 0 {
+				return []string{strconv.Itoa(v)}
+			}
+			return nil
+		},
+		set: func(m *sip.Msg, value string) error {
+			n, err := parseNumber(value)
+			if err != nil {
+				return err
+			}
+			*ptr(m) = n
+			return nil
+		},
+		del: func(m *sip.Msg) {
+			*ptr(m) = 0
+		},
+	})
+}
+
+// singleField makes header of single value, which is replaced when it is added
+func singleField(f field) field {
+	f.add = f.set
+	return f
+}
+
+// checkNumber checks value of number header, other headers are not checked
+func checkNumber(canonical string, value string) error {
+	limit, ok := numberHeaders[canonical]
+	if !ok {
+		return nil
+	}
+	if n, err := parseNumber(value); err != nil || n > limit {
+		return fmt.Errorf("invalid number %q", value)
+	}
+	return nil
+}
+
+func parseNumber(value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return n, nil
+}
+
+var cseqField = singleField(field{
+	get: func(m *sip.Msg) []string {
+		if m.CSeq == 0 && m.CSeqMethod == "" {
+			return nil
+		}
+		return []string{strconv.Itoa(m.CSeq) + " " + m.CSeqMethod}
+	},
+	set: func(m *sip.Msg, value string) error {
+		num, method, ok := strings.Cut(strings.TrimSpace(value), " ")
+		n, err := strconv.Atoi(num)
+		if !ok || err != nil || n < 0 {
+			return fmt.Errorf("invalid CSeq %q", value)
+		}
+		m.CSeq, m.CSeqMethod = n, strings.TrimSpace(method)
+		return nil
+	},
+	del: func(m *sip.Msg) {
+		m.CSeq, m.CSeqMethod = 0, ""
+	},
+})
+
+var viaField = field{
+	get: func(m *sip.Msg) []string {
+		var values []string
+		for v := m.Via; v != nil; v = v.Next {
+			var b bytes.Buffer
+			v.Append(&b)
+			values = append(values, b.String())
+		}
+		return values
+	},
+	set: func(m *sip.Msg, value string) error {
+		return ErrReadOnlyHeader
+	},
+	add: func(m *sip.Msg, value string) error {
+		return ErrReadOnlyHeader
+	},
+	del: func(m *sip.Msg) {
+		m.Via = nil
+	},
+}
+
+var contentTypeField = singleField(field{
+	get: func(m *sip.Msg) []string {
+		if m.Payload != nil && m.Payload.ContentType() != "" {
+			return []string{m.Payload.ContentType()}
+		}
+		return nil
+	},
+	set: func(m *sip.Msg, value string) error {
+		var data []byte
+		if m.Payload != nil {
+			data = m.Payload.Data()
+		}
+		m.Payload = &sip.MiscPayload{T: strings.TrimSpace(value), D: data}
+		return nil
+	},
+	del: func(m *sip.Msg) {
+		m.Payload = nil
+	},
+})
+
+var contentLengthField = field{
+	get: func(m *sip.Msg) []string {
+		n := 0
+		if m.Payload != nil {
+			n = len(m.Payload.Data())
+		}
+		return []string{strconv.Itoa(n)}
+	},
+	set: func(m *sip.Msg, value string) error {
+		return ErrReadOnlyHeader
+	},
+	add: func(m *sip.Msg, value string) error {
+		return ErrReadOnlyHeader
+	},
+	del: func(m *sip.Msg) {},
+}
+
+// addrList returns addresses of list, each without the following ones
+func addrList(addr *sip.Addr) []*sip.Addr {
+	var list []*sip.Addr
+	for a := addr; a != nil; a = a.Next {
+		c := *a
+		c.Next = nil
+		list = append(list, &c)
+	}
+	return list
+}
+
+// tokenList splits comma separated values into tokens
+func tokenList(values []string) []string {
+	var tokens []string
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
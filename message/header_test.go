@@ -0,0 +1,218 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jart/gosip/sip"
+)
+
+func newTestRequest(method RequestMethod) *Message {
+	return NewRequest(method, &sip.URI{Scheme: "sip", User: "bob", Host: "example.com"}).
+		From(&sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}}).
+		Via("192.0.2.1", 5060).
+		Build()
+}
+
+// wireHeaders returns header lines of message as written on the wire
+func wireHeaders(m *Message, name string) []string {
+	var b bytes.Buffer
+	m.Append(&b)
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\r\n") {
+		if h, _, ok := strings.Cut(line, ":"); ok && CanonicalHeader(h) == CanonicalHeader(name) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestCanonicalHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"v", "via"},
+		{"I", "call-id"},
+		{" l ", "content-length"},
+		{"m", "contact"},
+		{"k", "supported"},
+		{"o", "event"},
+		{"Max-Forwards", "max-forwards"},
+		{"X-Custom", "x-custom"},
+		// Unknown single letter is kept
+		{"z", "z"},
+	}
+
+	for _, tt := range tests {
+		if got := CanonicalHeader(tt.name); got != tt.want {
+			t.Errorf("CanonicalHeader(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		method RequestMethod
+		header string
+		// alias is other name of header, e.g. compact form
+		alias string
+		value string
+		want  []string
+		// wire is header line written, empty when it is written as value
+		wire string
+		// removed is header line written after removal, empty for none
+		removed string
+	}{
+		{name: "Expires 0 of SUBSCRIBE", method: SUBSCRIBE, header: "Expires", alias: "expires", value: "0", want: []string{"0"}},
+		{name: "Expires 0 of REGISTER", method: REGISTER, header: "Expires", alias: "EXPIRES", value: "0", want: []string{"0"}},
+		{name: "Max-Forwards 0", method: OPTIONS, header: "Max-Forwards", alias: "max-forwards", value: "0", want: []string{"0"}, removed: "Max-Forwards: 70"},
+		{name: "compact Subject", method: MESSAGE, header: "s", alias: "Subject", value: "hello", want: []string{"hello"}, wire: "Subject: hello"},
+		{name: "compact Supported", method: INVITE, header: "k", alias: "Supported", value: "100rel, timer", want: []string{"100rel, timer"}, wire: "Supported: 100rel, timer"},
+		{
+			name:   "compact Contact list",
+			method: INVITE,
+			header: "m",
+			alias:  "Contact",
+			value:  "<sip:a@192.0.2.1>, <sip:b@192.0.2.2>;q=0.5",
+			want:   []string{"<sip:a@192.0.2.1>", "<sip:b@192.0.2.2>;q=0.5"},
+			wire:   "Contact: <sip:a@192.0.2.1>, <sip:b@192.0.2.2>;q=0.5",
+		},
+		{name: "Retry-After", method: INVITE, header: "Retry-After", alias: "retry-after", value: "120", want: []string{"120"}},
+		{name: "extension header", method: INVITE, header: "X-Custom", alias: "x-custom", value: "a b", want: []string{"a b"}},
+		{name: "compact event", method: SUBSCRIBE, header: "o", alias: "Event", value: "presence", want: []string{"presence"}, wire: "Event: presence"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestRequest(tt.method)
+			if err := m.SetHeader(tt.header, tt.value); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{tt.header, tt.alias} {
+				got := m.Headers(name)
+				if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+					t.Errorf("Headers(%q) = %q, want %q", name, got, tt.want)
+				}
+			}
+			wire := tt.wire
+			if wire == "" {
+				wire = tt.header + ": " + tt.value
+			}
+			if got := wireHeaders(m, tt.header); len(got) != 1 || got[0] != wire {
+				t.Errorf("written %q, want %q", got, wire)
+			}
+
+			m.RemoveHeader(tt.alias)
+			if m.HasHeader(tt.header) {
+				t.Errorf("header %q present after removal", m.Header(tt.header))
+			}
+			got := strings.Join(wireHeaders(m, tt.header), "|")
+			if got != tt.removed {
+				t.Errorf("written %q after removal, want %q", got, tt.removed)
+			}
+		})
+	}
+}
+
+func TestExpiresAccessor(t *testing.T) {
+	tests := []struct {
+		name   string
+		method RequestMethod
+		set    func(m *Message)
+		want   int
+		ok     bool
+	}{
+		{name: "missing of REGISTER", method: REGISTER, set: func(m *Message) {}},
+		{name: "missing of SUBSCRIBE", method: SUBSCRIBE, set: func(m *Message) {}},
+		{name: "unsubscribe", method: SUBSCRIBE, set: func(m *Message) { m.SetExpires(0) }, ok: true},
+		{name: "unregister", method: REGISTER, set: func(m *Message) { m.SetExpires(0) }, ok: true},
+		{name: "set twice", method: REGISTER, set: func(m *Message) { m.SetExpires(60); m.SetExpires(3600) }, want: 3600, ok: true},
+		{name: "added twice", method: PUBLISH, set: func(m *Message) { m.AddHeader("Expires", "60"); m.AddHeader("Expires", "0") }, ok: true},
+		{name: "invalid text", method: SUBSCRIBE, set: func(m *Message) { m.Msg.XHeader = &sip.XHeader{Name: "Expires", Value: []byte("soon")} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestRequest(tt.method)
+			tt.set(m)
+			got, ok := m.Expires()
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Expires() = %d, %v, want %d, %v", got, ok, tt.want, tt.ok)
+			}
+			if n := len(m.Headers("Expires")); n > 1 {
+				t.Errorf("%d Expires headers", n)
+			}
+			if m.Msg.Expires != 0 {
+				t.Errorf("Msg.Expires = %d, want unused", m.Msg.Expires)
+			}
+		})
+	}
+}
+
+func TestSetHeaderInvalid(t *testing.T) {
+	tests := []struct {
+		header string
+		value  string
+		err    error
+	}{
+		{header: "Expires", value: "-1"},
+		{header: "Expires", value: "soon"},
+		{header: "Max-Forwards", value: "256"},
+		{header: "CSeq", value: "abc INVITE"},
+		{header: "From", value: "<sip:a@example.com"},
+		{header: "Via", value: "SIP/2.0/UDP 192.0.2.9", err: ErrReadOnlyHeader},
+		{header: "l", value: "10", err: ErrReadOnlyHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header+" "+tt.value, func(t *testing.T) {
+			m := newTestRequest(INVITE)
+			m.SetExpires(60)
+			m.SetMaxForwards(10)
+			before := m.Headers(tt.header)
+
+			err := m.SetHeader(tt.header, tt.value)
+			if err == nil {
+				t.Fatal("invalid value was set")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+			if got := m.Headers(tt.header); strings.Join(got, "|") != strings.Join(before, "|") {
+				t.Errorf("header changed to %q from %q", got, before)
+			}
+		})
+	}
+}
+
+func TestDecrementMaxForwards(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(m *Message)
+		want int
+	}{
+		{name: "missing", set: func(m *Message) {}, want: 70},
+		{name: "70", set: func(m *Message) { m.SetMaxForwards(70) }, want: 69},
+		{name: "1", set: func(m *Message) { m.SetMaxForwards(1) }, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestRequest(INVITE)
+			tt.set(m)
+			orig := m.Clone()
+			m.DecrementMaxForwards()
+			if got, _ := m.MaxForwards(); got != tt.want {
+				t.Errorf("Max-Forwards %d, want %d", got, tt.want)
+			}
+			// Clone shares extension headers, original keeps its value
+			if strings.Join(orig.Headers("Max-Forwards"), "") == strings.Join(m.Headers("Max-Forwards"), "") {
+				t.Errorf("original changed to %q", orig.Headers("Max-Forwards"))
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package message
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
 	"fmt"
 	"strings"
 
@@ -9,9 +12,20 @@ import (
 
 type RequestMiddleware func(req *Message)
 
+// ResponseMiddleware gets response returned by request handler, nil when handler
+// responded by itself. Returning true stops the chain and response is not sent.
 type ResponseMiddleware func(res *Message) bool
 
-type RequestHandler func(req *Message) *Message
+// RequestHandler handles request and returns response, nil when it responds by itself.
+// Ctx is canceled when handler returns, on its deadline or when server stops.
+type RequestHandler func(ctx context.Context, req *Message) *Message
+
+// Middleware wraps request handler, e.g. with logging or authentication. It can
+// answer request without calling next.
+type Middleware func(next RequestHandler) RequestHandler
+
+// ResponseHandler gets response received by server
+type ResponseHandler func(res *Message)
 
 type RequestMethod string
 
@@ -24,6 +38,9 @@ type StatusCode int
 
 type RespondFunc func(*Message) error
 
+// Message is SIP message with its transport metadata. Expires and Max-Forwards
+// are kept as extension headers, as gosip can not tell them missing from 0, so
+// Msg.Expires and Msg.MaxForwards are not used.
 type Message struct {
 	Msg       *sip.Msg
 	Transport string
@@ -31,6 +48,9 @@ type Message struct {
 	Source      string
 	Destination string
 
+	// PeerCertificates are certificates presented by remote side of TLS connection
+	PeerCertificates []*x509.Certificate
+
 	Respond RespondFunc
 }
 
@@ -58,12 +78,38 @@ func (m *Message) Clone() Message {
 		Transport:   m.Transport,
 		Source:      m.Source,
 		Destination: m.Destination,
-		Respond:     m.Respond,
+
+		PeerCertificates: m.PeerCertificates,
+
+		Respond: m.Respond,
+	}
+}
+
+// Append serializes message into buffer
+func (m *Message) Append(b *bytes.Buffer) {
+	appendMsg(b, m.Msg)
+}
+
+// DecrementMaxForwards decrements Max-Forwards of request forwarded by proxy.
+// Request without it gets 70 (RFC 3261 16.6 step 3).
+func (m *Message) DecrementMaxForwards() {
+	n, ok := m.MaxForwards()
+	if !ok {
+		m.SetMaxForwards(defaultMaxForwards)
+		return
 	}
+	m.SetMaxForwards(max(n-1, 0))
 }
 
 func (m *Message) GetBranch() string {
-	return m.Msg.Via.Param.Get("branch").Value
+	if m.Msg.Via == nil {
+		return ""
+	}
+	branch := m.Msg.Via.Param.Get("branch")
+	if branch == nil {
+		return ""
+	}
+	return branch.Value
 }
 
 func (m *Message) GetCallID() string {
@@ -71,19 +117,25 @@ func (m *Message) GetCallID() string {
 }
 
 func (m *Message) GetToTag() string {
-	toParam := m.Msg.To.Param
-	if toParam == nil {
+	if m.Msg.To == nil {
 		return ""
 	}
-	return toParam.Get("tag").Value
+	tag := m.Msg.To.Param.Get("tag")
+	if tag == nil {
+		return ""
+	}
+	return tag.Value
 }
 
 func (m *Message) GetFromTag() string {
-	fromParam := m.Msg.From.Param
-	if fromParam == nil {
+	if m.Msg.From == nil {
+		return ""
+	}
+	tag := m.Msg.From.Param.Get("tag")
+	if tag == nil {
 		return ""
 	}
-	return fromParam.Get("tag").Value
+	return tag.Value
 }
 
 // MakeDialogIDFromMessage creates dialog ID of message.
@@ -0,0 +1,22 @@
+package message
+
+import (
+	"strings"
+
+	"github.com/jart/gosip/sip"
+)
+
+// RemoveParam returns param list without params named name. Original list is not modified
+func RemoveParam(p *sip.Param, name string) *sip.Param {
+	if p == nil {
+		return nil
+	}
+	next := RemoveParam(p.Next, name)
+	if strings.EqualFold(p.Name, name) {
+		return next
+	}
+	if next == p.Next {
+		return p
+	}
+	return &sip.Param{Name: p.Name, Value: p.Value, Next: next}
+}
@@ -0,0 +1,168 @@
+package message
+
+import (
+	"github.com/jart/gosip/sip"
+	"github.com/jart/gosip/util"
+)
+
+// RequestBuilder builds request outside dialog, e.g.
+//
+//	req := message.NewRequest(message.INVITE, uri).
+//		From(&sip.Addr{Display: "Alice", Uri: alice}).
+//		SDP(offer).
+//		Build()
+//	ch, err := srv.Request(ctx, req)
+//
+// Requests within dialog are built by Dialog.NewRequest.
+type RequestBuilder struct {
+	msg         *sip.Msg
+	transport   string
+	destination string
+}
+
+// NewRequest starts request of method to uri
+func NewRequest(method RequestMethod, uri *sip.URI) *RequestBuilder {
+	msg := &sip.Msg{
+		Method:  string(method),
+		Request: uri.Copy(),
+	}
+	return &RequestBuilder{msg: msg}
+}
+
+// From sets From header, tag is generated when it has none. From is required,
+// Server.Request rejects request without it with ErrInvalidRequest.
+func (b *RequestBuilder) From(addr *sip.Addr) *RequestBuilder {
+	b.msg.From = copyAddr(addr)
+	return b
+}
+
+// To sets To header, Request-URI is used by default
+func (b *RequestBuilder) To(addr *sip.Addr) *RequestBuilder {
+	b.msg.To = copyAddr(addr)
+	return b
+}
+
+// Contact sets Contact header. Server.Request derives it from local address
+// and listen port for INVITE, SUBSCRIBE and REFER when it is not set.
+func (b *RequestBuilder) Contact(addr *sip.Addr) *RequestBuilder {
+	b.msg.Contact = copyAddr(addr)
+	return b
+}
+
+// Route appends Route header, e.g. outbound proxy
+func (b *RequestBuilder) Route(uri *sip.URI) *RequestBuilder {
+	route := &sip.Addr{Uri: uri.Copy()}
+	if b.msg.Route == nil {
+		b.msg.Route = route
+	} else {
+		b.msg.Route.Last().Next = route
+	}
+	return b
+}
+
+// Via sets sent-by of Via header. Server.Request fills in local address and
+// listen port of transport otherwise.
+func (b *RequestBuilder) Via(host string, port int) *RequestBuilder {
+	b.via().Host = host
+	b.via().Port = uint16(port)
+	return b
+}
+
+// CallID sets Call-ID, it is generated by default
+func (b *RequestBuilder) CallID(id string) *RequestBuilder {
+	b.msg.CallID = id
+	return b
+}
+
+// CSeq sets sequence number, 1 by default
+func (b *RequestBuilder) CSeq(seq int) *RequestBuilder {
+	b.msg.CSeq = seq
+	return b
+}
+
+// MaxForwards sets Max-Forwards, 70 by default
+func (b *RequestBuilder) MaxForwards(n int) *RequestBuilder {
+	(&Message{Msg: b.msg}).SetMaxForwards(n)
+	return b
+}
+
+// Expires sets Expires header, e.g. of REGISTER or SUBSCRIBE
+func (b *RequestBuilder) Expires(seconds int) *RequestBuilder {
+	(&Message{Msg: b.msg}).SetExpires(seconds)
+	return b
+}
+
+// Header appends extension header
+func (b *RequestBuilder) Header(name string, value string) *RequestBuilder {
+	// gosip writes extension headers from the last one in list
+	b.msg.XHeader = &sip.XHeader{Name: name, Value: []byte(value), Next: b.msg.XHeader}
+	return b
+}
+
+// Body sets body of request
+func (b *RequestBuilder) Body(payload sip.Payload) *RequestBuilder {
+	b.msg.Payload = payload
+	return b
+}
+
+// SDP sets SDP body of request
+func (b *RequestBuilder) SDP(sdp []byte) *RequestBuilder {
+	return b.Body(&sip.MiscPayload{T: "application/sdp", D: sdp})
+}
+
+// Transport sets transport of request, it is picked from Route or Request-URI by default
+func (b *RequestBuilder) Transport(network string) *RequestBuilder {
+	b.transport = network
+	return b
+}
+
+// Destination sets address request is sent to, it is resolved from Route or
+// Request-URI by default
+func (b *RequestBuilder) Destination(addr string) *RequestBuilder {
+	b.destination = addr
+	return b
+}
+
+// Build returns request with generated Call-ID, From tag, CSeq and Via branch
+// with rport (RFC 3581). From is not defaulted, it must be set by From before.
+// Builder must not be used afterwards.
+func (b *RequestBuilder) Build() *Message {
+	msg := b.msg
+	if msg.To == nil {
+		msg.To = &sip.Addr{Uri: msg.Request.Copy()}
+	}
+	if msg.From != nil && msg.From.Param.Get("tag") == nil {
+		msg.From.Tag()
+	}
+	if msg.CallID == "" {
+		msg.CallID = util.GenerateCallID()
+	}
+	if msg.CSeq == 0 {
+		msg.CSeq = 1
+	}
+	msg.CSeqMethod = msg.Method
+
+	via := b.via()
+	if via.Param.Get("rport") == nil {
+		via.Param = &sip.Param{Name: "rport", Next: via.Param}
+	}
+	if via.Param.Get("branch") == nil {
+		via.Param = &sip.Param{Name: "branch", Value: util.GenerateBranch(), Next: via.Param}
+	}
+	if b.transport != "" {
+		via.Transport = b.transport
+	}
+
+	return &Message{
+		Msg:         msg,
+		Transport:   b.transport,
+		Destination: b.destination,
+	}
+}
+
+func (b *RequestBuilder) via() *sip.Via {
+	if b.msg.Via == nil {
+		b.msg.Via = &sip.Via{}
+	}
+	return b.msg.Via
+}
@@ -0,0 +1,231 @@
+package message
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/jart/gosip/sip"
+)
+
+// ServerName is value of Server header of responses created by NewResponse.
+// Empty value leaves header out.
+var ServerName = "simplesip"
+
+// tagKey keys To tags derived from requests, so tags can not be guessed
+var tagKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("read random tag key failed: " + err.Error())
+	}
+	return key
+}()
+
+// quoteEscaper escapes text of quoted string
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// phrases are reason phrases of RFC 3261 21
+var phrases = map[int]string{
+	100: "Trying",
+	180: "Ringing",
+	181: "Call Is Being Forwarded",
+	182: "Queued",
+	183: "Session Progress",
+	200: "OK",
+	202: "Accepted",
+	300: "Multiple Choices",
+	301: "Moved Permanently",
+	302: "Moved Temporarily",
+	305: "Use Proxy",
+	380: "Alternative Service",
+	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	410: "Gone",
+	413: "Request Entity Too Large",
+	414: "Request-URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Unsupported URI Scheme",
+	420: "Bad Extension",
+	421: "Extension Required",
+	423: "Interval Too Brief",
+	480: "Temporarily Unavailable",
+	481: "Call/Transaction Does Not Exist",
+	482: "Loop Detected",
+	483: "Too Many Hops",
+	484: "Address Incomplete",
+	485: "Ambiguous",
+	486: "Busy Here",
+	487: "Request Terminated",
+	488: "Not Acceptable Here",
+	491: "Request Pending",
+	493: "Undecipherable",
+	500: "Server Internal Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Server Time-out",
+	505: "Version Not Supported",
+	513: "Message Too Large",
+	600: "Busy Everywhere",
+	603: "Decline",
+	604: "Does Not Exist Anywhere",
+	606: "Not Acceptable",
+}
+
+// Phrase returns reason phrase of status code, empty for unknown code
+func Phrase(status int) string {
+	return phrases[status]
+}
+
+// NewResponse creates response of request (RFC 3261 8.2.6). Via, From, To, Call-ID,
+// CSeq and Record-Route are copied, other headers and body are left out. To tag
+// is added unless request has one or status is 100, it is the same for every
+// response of request. Empty phrase is replaced by phrase of status.
+//
+// Content-Length is written with message, Contact of dialog creating response is
+// added by Server.WriteResponse when it is missing.
+func NewResponse(req *Message, status int, phrase string) *Message {
+	if phrase == "" {
+		phrase = Phrase(status)
+	}
+
+	msg := req.Msg
+	to := copyAddr(msg.To)
+	if to != nil && req.GetToTag() == "" && status != 100 {
+		to.Param = &sip.Param{Name: "tag", Value: ToTag(req), Next: to.Param}
+	}
+
+	return &Message{
+		Msg: &sip.Msg{
+			Status:      status,
+			Phrase:      phrase,
+			Via:         copyVia(msg.Via),
+			From:        copyAddr(msg.From),
+			To:          to,
+			CallID:      msg.CallID,
+			CSeq:        msg.CSeq,
+			CSeqMethod:  msg.CSeqMethod,
+			RecordRoute: msg.RecordRoute.Copy(),
+			Server:      ServerName,
+		},
+		Transport:   req.Transport,
+		Source:      req.Destination,
+		Destination: req.Source,
+		Respond:     req.Respond,
+	}
+}
+
+// ToTag returns To tag of responses of request without one. Tag is derived from
+// Call-ID, From tag, top Via and CSeq number, so retransmissions of request and
+// its CANCEL get the same tag.
+func ToTag(req *Message) string {
+	if tag := req.GetToTag(); tag != "" {
+		return tag
+	}
+
+	msg := req.Msg
+	h := hmac.New(sha256.New, tagKey)
+	for _, s := range []string{msg.CallID, req.GetFromTag(), req.GetBranch(), strconv.Itoa(msg.CSeq)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	if msg.Via != nil {
+		h.Write([]byte(msg.Via.Host + ":" + strconv.Itoa(int(msg.Via.Port))))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// NewTrying creates 100 response
+func NewTrying(req *Message) *Message {
+	return NewResponse(req, 100, "")
+}
+
+// NewRinging creates 180 response
+func NewRinging(req *Message) *Message {
+	return NewResponse(req, 180, "")
+}
+
+// NewSessionProgress creates 183 response with SDP for early media
+func NewSessionProgress(req *Message, sdp []byte) *Message {
+	res := NewResponse(req, 183, "")
+	res.SetSDP(sdp)
+	return res
+}
+
+// NewOK creates 200 response, with SDP unless sdp is nil
+func NewOK(req *Message, sdp []byte) *Message {
+	res := NewResponse(req, 200, "")
+	if sdp != nil {
+		res.SetSDP(sdp)
+	}
+	return res
+}
+
+// NewRedirect creates 3xx response with contacts to try instead
+func NewRedirect(req *Message, status int, contacts ...*sip.Addr) *Message {
+	res := NewResponse(req, status, "")
+	var last *sip.Addr
+	for _, c := range contacts {
+		c = copyAddr(c)
+		c.Next = nil
+		if last == nil {
+			res.Msg.Contact = c
+		} else {
+			last.Next = c
+		}
+		last = c
+	}
+	return res
+}
+
+// NewWarning creates response, usually 4xx, with Warning 399 carrying text (RFC 3261 20.43)
+func NewWarning(req *Message, status int, text string) *Message {
+	res := NewResponse(req, status, "")
+	res.Msg.Warning = `399 simplesip "` + quoteEscaper.Replace(text) + `"`
+	return res
+}
+
+// SetSDP sets body of message to SDP
+func (m *Message) SetSDP(sdp []byte) {
+	m.Msg.Payload = &sip.MiscPayload{T: "application/sdp", D: sdp}
+}
+
+// copyAddr copies address with display name and params, which Addr.Copy leaves
+// out or shares
+func copyAddr(addr *sip.Addr) *sip.Addr {
+	if addr == nil {
+		return nil
+	}
+	res := addr.Copy()
+	for a, r := addr, res; a != nil; a, r = a.Next, r.Next {
+		r.Display = a.Display
+		r.Param = copyParams(a.Param)
+	}
+	return res
+}
+
+// copyVia copies Via list with params, which Via.Copy shares
+func copyVia(via *sip.Via) *sip.Via {
+	res := via.Copy()
+	for v, r := via, res; v != nil; v, r = v.Next, r.Next {
+		r.Param = copyParams(v.Param)
+	}
+	return res
+}
+
+func copyParams(p *sip.Param) *sip.Param {
+	if p == nil {
+		return nil
+	}
+	return &sip.Param{Name: p.Name, Value: p.Value, Next: copyParams(p.Next)}
+}
@@ -0,0 +1,179 @@
+package message
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jart/gosip/sip"
+)
+
+// newDialogRequest creates INVITE passed through proxy, with two Vias and Record-Route
+func newDialogRequest() *Message {
+	return &Message{
+		Msg: &sip.Msg{
+			Method:  string(INVITE),
+			Request: &sip.URI{Scheme: "sip", User: "bob", Host: "192.0.2.4"},
+			Via: &sip.Via{
+				Transport: "UDP", Host: "192.0.2.2", Port: 5060,
+				Param: &sip.Param{Name: "branch", Value: "z9hG4bKproxy1"},
+				Next: &sip.Via{
+					Transport: "UDP", Host: "192.0.2.1", Port: 5060,
+					Param: &sip.Param{Name: "branch", Value: "z9hG4bKalice1", Next: &sip.Param{Name: "received", Value: "198.51.100.7"}},
+				},
+			},
+			From:        &sip.Addr{Display: "Alice", Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}, Param: &sip.Param{Name: "tag", Value: "a1"}},
+			To:          &sip.Addr{Display: "Bob", Uri: &sip.URI{Scheme: "sip", User: "bob", Host: "example.com"}},
+			Contact:     &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "192.0.2.1"}},
+			RecordRoute: &sip.Addr{Uri: &sip.URI{Scheme: "sip", Host: "192.0.2.2", Param: &sip.URIParam{Name: "lr"}}},
+			CallID:      "resp-1@192.0.2.1",
+			CSeq:        1,
+			CSeqMethod:  string(INVITE),
+			Subject:     "lunch",
+			Payload:     &sip.MiscPayload{T: "application/sdp", D: []byte("v=0\r\n")},
+		},
+		Transport:   "UDP",
+		Source:      "192.0.2.2:5060",
+		Destination: "192.0.2.4:5060",
+	}
+}
+
+func TestNewResponseToTag(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// tagged sets To tag of request
+		tagged bool
+		// want is To tag of response, "derived" for ToTag of request
+		want string
+	}{
+		{name: "100 Trying", status: 100, want: ""},
+		{name: "180 Ringing", status: 180, want: "derived"},
+		{name: "200 OK", status: 200, want: "derived"},
+		{name: "486 Busy Here", status: 486, want: "derived"},
+		{name: "in dialog", status: 200, tagged: true, want: "b1"},
+		{name: "100 Trying in dialog", status: 100, tagged: true, want: "b1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newDialogRequest()
+			if tt.tagged {
+				req.Msg.To.Param = &sip.Param{Name: "tag", Value: "b1"}
+			}
+			want := tt.want
+			if want == "derived" {
+				want = ToTag(req)
+			}
+
+			res := NewResponse(req, tt.status, "")
+			if got := res.GetToTag(); got != want {
+				t.Errorf("To tag %q, want %q", got, want)
+			}
+			if !tt.tagged && req.GetToTag() != "" {
+				t.Errorf("request got To tag %q", req.GetToTag())
+			}
+			if res.Msg.To.Display != "Bob" {
+				t.Errorf("To display name %q, want Bob", res.Msg.To.Display)
+			}
+		})
+	}
+}
+
+func TestToTagStable(t *testing.T) {
+	req := newDialogRequest()
+	tag := ToTag(req)
+	if tag == "" {
+		t.Fatal("empty To tag")
+	}
+
+	ringing := NewRinging(req)
+	ok := NewOK(req, nil)
+	if ringing.GetToTag() != tag || ok.GetToTag() != tag {
+		t.Errorf("To tags %q and %q of responses, want %q", ringing.GetToTag(), ok.GetToTag(), tag)
+	}
+
+	// Retransmission is parsed again, it is other message with same fields
+	if got := ToTag(newDialogRequest()); got != tag {
+		t.Errorf("To tag %q of retransmission, want %q", got, tag)
+	}
+
+	// CANCEL matches INVITE by Call-ID, From tag, top Via and CSeq number
+	cancel := newDialogRequest()
+	cancel.Msg.Method = string(CANCEL)
+	cancel.Msg.CSeqMethod = string(CANCEL)
+	if got := ToTag(cancel); got != tag {
+		t.Errorf("To tag %q of CANCEL, want %q", got, tag)
+	}
+
+	others := map[string]func(m *Message){
+		"Call-ID":  func(m *Message) { m.Msg.CallID = "resp-2@192.0.2.1" },
+		"From tag": func(m *Message) { m.Msg.From.Param.Value = "a2" },
+		"branch":   func(m *Message) { m.Msg.Via.Param.Value = "z9hG4bKproxy2" },
+		"CSeq":     func(m *Message) { m.Msg.CSeq = 2 },
+	}
+	for name, change := range others {
+		other := newDialogRequest()
+		change(other)
+		if ToTag(other) == tag {
+			t.Errorf("To tag is the same for other %s", name)
+		}
+	}
+}
+
+func TestNewResponseCopy(t *testing.T) {
+	req := newDialogRequest()
+	res := NewResponse(req, 200, "")
+
+	if res.Msg.Phrase != "OK" {
+		t.Errorf("phrase %q, want OK", res.Msg.Phrase)
+	}
+	if res.Source != req.Destination || res.Destination != req.Source || res.Transport != req.Transport {
+		t.Errorf("addresses %s -> %s over %s", res.Source, res.Destination, res.Transport)
+	}
+
+	wire := func(m *Message, name string) string {
+		return strings.Join(wireHeaders(m, name), "|")
+	}
+	for _, name := range []string{"Via", "From", "Record-Route", "Call-ID", "CSeq"} {
+		if got, want := wire(res, name), wire(req, name); got != want {
+			t.Errorf("%s %q, want %q", name, got, want)
+		}
+	}
+	if n := len(wireHeaders(res, "Via")); n != 2 {
+		t.Errorf("%d Vias, want 2", n)
+	}
+	for _, name := range []string{"Contact", "Subject", "Content-Type"} {
+		if got := wire(res, name); got != "" {
+			t.Errorf("%s %q copied", name, got)
+		}
+	}
+	if got := wire(res, "Content-Length"); got != "Content-Length: 0" {
+		t.Errorf("written %q, want empty body", got)
+	}
+
+	// Response owns its headers, proxy changes to it leave request alone
+	res.Msg.Via = res.Msg.Via.Next
+	res.Msg.Via.Param.Value = "z9hG4bKchanged"
+	res.Msg.RecordRoute.Uri.Host = "192.0.2.3"
+	res.Msg.From.Param.Value = "changed"
+	if req.Msg.Via.Next.Param.Value != "z9hG4bKalice1" {
+		t.Errorf("request Via changed to %q", req.Msg.Via.Next.Param.Value)
+	}
+	if req.Msg.RecordRoute.Uri.Host != "192.0.2.2" {
+		t.Errorf("request Record-Route changed to %q", req.Msg.RecordRoute.Uri.Host)
+	}
+	if req.GetFromTag() != "a1" {
+		t.Errorf("request From tag changed to %q", req.GetFromTag())
+	}
+}
+
+func TestNewTrying(t *testing.T) {
+	req := newDialogRequest()
+	res := NewTrying(req)
+	if res.Msg.Status != 100 || res.Msg.Phrase != "Trying" {
+		t.Errorf("status %d %s, want 100 Trying", res.Msg.Status, res.Msg.Phrase)
+	}
+	if got := wireHeaders(res, "To"); len(got) != 1 || strings.Contains(got[0], "tag=") {
+		t.Errorf("written %q, want To without tag", got)
+	}
+}
@@ -0,0 +1,75 @@
+// Package middleware provides common request handler middlewares, e.g.
+//
+//	srv.Use(middleware.Recover(), middleware.Logging(), middleware.MaxForwards())
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/shend/simplesip/message"
+)
+
+// Logging logs every request with status of its response and handling time.
+// Status is 0 when handler responded by itself.
+func Logging() message.Middleware {
+	return func(next message.RequestHandler) message.RequestHandler {
+		return func(ctx context.Context, req *message.Message) *message.Message {
+			start := time.Now()
+			res := next(ctx, req)
+
+			status := 0
+			if res != nil {
+				status = res.Msg.Status
+			}
+			slog.Info("request handled",
+				"method", req.Msg.Method,
+				"call-id", req.Msg.CallID,
+				"src", req.Source,
+				"status", status,
+				"duration", time.Since(start),
+			)
+			return res
+		}
+	}
+}
+
+// Recover answers request with 500 when handler panics, instead of crashing server
+func Recover() message.Middleware {
+	return func(next message.RequestHandler) message.RequestHandler {
+		return func(ctx context.Context, req *message.Message) (res *message.Message) {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("request handler panicked", "panic", r, "method", req.Msg.Method, "stack", string(debug.Stack()))
+					if req.Msg.Method == string(message.ACK) {
+						res = nil
+						return
+					}
+					res = message.NewResponse(req, 500, "Server Internal Error")
+				}
+			}()
+			return next(ctx, req)
+		}
+	}
+}
+
+// MaxForwards answers request with Max-Forwards 0 with 483 (RFC 3261 16.3).
+// OPTIONS is passed to handler, which can answer it as destination (RFC 3261 11).
+func MaxForwards() message.Middleware {
+	return func(next message.RequestHandler) message.RequestHandler {
+		return func(ctx context.Context, req *message.Message) *message.Message {
+			if n, ok := req.MaxForwards(); !ok || n > 0 {
+				return next(ctx, req)
+			}
+			switch message.RequestMethod(req.Msg.Method) {
+			case message.OPTIONS:
+				return next(ctx, req)
+			case message.ACK:
+				return nil
+			}
+			return message.NewResponse(req, 483, "Too Many Hops")
+		}
+	}
+}
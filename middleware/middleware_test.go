@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+func newTestRequest(method message.RequestMethod) *message.Message {
+	req := message.NewRequest(method, &sip.URI{Scheme: "sip", User: "bob", Host: "example.com"}).
+		From(&sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}}).
+		Via("192.0.2.1", 5060).
+		Build()
+	req.Source = "192.0.2.1:5060"
+	return req
+}
+
+// handler answers with 200 and counts calls
+func handler(calls *int) message.RequestHandler {
+	return func(ctx context.Context, req *message.Message) *message.Message {
+		*calls++
+		return message.NewResponse(req, 200, "OK")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	panics := func(ctx context.Context, req *message.Message) *message.Message {
+		panic("boom")
+	}
+	tests := []struct {
+		name    string
+		method  message.RequestMethod
+		handler message.RequestHandler
+		// want is status of response, 0 for none
+		want int
+	}{
+		{name: "panic", method: message.INVITE, handler: panics, want: 500},
+		{name: "panic of ACK", method: message.ACK, handler: panics},
+		{name: "no panic", method: message.INVITE, handler: handler(new(int)), want: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Recover()(tt.handler)(context.Background(), newTestRequest(tt.method))
+			got := 0
+			if res != nil {
+				got = res.Msg.Status
+			}
+			if got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxForwards(t *testing.T) {
+	tests := []struct {
+		name   string
+		method message.RequestMethod
+		// maxForwards is value of header, -1 for none
+		maxForwards int
+		// want is status of response, 0 for none
+		want    int
+		handled bool
+	}{
+		{name: "exhausted", method: message.INVITE, maxForwards: 0, want: 483},
+		{name: "last hop", method: message.INVITE, maxForwards: 1, want: 200, handled: true},
+		{name: "missing", method: message.INVITE, maxForwards: -1, want: 200, handled: true},
+		{name: "exhausted OPTIONS", method: message.OPTIONS, maxForwards: 0, want: 200, handled: true},
+		{name: "exhausted ACK", method: message.ACK, maxForwards: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest(tt.method)
+			if tt.maxForwards >= 0 {
+				req.SetMaxForwards(tt.maxForwards)
+			}
+			calls := 0
+			res := MaxForwards()(handler(&calls))(context.Background(), req)
+			got := 0
+			if res != nil {
+				got = res.Msg.Status
+			}
+			if got != tt.want || (calls == 1) != tt.handled {
+				t.Errorf("status %d handled %v, want %d %v", got, calls == 1, tt.want, tt.handled)
+			}
+		})
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	calls := 0
+	res := Logging()(handler(&calls))(context.Background(), newTestRequest(message.INVITE))
+	if res == nil || res.Msg.Status != 200 || calls != 1 {
+		t.Fatalf("response %v not passed through", res)
+	}
+	line := buf.String()
+	for _, want := range []string{"method=INVITE", "status=200", "src=192.0.2.1:5060", "duration="} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log %q lacks %s", line, want)
+		}
+	}
+}
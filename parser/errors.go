@@ -0,0 +1,102 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/shend/simplesip/message"
+)
+
+var (
+	ErrInvalidStartLine = errors.New("invalid start line")
+	ErrInvalidHeader    = errors.New("invalid header")
+	ErrInvalidVia       = errors.New("invalid Via")
+	ErrMissingHeader    = errors.New("missing mandatory header")
+	ErrMissingVia       = fmt.Errorf("%w Via", ErrMissingHeader)
+	ErrTruncatedBody    = errors.New("body shorter than Content-Length")
+)
+
+// ParseError is returned by parsers for malformed message
+type ParseError struct {
+	// Header is name of invalid or missing header, empty when start line or body is invalid
+	Header string
+	// Offset is position in data where parsing failed, -1 when header is missing.
+	// Invalid header is reported at start of its line by every parser.
+	Offset int
+	Err    error
+	// Request is what could be recovered of malformed request, it has headers
+	// needed to respond: Via, From, To, Call-ID and CSeq. It is nil otherwise.
+	Request *message.Message
+}
+
+func (e *ParseError) Error() string {
+	if e.Header == "" {
+		return fmt.Sprintf("parse message at offset %d failed err=%v", e.Offset, e.Err)
+	}
+	if e.Offset < 0 {
+		return fmt.Sprintf("parse message failed header=%s err=%v", e.Header, e.Err)
+	}
+	return fmt.Sprintf("parse header %s at offset %d failed err=%v", e.Header, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError creates parse error and recovers request from data
+func newParseError(data []byte, header string, offset int, err error) *ParseError {
+	return &ParseError{
+		Header:  header,
+		Offset:  offset,
+		Err:     err,
+		Request: RecoverRequest(data),
+	}
+}
+
+// RecoverRequest parses what it can of malformed request, invalid headers are
+// left out. Request is returned only when Via, From, To, Call-ID and CSeq are
+// valid, so it can be answered with 400.
+func RecoverRequest(data []byte) *message.Message {
+	st := nativeState{recover: true}
+	m, err := st.parse(data)
+	if err != nil || m.Msg.IsResponse() {
+		return nil
+	}
+	msg := m.Msg
+	if msg.Method == "" || msg.From == nil || msg.To == nil || msg.CallID == "" || msg.CSeqMethod == "" {
+		return nil
+	}
+	return m
+}
+
+// headerAt returns name and offset of header line containing offset of data.
+// Name is empty and offset unchanged for start line and body.
+func headerAt(data []byte, offset int) (string, int) {
+	if offset < 0 || offset >= len(data) {
+		return "", offset
+	}
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end >= 0 && offset >= end+4 {
+		return "", offset
+	}
+	start := bytes.LastIndexByte(data[:offset], '\n') + 1
+	if start == 0 {
+		return "", offset
+	}
+	// Continuation line belongs to header above
+	for start > 1 && (data[start] == ' ' || data[start] == '\t') {
+		start = bytes.LastIndexByte(data[:start-1], '\n') + 1
+	}
+	name, _, ok := headerValue(cutLineAt(data, start))
+	if !ok {
+		return "", offset
+	}
+	return string(name), start
+}
+
+// cutLineAt returns line of data starting at offset without CRLF
+func cutLineAt(data []byte, offset int) []byte {
+	line, _ := cutLine(data[offset:])
+	return line
+}
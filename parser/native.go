@@ -0,0 +1,381 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// eagerHeaders are headers the stack reads from fields of Msg, or numbers like
+// Expires it reads from extension headers. They are parsed or checked by
+// NativeParser, other headers are left as text.
+var eagerHeaders = map[string]bool{
+	"from":                true,
+	"to":                  true,
+	"call-id":             true,
+	"cseq":                true,
+	"max-forwards":        true,
+	"contact":             true,
+	"route":               true,
+	"record-route":        true,
+	"expires":             true,
+	"min-expires":         true,
+	"retry-after":         true,
+	"warning":             true,
+	"authorization":       true,
+	"proxy-authorization": true,
+	"www-authenticate":    true,
+	"proxy-authenticate":  true,
+	"p-asserted-identity": true,
+}
+
+// mandatoryHeaders are needed to match transaction and respond, lenient parser
+// does not accept them malformed
+var mandatoryHeaders = map[string]bool{
+	"via":     true,
+	"from":    true,
+	"to":      true,
+	"call-id": true,
+	"cseq":    true,
+}
+
+// NativeParser parses message in single pass over data, for proxies which touch
+// few headers. Only Via, Content-Length and headers the stack reads from fields
+// of Msg, like From, To, CSeq, Contact or Route, are parsed. Other headers are
+// kept as extension headers referencing data, Message.Header reads them. Body,
+// SDP included, is not parsed and references data too, so data must not be
+// reused while message is in use.
+type NativeParser struct {
+	// Lenient accepts common quirks of vendors: bare LF line endings, extra
+	// whitespace and lower case version in start line, body shorter than
+	// Content-Length, and malformed headers other than Via, From, To, Call-ID
+	// and CSeq, which are kept as text. It can be changed before serving.
+	Lenient bool
+}
+
+// NewNativeParser creates native parser
+func NewNativeParser() *NativeParser {
+	return &NativeParser{}
+}
+
+// nativeState is state of single parse
+type nativeState struct {
+	// lenient accepts vendor quirks, recover skips every invalid header
+	lenient bool
+	recover bool
+
+	m                   *message.Message
+	contentLength       int
+	contentLengthOffset int
+	contentType         string
+}
+
+// ParseMsg parses message. Error is *ParseError.
+func (p *NativeParser) ParseMsg(data []byte) (*message.Message, error) {
+	st := nativeState{lenient: p.Lenient}
+	m, perr := st.parse(data)
+	if perr != nil {
+		perr.Request = RecoverRequest(data)
+		return nil, perr
+	}
+	return m, nil
+}
+
+func (st *nativeState) parse(data []byte) (*message.Message, *ParseError) {
+	loose := st.lenient || st.recover
+	head, body := data, []byte(nil)
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head, body = data[:i], data[i+4:]
+	}
+	if loose {
+		if i := bytes.Index(head, []byte("\n\n")); i >= 0 {
+			head, body = data[:i], data[i+2:]
+		}
+	}
+
+	line, rest := cutLine(head)
+	if !loose && len(rest) > 0 && !bytes.HasSuffix(head[:len(head)-len(rest)], []byte("\r\n")) {
+		return nil, &ParseError{Offset: len(line), Err: fmt.Errorf("%w: line not ended by CRLF", ErrInvalidStartLine)}
+	}
+	msg := &sip.Msg{}
+	if err := parseStartLine(msg, line, loose); err != nil && !(st.recover && msg.Method != "") {
+		return nil, &ParseError{Offset: 0, Err: err}
+	}
+	st.m = &message.Message{Msg: msg}
+	st.contentLength = -1
+
+	var name, value []byte
+	nameOffset := 0
+	for len(rest) > 0 || name != nil {
+		// Header continues on lines starting with whitespace (RFC 3261 7.3.1)
+		var next []byte
+		offset := len(head) - len(rest)
+		if len(rest) > 0 {
+			line, rest = cutLine(rest)
+			if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+				if name == nil {
+					return nil, &ParseError{Offset: offset, Err: fmt.Errorf("%w: continuation without header", ErrInvalidHeader)}
+				}
+				value = append(append(bytes.Clone(value), ' '), bytes.TrimSpace(line)...)
+				continue
+			}
+			next = line
+		}
+
+		if name != nil {
+			if err := st.addHeader(name, value, nameOffset); err != nil {
+				mandatory := mandatoryHeaders[message.CanonicalHeader(string(name))]
+				switch {
+				case st.recover:
+				case st.lenient && !mandatory:
+					msg.XHeader = &sip.XHeader{Name: string(name), Value: value, Next: msg.XHeader}
+				default:
+					return nil, &ParseError{Header: string(name), Offset: nameOffset, Err: err}
+				}
+			}
+			name, value = nil, nil
+		}
+		if len(next) == 0 {
+			continue
+		}
+
+		i := bytes.IndexByte(next, ':')
+		if i <= 0 {
+			if st.recover {
+				continue
+			}
+			return nil, &ParseError{Offset: offset, Err: fmt.Errorf("%w: %q", ErrInvalidHeader, next)}
+		}
+		name, value = bytes.TrimSpace(next[:i]), bytes.TrimSpace(next[i+1:])
+		nameOffset = offset
+	}
+
+	if msg.Via == nil {
+		return nil, &ParseError{Header: "Via", Offset: -1, Err: ErrMissingVia}
+	}
+	if st.contentLength >= 0 {
+		// Datagram may carry bytes past body, they are discarded (RFC 3261 18.3)
+		if st.contentLength <= len(body) {
+			body = body[:st.contentLength]
+		} else if !loose {
+			return nil, &ParseError{Header: "Content-Length", Offset: st.contentLengthOffset, Err: ErrTruncatedBody}
+		}
+	}
+	if len(body) > 0 {
+		msg.Payload = &sip.MiscPayload{T: st.contentType, D: body}
+	}
+
+	st.m.Transport = msg.Via.Transport
+	return st.m, nil
+}
+
+// parseStartLine parses Request-Line or Status-Line (RFC 3261 7.1, 7.2). Loose
+// parsing accepts any whitespace between elements and lower case version.
+func parseStartLine(msg *sip.Msg, line []byte, loose bool) error {
+	var parts [][]byte
+	if loose {
+		parts = bytes.Fields(line)
+		if len(parts) > 3 && bytes.HasPrefix(bytes.ToUpper(parts[0]), []byte("SIP/")) {
+			// Phrase of status line keeps its spaces
+			i := bytes.Index(line, parts[2])
+			parts = append(parts[:2], bytes.TrimSpace(line[i:]))
+		}
+	} else {
+		parts = bytes.SplitN(line, []byte(" "), 3)
+	}
+	if len(parts) < 2 {
+		return fmt.Errorf("%w: %q", ErrInvalidStartLine, line)
+	}
+	msg.VersionMajor, msg.VersionMinor = 2, 0
+
+	isVersion := func(b []byte) bool {
+		if loose {
+			return bytes.EqualFold(b, []byte("SIP/2.0"))
+		}
+		return bytes.Equal(b, []byte("SIP/2.0"))
+	}
+
+	if bytes.HasPrefix(bytes.ToUpper(parts[0]), []byte("SIP/")) {
+		if !isVersion(parts[0]) {
+			return fmt.Errorf("%w: unsupported version %q", ErrInvalidStartLine, parts[0])
+		}
+		status, err := strconv.Atoi(string(parts[1]))
+		if err != nil || status < 100 || status > 699 {
+			return fmt.Errorf("%w: invalid status %q", ErrInvalidStartLine, parts[1])
+		}
+		msg.Status = status
+		if len(parts) == 3 {
+			msg.Phrase = string(parts[2])
+		}
+		return nil
+	}
+
+	if len(parts) != 3 || !isVersion(parts[2]) {
+		return fmt.Errorf("%w: %q", ErrInvalidStartLine, line)
+	}
+	msg.Method = string(parts[0])
+	u, err := sip.ParseURI(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: invalid Request-URI %q err=%w", ErrInvalidStartLine, parts[1], err)
+	}
+	msg.Request = u
+	return nil
+}
+
+// addHeader sets header of message. Eager headers go through Message.AddHeader,
+// others are prepended as extension headers, which gosip writes from the last one.
+func (st *nativeState) addHeader(name []byte, value []byte, offset int) error {
+	var buf [32]byte
+	lower := lowerName(buf[:0], name)
+	if len(lower) == 1 {
+		lower = []byte(message.CanonicalHeader(string(lower)))
+	}
+	msg := st.m.Msg
+
+	switch string(lower) {
+	case "via":
+		vias, err := parseVias(value)
+		if err != nil {
+			return err
+		}
+		if msg.Via == nil {
+			msg.Via = vias
+		} else {
+			msg.Via.Last().Next = vias
+		}
+		return nil
+	case "content-length":
+		n, err := strconv.Atoi(string(value))
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: Content-Length %q", ErrInvalidHeader, value)
+		}
+		st.contentLength = n
+		st.contentLengthOffset = offset
+		return nil
+	case "content-type":
+		st.contentType = string(value)
+		return nil
+	case "contact":
+		if bytes.Equal(value, []byte("*")) {
+			// Wildcard of REGISTER is no address, it is kept as extension header
+			msg.XHeader = &sip.XHeader{Name: "Contact", Value: value, Next: msg.XHeader}
+			return nil
+		}
+	}
+
+	if !eagerHeaders[string(lower)] {
+		msg.XHeader = &sip.XHeader{Name: string(name), Value: value, Next: msg.XHeader}
+		return nil
+	}
+	if err := st.m.AddHeader(string(name), string(value)); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+	}
+	return nil
+}
+
+// lowerName appends ASCII lower case name to dst
+func lowerName(dst []byte, name []byte) []byte {
+	for _, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// parseVias parses comma separated Via values (RFC 3261 20.42)
+func parseVias(value []byte) (*sip.Via, error) {
+	var head *sip.Via
+	tail := &head
+	for s, more := string(value), true; more; {
+		var part string
+		part, s, more = strings.Cut(s, ",")
+		via, err := parseVia(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		*tail = via
+		tail = &via.Next
+	}
+	return head, nil
+}
+
+func parseVia(s string) (*sip.Via, error) {
+	protocol, rest, ok1 := strings.Cut(s, "/")
+	version, rest, ok2 := strings.Cut(rest, "/")
+	rest = strings.TrimLeft(rest, " \t")
+	i := strings.IndexAny(rest, " \t")
+	if !ok1 || !ok2 || i <= 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidVia, s)
+	}
+	via := &sip.Via{
+		Protocol:  strings.TrimSpace(protocol),
+		Version:   strings.TrimSpace(version),
+		Transport: strings.TrimSpace(rest[:i]),
+	}
+
+	sentBy, params, _ := strings.Cut(strings.TrimSpace(rest[i:]), ";")
+	host, port, err := splitSentBy(strings.TrimSpace(sentBy))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q err=%w", ErrInvalidVia, s, err)
+	}
+	via.Host, via.Port = host, port
+
+	// gosip writes params from the last one in list
+	for more := params != ""; more; {
+		var p string
+		p, params, more = strings.Cut(params, ";")
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(p, "=")
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		via.Param = &sip.Param{Name: strings.TrimSpace(name), Value: value, Next: via.Param}
+	}
+	return via, nil
+}
+
+// splitSentBy splits host and port of Via. Missing port is 0 like in gosip,
+// IPv6 reference loses brackets.
+func splitSentBy(s string) (string, uint16, error) {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return "", 0, errors.New("unterminated IPv6 reference")
+		}
+		host, port = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+	} else if i := strings.IndexByte(s, ':'); i >= 0 {
+		host, port = s[:i], s[i+1:]
+	}
+	if host == "" {
+		return "", 0, errors.New("missing host")
+	}
+	if port == "" {
+		return host, 0, nil
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, uint16(n), nil
+}
+
+// cutLine returns first line of data without CRLF and the rest
+func cutLine(data []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return bytes.TrimSuffix(data, []byte("\r")), nil
+	}
+	return bytes.TrimSuffix(data[:i], []byte("\r")), data[i+1:]
+}
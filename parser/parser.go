@@ -1,34 +1,166 @@
 package parser
 
 import (
+	"bytes"
 	"errors"
+	"strconv"
 
 	"github.com/jart/gosip/sip"
 
 	"github.com/shend/simplesip/message"
 )
 
-// Parser is SIP parser implementation
-type Parser struct {
+// Parser parses SIP message received by transport. Message can reference data,
+// so transport must not reuse data afterwards.
+type Parser interface {
+	ParseMsg(data []byte) (*message.Message, error)
 }
 
-func (p *Parser) ParseMsg(data []byte) (msg *message.Message, err error) {
-	msg0, err := sip.ParseMsg(data)
+// GosipParser parses whole message with gosip, SDP body included
+type GosipParser struct {
+	// Lenient parses messages gosip rejects again with lenient NativeParser,
+	// which accepts common quirks of vendors. It can be changed before serving.
+	Lenient bool
+}
+
+// ParseMsg parses message. Error is *ParseError.
+func (p *GosipParser) ParseMsg(data []byte) (msg *message.Message, err error) {
+	h := scanHeaders(data)
+	if h.contentLength > len(data)-h.body {
+		if p.Lenient {
+			return (&NativeParser{Lenient: true}).ParseMsg(data)
+		}
+		return nil, newParseError(data, "Content-Length", h.contentLengthOffset, ErrTruncatedBody)
+	}
+	// Datagram may carry bytes past body, they are discarded (RFC 3261 18.3)
+	cut := data
+	if h.contentLength >= 0 {
+		cut = data[:h.body+h.contentLength]
+	}
+	// gosip does not understand wildcard Contact of REGISTER
+	if h.wildcard >= 0 {
+		cut = append(append(make([]byte, 0, len(cut)), cut[:h.wildcard]...), cut[h.wildcardEnd:]...)
+	}
+
+	msg0, err := sip.ParseMsg(cut)
 	if err != nil {
-		return nil, err
+		if p.Lenient {
+			return (&NativeParser{Lenient: true}).ParseMsg(data)
+		}
+		return nil, gosipError(data, h, err)
 	}
 	if msg0.Via == nil {
-		return nil, errors.New("invalid SIP: \"Via\" header field is mandatory")
+		return nil, newParseError(data, "Via", -1, ErrMissingVia)
+	}
+	if h.compactLength {
+		// gosip grammar takes compact Content-Length "l" for Min-Expires too
+		msg0.MinExpires = h.minExpires
+	}
+	if h.wildcard >= 0 {
+		msg0.XHeader = &sip.XHeader{Name: "Contact", Value: []byte("*"), Next: msg0.XHeader}
+	}
+	// gosip reads missing Expires and Max-Forwards as 0, they are kept as extension headers
+	msg0.Expires, msg0.MaxForwards = 0, 0
+	if h.maxForwards != nil {
+		msg0.XHeader = &sip.XHeader{Name: "Max-Forwards", Value: h.maxForwards, Next: msg0.XHeader}
+	}
+	if h.expires != nil {
+		msg0.XHeader = &sip.XHeader{Name: "Expires", Value: h.expires, Next: msg0.XHeader}
 	}
 	msg1 := &message.Message{
-		Msg:       msg0.Copy(),
+		Msg:       msg0,
 		Transport: msg0.Via.Transport,
 	}
 	return msg1, nil
 }
 
-// NewParser creates a new Parser.
-func NewParser() Parser {
-	p := Parser{}
-	return p
+// gosipError converts error of gosip parsing data without wildcard Contact
+// line to parse error of data
+func gosipError(data []byte, h headerScan, err error) *ParseError {
+	var perr sip.MsgParseError
+	var ierr sip.MsgIncompleteError
+	switch {
+	case errors.As(err, &perr):
+		offset := perr.Offset
+		if h.wildcard >= 0 && offset >= h.wildcard {
+			offset += h.wildcardEnd - h.wildcard
+		}
+		header, offset := headerAt(data, offset)
+		return newParseError(data, header, offset, err)
+	case errors.As(err, &ierr):
+		return newParseError(data, "", len(data), err)
+	}
+	return newParseError(data, "", -1, err)
+}
+
+// headerScan is what gosip workarounds need of header block, read in single pass
+type headerScan struct {
+	// body is offset of body
+	body int
+	// contentLength is -1 when Content-Length is missing or invalid
+	contentLength       int
+	contentLengthOffset int
+	compactLength       bool
+	// wildcard and wildcardEnd are offsets of "Contact: *" line, -1 if there is none
+	wildcard    int
+	wildcardEnd int
+	// maxForwards and expires are values of last header, nil if it is missing
+	maxForwards []byte
+	expires     []byte
+	minExpires  int
+}
+
+func scanHeaders(data []byte) headerScan {
+	h := headerScan{contentLength: -1, wildcard: -1}
+	end := headerEnd(data)
+	h.body = min(end+2, len(data))
+
+	for start := bytes.IndexByte(data[:end], '\n') + 1; start > 0 && start < end; {
+		next := end
+		if i := bytes.IndexByte(data[start:end], '\n'); i >= 0 {
+			next = start + i + 1
+		}
+		name, value, ok := headerValue(bytes.TrimRight(data[start:next], "\r\n"))
+		switch {
+		case !ok:
+		case bytes.EqualFold(name, []byte("Content-Length")) || bytes.EqualFold(name, []byte("l")):
+			h.compactLength = h.compactLength || len(name) == 1
+			h.contentLength, h.contentLengthOffset = -1, start
+			if n, err := strconv.Atoi(string(value)); err == nil && n >= 0 {
+				h.contentLength = n
+			}
+		case bytes.EqualFold(name, []byte("Max-Forwards")):
+			h.maxForwards = value
+		case bytes.EqualFold(name, []byte("Expires")):
+			h.expires = value
+		case bytes.EqualFold(name, []byte("Min-Expires")):
+			h.minExpires, _ = strconv.Atoi(string(value))
+		case bytes.Equal(value, []byte("*")) && (bytes.EqualFold(name, []byte("Contact")) || bytes.EqualFold(name, []byte("m"))):
+			h.wildcard, h.wildcardEnd = start, next
+		}
+		start = next
+	}
+	return h
+}
+
+// NewParser creates default parser, which is gosip parser
+func NewParser() *GosipParser {
+	return &GosipParser{}
+}
+
+// headerEnd returns offset of empty line separating headers from body
+func headerEnd(data []byte) int {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return i + 2
+	}
+	return len(data)
+}
+
+// headerValue returns name and value of header line
+func headerValue(line []byte) (name []byte, value []byte, ok bool) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return nil, nil, false
+	}
+	return bytes.TrimSpace(line[:i]), bytes.TrimSpace(line[i+1:]), true
 }
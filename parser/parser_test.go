@@ -0,0 +1,360 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// crlf turns LF line endings of fixture into CRLF
+func crlf(s string) []byte {
+	return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+}
+
+// inviteCapture is INVITE of softphone behind NAT, as captured on the wire
+var inviteCapture = crlf(`INVITE sip:1001@10.0.0.5:5060 SIP/2.0
+Via: SIP/2.0/UDP 192.168.1.23:5062;branch=z9hG4bK-524287-1---77ba3b4f1a3b5d7c;rport
+Max-Forwards: 70
+Contact: <sip:1002@192.168.1.23:5062;transport=UDP>
+To: <sip:1001@10.0.0.5>
+From: "Alice" <sip:1002@10.0.0.5>;tag=0d6f2b5a
+Call-ID: YjM4ZTY2ZmI3MjY1NzZiZjQ5YjY4ZDg1NzFlMzY1MDY
+CSeq: 1 INVITE
+Allow: INVITE, ACK, CANCEL, BYE, NOTIFY, REFER, MESSAGE, OPTIONS, INFO, SUBSCRIBE
+Content-Type: application/sdp
+Supported: replaces, norefersub, extended-refer, timer, outbound, path, X-cisco-serviceuri
+User-Agent: Z 5.6.1 v2.10.19.9
+Allow-Events: presence, kpml, talk
+Content-Length: 178
+
+v=0
+o=Z 0 1234 IN IP4 192.168.1.23
+s=Z
+c=IN IP4 192.168.1.23
+t=0 0
+m=audio 8000 RTP/AVP 0 8 101
+a=rtpmap:101 telephone-event/8000
+a=fmtp:101 0-16
+a=sendrecv
+a=rtcp-mux
+`)
+
+// registerCapture is REGISTER of desk phone answering digest challenge
+var registerCapture = crlf(`REGISTER sip:example.com SIP/2.0
+Via: SIP/2.0/TCP 10.1.2.3:5060;branch=z9hG4bK3a8b2c1d;rport
+Via: SIP/2.0/TCP 10.1.2.1:5060;branch=z9hG4bK77ef01aa;received=172.16.0.1
+From: "Bob" <sip:bob@example.com>;tag=1928301774
+To: <sip:bob@example.com>
+Call-ID: a84b4c76e66710@pc33.example.com
+CSeq: 2 REGISTER
+Contact: <sip:bob@10.1.2.3:5060;transport=tcp>;expires=3600, <sip:bob@10.1.2.3:5061>;q=0.5
+Authorization: Digest username="bob", realm="example.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="sip:example.com", response="6629fae49393a05397450978507c4ef1", algorithm=MD5, cnonce="0a4f113b", qop=auth, nc=00000001
+Max-Forwards: 69
+Expires: 3600
+User-Agent: Yealink SIP-T46S 66.86.0.15
+Content-Length: 0
+
+`)
+
+// compactCapture is MESSAGE using compact header names (RFC 3261 7.3.3)
+var compactCapture = crlf(`MESSAGE sip:carol@example.com SIP/2.0
+v: SIP/2.0/UDP 10.1.2.3:5060;branch=z9hG4bK776sgdkse
+f: <sip:bob@example.com>;tag=49583
+t: <sip:carol@example.com>
+i: asd88asd77a@1.2.3.4
+CSeq: 1 MESSAGE
+m: <sip:bob@10.1.2.3>
+s: greeting
+k: 100rel
+c: text/plain
+l: 5
+
+hello`)
+
+// fieldsOf returns fields of parsed message both parsers must agree on
+func fieldsOf(m *message.Message) map[string]string {
+	msg := m.Msg
+	fields := map[string]string{
+		"transport":    m.Transport,
+		"method":       msg.Method,
+		"phrase":       msg.Phrase,
+		"call-id":      msg.CallID,
+		"cseq":         message.CanonicalHeader(msg.CSeqMethod),
+		"from":         msg.From.String(),
+		"from-tag":     m.GetFromTag(),
+		"to":           msg.To.String(),
+		"to-tag":       m.GetToTag(),
+		"branch":       m.GetBranch(),
+		"contact":      strings.Join(m.Headers("Contact"), ", "),
+		"route":        strings.Join(m.Headers("Route"), ", "),
+		"subject":      m.Header("Subject"),
+		"supported":    strings.Join(m.Supported(), ","),
+		"user-agent":   m.Header("User-Agent"),
+		"allow":        m.Header("Allow"),
+		"content-type": m.Header("Content-Type"),
+	}
+	if msg.Request != nil {
+		fields["request-uri"] = msg.Request.String()
+	}
+	fields["status"] = strconv.Itoa(msg.Status)
+	fields["cseq-number"] = strconv.Itoa(msg.CSeq)
+	if n, ok := m.MaxForwards(); ok {
+		fields["max-forwards"] = strconv.Itoa(n)
+	}
+	if expires, ok := m.Expires(); ok {
+		fields["expires-header"] = strconv.Itoa(expires)
+	}
+	if auth, err := m.Authorization(); err == nil && auth != nil {
+		fields["authorization"] = auth.Scheme + " " + auth.Params["username"] + " " + auth.Params["response"]
+	}
+	for i, via := 0, msg.Via; via != nil; i, via = i+1, via.Next {
+		prefix := "via" + strconv.Itoa(i)
+		fields[prefix] = via.Transport + " " + sentBy(via)
+		if p := via.Param.Get("received"); p != nil {
+			fields[prefix+"-received"] = p.Value
+		}
+		if p := via.Param.Get("rport"); p != nil {
+			fields[prefix+"-rport"] = "present"
+		}
+	}
+	// gosip parses SDP and writes it back normalized, native parser keeps it as text
+	if msg.Payload != nil && msg.Payload.ContentType() != "application/sdp" {
+		fields["body"] = string(msg.Payload.Data())
+	}
+	return fields
+}
+
+func sentBy(via *sip.Via) string {
+	return via.Host + ":" + strconv.Itoa(int(via.Port))
+}
+
+func TestParsersEquivalent(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"INVITE", inviteCapture},
+		{"REGISTER", registerCapture},
+		{"compact headers", compactCapture},
+		{"response", crlf(`SIP/2.0 180 Ringing
+Via: SIP/2.0/UDP 192.168.1.23:5062;branch=z9hG4bK-524287-1---77ba3b4f1a3b5d7c;rport=5062;received=203.0.113.7
+Record-Route: <sip:10.0.0.5;lr>
+To: <sip:1001@10.0.0.5>;tag=as5f1c2e9a
+From: "Alice" <sip:1002@10.0.0.5>;tag=0d6f2b5a
+Call-ID: YjM4ZTY2ZmI3MjY1NzZiZjQ5YjY4ZDg1NzFlMzY1MDY
+CSeq: 1 INVITE
+Contact: <sip:1001@10.0.0.9:5060>
+Content-Length: 0
+
+`)},
+		{"wildcard Contact", crlf(`REGISTER sip:example.com SIP/2.0
+Via: SIP/2.0/UDP 10.1.2.3:5060;branch=z9hG4bK3a8b2c1d
+From: <sip:bob@example.com>;tag=1928301774
+To: <sip:bob@example.com>
+Call-ID: a84b4c76e66710@pc33.example.com
+CSeq: 3 REGISTER
+Contact: *
+Expires: 0
+Content-Length: 0
+
+`)},
+		// Datagram may carry bytes past body (RFC 3261 18.3)
+		{"bytes past body", append(bytes.Clone(compactCapture), "\r\n\r\njunk"...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gm, err := NewParser().ParseMsg(tt.data)
+			if err != nil {
+				t.Fatalf("gosip parser failed: %v", err)
+			}
+			nm, err := NewNativeParser().ParseMsg(tt.data)
+			if err != nil {
+				t.Fatalf("native parser failed: %v", err)
+			}
+
+			want, got := fieldsOf(gm), fieldsOf(nm)
+			for name, value := range want {
+				if got[name] != value {
+					t.Errorf("%s: native %q, gosip %q", name, got[name], value)
+				}
+			}
+			for name, value := range got {
+				if _, ok := want[name]; !ok {
+					t.Errorf("%s: native %q, gosip has none", name, value)
+				}
+			}
+		})
+	}
+}
+
+func TestParsersCompactHeaders(t *testing.T) {
+	for _, p := range []Parser{NewParser(), NewNativeParser()} {
+		m, err := p.ParseMsg(compactCapture)
+		if err != nil {
+			t.Fatalf("%T failed: %v", p, err)
+		}
+		if m.GetBranch() != "z9hG4bK776sgdkse" {
+			t.Errorf("%T: branch %q", p, m.GetBranch())
+		}
+		if m.GetFromTag() != "49583" || m.GetCallID() != "asd88asd77a@1.2.3.4" {
+			t.Errorf("%T: From tag %q, Call-ID %q", p, m.GetFromTag(), m.GetCallID())
+		}
+		// Compact and full names read the same header
+		for _, names := range [][2]string{{"s", "Subject"}, {"k", "Supported"}, {"m", "Contact"}, {"t", "To"}} {
+			if m.Header(names[0]) == "" || m.Header(names[0]) != m.Header(names[1]) {
+				t.Errorf("%T: %s %q, %s %q", p, names[0], m.Header(names[0]), names[1], m.Header(names[1]))
+			}
+		}
+		if m.Msg.Payload == nil || string(m.Msg.Payload.Data()) != "hello" {
+			t.Errorf("%T: body %v", p, m.Msg.Payload)
+		}
+	}
+}
+
+func TestParseErrorsEquivalent(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		header string
+		// at is text of line where parsing fails, empty when header is missing
+		at  string
+		err error
+		// recovered tells if request to answer with 400 is recovered
+		recovered bool
+	}{
+		{
+			name: "missing Via",
+			data: crlf(`OPTIONS sip:example.com SIP/2.0
+From: <sip:a@example.com>;tag=1
+To: <sip:example.com>
+Call-ID: 1@a
+CSeq: 1 OPTIONS
+Content-Length: 0
+
+`),
+			header: "Via",
+			err:    ErrMissingVia,
+		},
+		{
+			name: "truncated body",
+			data: crlf(`MESSAGE sip:carol@example.com SIP/2.0
+Via: SIP/2.0/UDP 10.1.2.3:5060;branch=z9hG4bK776sgdkse
+From: <sip:bob@example.com>;tag=49583
+To: <sip:carol@example.com>
+Call-ID: asd88asd77a@1.2.3.4
+CSeq: 1 MESSAGE
+Content-Type: text/plain
+Content-Length: 50
+
+hello`),
+			header:    "Content-Length",
+			at:        "Content-Length: 50",
+			err:       ErrTruncatedBody,
+			recovered: true,
+		},
+		{
+			name: "invalid CSeq after wildcard Contact",
+			data: crlf(`REGISTER sip:example.com SIP/2.0
+Via: SIP/2.0/UDP 10.1.2.3:5060;branch=z9hG4bK3a8b2c1d
+From: <sip:bob@example.com>;tag=1928301774
+To: <sip:bob@example.com>
+Call-ID: a84b4c76e66710@pc33.example.com
+Contact: *
+CSeq: abc REGISTER
+Content-Length: 0
+
+`),
+			header: "CSeq",
+			at:     "CSeq: abc",
+		},
+		{
+			name: "invalid CSeq",
+			data: crlf(`INVITE sip:1001@10.0.0.5 SIP/2.0
+Via: SIP/2.0/UDP 192.168.1.23:5062;branch=z9hG4bK-524287-1
+From: <sip:1002@10.0.0.5>;tag=0d6f2b5a
+To: <sip:1001@10.0.0.5>
+Call-ID: YjM4ZTY2ZmI3MjY1
+CSeq: abc INVITE
+Content-Length: 0
+
+`),
+			header: "CSeq",
+			at:     "CSeq: abc",
+		},
+		{
+			name: "invalid From",
+			data: crlf(`INVITE sip:1001@10.0.0.5 SIP/2.0
+Via: SIP/2.0/UDP 192.168.1.23:5062;branch=z9hG4bK-524287-1
+From: <sip:1002@10.0.0.5;tag=0d6f2b5a
+To: <sip:1001@10.0.0.5>
+Call-ID: YjM4ZTY2ZmI3MjY1
+CSeq: 1 INVITE
+Content-Length: 0
+
+`),
+			header: "From",
+			at:     "From:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset := -1
+			if tt.at != "" {
+				offset = bytes.Index(tt.data, []byte(tt.at))
+			}
+			for _, p := range []Parser{NewParser(), NewNativeParser()} {
+				_, err := p.ParseMsg(tt.data)
+				var perr *ParseError
+				if !errors.As(err, &perr) {
+					t.Fatalf("%T: error %v is not *ParseError", p, err)
+				}
+				if perr.Header != tt.header || perr.Offset != offset {
+					t.Errorf("%T: header %q offset %d, want %q at %d", p, perr.Header, perr.Offset, tt.header, offset)
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Errorf("%T: error %v, want %v", p, err, tt.err)
+				}
+				if (perr.Request != nil) != tt.recovered {
+					t.Errorf("%T: recovered request %v, want %v", p, perr.Request != nil, tt.recovered)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkParser(b *testing.B, p Parser) {
+	captures := []struct {
+		name string
+		data []byte
+	}{
+		{"INVITE", inviteCapture},
+		{"REGISTER", registerCapture},
+	}
+	for _, c := range captures {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(c.data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := p.ParseMsg(c.data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGosipParser(b *testing.B) {
+	benchmarkParser(b, NewParser())
+}
+
+func BenchmarkNativeParser(b *testing.B) {
+	benchmarkParser(b, NewNativeParser())
+}
@@ -0,0 +1,210 @@
+package simplesip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	jartsip "github.com/jart/gosip/sip"
+	jartutil "github.com/jart/gosip/util"
+
+	"github.com/shend/simplesip/dialog"
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/transaction"
+	"github.com/shend/simplesip/transport"
+)
+
+var (
+	ErrNoRoute = errors.New("no route for request")
+)
+
+// statelessBranchPrefix marks Via added by stateless proxy, so responses can be recognized
+const statelessBranchPrefix = transaction.MagicCookie + "sl"
+
+// Router picks target of request forwarded by proxy. ErrNoRoute is answered with 404.
+type Router func(req *message.Message) (*jartsip.URI, error)
+
+// SetRouter turns on stateless proxy mode (RFC 3261 16.11). Requests without
+// handler are forwarded to target returned by router and their responses are
+// forwarded back. Proxy is record-routed, requests within dialog and requests
+// with Route are forwarded without asking router.
+func (srv *Server) SetRouter(router Router) {
+	srv.router = router
+}
+
+// isLocal checks if request is handled by server itself. ACK and CANCEL belong to
+// INVITE, so they are local when INVITE is.
+func (srv *Server) isLocal(req *message.Message) bool {
+	if srv.routes.Match(req) != nil {
+		return true
+	}
+	method := message.RequestMethod(req.Msg.Method)
+	if method == message.ACK || method == message.CANCEL {
+		invite := *req
+		invite.Msg = &jartsip.Msg{}
+		*invite.Msg = *req.Msg
+		invite.Msg.Method = string(message.INVITE)
+		return srv.routes.Match(&invite) != nil
+	}
+	return false
+}
+
+// proxyRequest forwards request statelessly to target of router
+func (srv *Server) proxyRequest(req *message.Message) {
+	msg := req.Msg
+	method := message.RequestMethod(msg.Method)
+
+	if n, ok := req.MaxForwards(); ok && n == 0 {
+		srv.proxyReply(req, 483, "Too Many Hops")
+		return
+	}
+
+	// Requests within dialog and preloaded with Route follow Route or Request-URI
+	target := msg.Request
+	if !dialog.IsInDialog(req) && msg.Route == nil {
+		var err error
+		target, err = srv.router(req)
+		if err != nil || target == nil {
+			if errors.Is(err, ErrNoRoute) || target == nil {
+				srv.proxyReply(req, 404, "Not Found")
+			} else {
+				slog.Error("route request failed", "err", err)
+				srv.proxyReply(req, 500, "Server Internal Error")
+			}
+			return
+		}
+	}
+
+	fwd := req.Clone()
+	fwd.Msg.Request = target.Copy()
+	fwd.DecrementMaxForwards()
+	if err := srv.RecordRoute(&fwd); err != nil {
+		slog.Error("add Record-Route failed", "err", err)
+	}
+
+	if err := srv.pushVia(&fwd, statelessBranch(req)); err != nil {
+		slog.Error("resolve next hop failed", "err", err, "target", target.String())
+		srv.proxyReply(req, 500, "Server Internal Error")
+		return
+	}
+
+	if err := srv.tp.WriteMsgTo(&fwd, fwd.Destination, fwd.Transport); err != nil {
+		slog.Error("forward request failed", "err", err, "method", method, "dst", fwd.Destination)
+		if method != message.ACK {
+			srv.proxyReply(req, 503, "Service Unavailable")
+		}
+	}
+}
+
+// Forward sends request forwarded by stateful proxy through client transaction to
+// top Route or Request-URI. Own Via with new branch is pushed on top of request.
+// ACK for 2xx is sent without transaction, so nil transaction is returned for it.
+func (srv *Server) Forward(req *message.Message, handler transaction.ResponseHandler) (*transaction.ClientTx, error) {
+	if err := srv.pushVia(req, jartutil.GenerateBranch()); err != nil {
+		return nil, err
+	}
+	if req.Msg.Method == string(message.ACK) {
+		return nil, srv.tp.WriteMsg(req)
+	}
+	return srv.tx.Request(req, handler)
+}
+
+// pushVia resolves next hop of forwarded request and pushes own Via with branch
+func (srv *Server) pushVia(req *message.Message, branch string) error {
+	strictRoute(req.Msg)
+
+	network := requestTransport(req.Msg)
+	dst, err := requestDestination(req.Msg, network)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := srv.tp.LocalAddr(network, dst)
+	if err != nil {
+		return fmt.Errorf("resolve local address failed err=%w", err)
+	}
+	req.Msg.Via = &jartsip.Via{
+		Transport: network,
+		Host:      host,
+		Port:      uint16(port),
+		Param:     &jartsip.Param{Name: "branch", Value: branch},
+		Next:      req.Msg.Via,
+	}
+
+	req.Transport = network
+	req.Source = ""
+	req.Destination = dst
+	return nil
+}
+
+// proxyResponse forwards response to previous hop when top Via was added by stateless proxy.
+// It returns false when response is not ours to forward.
+func (srv *Server) proxyResponse(res *message.Message) bool {
+	via := res.Msg.Via
+	if via == nil || !strings.HasPrefix(res.GetBranch(), statelessBranchPrefix) {
+		return false
+	}
+	if int(via.Port) != srv.tp.ListenPort(via.Transport) {
+		return false
+	}
+
+	next := via.Next
+	if next == nil {
+		// Response was meant for us
+		slog.Debug("drop response of request sent by stateless proxy itself")
+		return true
+	}
+
+	fwd := res.Clone()
+	fwd.Msg.Via = next
+	fwd.Transport = next.Transport
+	fwd.Source = ""
+	fwd.Destination = transport.ResponseAddr(next)
+	if err := srv.tp.WriteMsgTo(&fwd, fwd.Destination, fwd.Transport); err != nil {
+		slog.Error("forward response failed", "err", err, "dst", fwd.Destination)
+	}
+	return true
+}
+
+// proxyReply answers request statelessly
+func (srv *Server) proxyReply(req *message.Message, status int, phrase string) {
+	if req.Msg.Method == string(message.ACK) {
+		return
+	}
+	res := message.NewResponse(req, status, phrase)
+	if err := srv.tp.WriteMsg(res); err != nil {
+		slog.Error("respond to proxied request failed", "err", err, "status", status)
+	}
+}
+
+// statelessBranch derives branch from request, so retransmissions get the same
+// branch and CANCEL and ACK of non-2xx get the branch of INVITE (RFC 3261 16.11).
+// RFC 3261 branch of previous hop is hashed. Otherwise To tag is left out, as
+// ACK has tag its INVITE did not have.
+func statelessBranch(req *message.Message) string {
+	msg := req.Msg
+	parts := []string{
+		msg.Via.Host,
+		strconv.Itoa(int(msg.Via.Port)),
+		req.GetBranch(),
+	}
+	if !strings.HasPrefix(req.GetBranch(), transaction.MagicCookie) {
+		parts = append(parts,
+			req.GetFromTag(),
+			msg.CallID,
+			msg.Request.String(),
+			strconv.Itoa(msg.CSeq),
+		)
+	}
+
+	h := sha256.New()
+	for _, s := range parts {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return statelessBranchPrefix + hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/transaction"
+)
+
+// fork is request forwarded to several branches with its collected responses
+type fork struct {
+	p   *Proxy
+	key string
+	req *message.Message
+
+	mu       sync.Mutex
+	invite   bool
+	groups   [][]Target
+	next     int
+	branches []*branch
+	// responses are final non 2xx responses of branches, without own Via
+	responses []*message.Message
+	// final is set when final response was sent upstream
+	final bool
+	// stopped forbids new branches after 2xx, 6xx or CANCEL
+	stopped bool
+}
+
+// branch is request forwarded to one target
+type branch struct {
+	req *message.Message
+	tx  *transaction.ClientTx
+
+	provisional bool
+	done        bool
+	// cancelPending sends CANCEL once provisional response arrives (RFC 3261 9.1)
+	cancelPending bool
+	timer         *time.Timer
+}
+
+func newFork(p *Proxy, req *message.Message, groups [][]Target) *fork {
+	return &fork{
+		p:      p,
+		key:    forkKey(req),
+		req:    req,
+		invite: req.Msg.Method == string(message.INVITE),
+		groups: groups,
+	}
+}
+
+func (f *fork) start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.startGroup()
+}
+
+// startGroup forwards request to next group of targets. Must be called with lock held.
+func (f *fork) startGroup() {
+	for !f.stopped && f.next < len(f.groups) {
+		targets := f.groups[f.next]
+		f.next++
+
+		started := false
+		for _, t := range targets {
+			if f.startBranch(t) {
+				started = true
+			}
+		}
+		if started {
+			return
+		}
+	}
+	f.sendBest()
+}
+
+// startBranch forwards request to target. Failure is recorded as 503 of branch.
+func (f *fork) startBranch(t Target) bool {
+	fwd := f.req.Clone()
+	fwd.Msg.Request = t.URI.Copy()
+	fwd.DecrementMaxForwards()
+	if f.p.RecordRoute {
+		if err := f.p.srv.RecordRoute(&fwd); err != nil {
+			slog.Error("add Record-Route failed", "err", err)
+		}
+	}
+
+	b := &branch{req: &fwd}
+	tx, err := f.p.srv.Forward(b.req, func(res *message.Message, err error) {
+		f.onResponse(b, res, err)
+	})
+	if err != nil {
+		slog.Error("forward request failed", "err", err, "target", t.URI.String())
+		f.responses = append(f.responses, message.NewResponse(f.req, 503, "Service Unavailable"))
+		return false
+	}
+
+	b.tx = tx
+	b.timer = time.AfterFunc(f.p.BranchTimeout, func() {
+		f.timeout(b)
+	})
+	f.branches = append(f.branches, b)
+	return true
+}
+
+// onResponse handles response of branch (RFC 3261 16.7)
+func (f *fork) onResponse(b *branch, res *message.Message, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err != nil {
+		// Timeout and transport failure are treated as 408 (RFC 3261 16.7 step 10)
+		slog.Debug("branch failed", "err", err, "target", b.req.Msg.Request.String())
+		f.finishBranch(b, message.NewResponse(f.req, 408, "Request Timeout"))
+		return
+	}
+
+	status := res.Msg.Status
+	switch {
+	case status < 200:
+		b.provisional = true
+		if b.cancelPending {
+			f.cancelBranch(b)
+		}
+		if status > 100 && !f.final && !b.done {
+			f.forward(res)
+		}
+	case status < 300:
+		// Every 2xx is forwarded, even after other branch answered (RFC 3261 16.7 step 5)
+		f.forward(res)
+		f.final = true
+		f.stopped = true
+		f.cancelOthers(b)
+		f.finishBranch(b, nil)
+	default:
+		if status >= 600 {
+			f.stopped = true
+			f.cancelOthers(b)
+		}
+		f.finishBranch(b, upstream(res))
+	}
+}
+
+// timeout cancels branch with provisional response, other branches are treated as 408
+func (f *fork) timeout(b *branch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if b.done {
+		return
+	}
+	if f.invite && b.provisional {
+		f.cancelBranch(b)
+		return
+	}
+	b.cancelPending = f.invite
+	f.finishBranch(b, message.NewResponse(f.req, 408, "Request Timeout"))
+}
+
+// finishBranch records final response of branch and continues with next
+// group or sends best response when all branches are done
+func (f *fork) finishBranch(b *branch, res *message.Message) {
+	if b.done {
+		return
+	}
+	b.done = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if res != nil {
+		f.responses = append(f.responses, res)
+	}
+
+	for _, b := range f.branches {
+		if !b.done {
+			return
+		}
+	}
+	if f.final {
+		f.p.removeFork(f)
+		return
+	}
+	f.startGroup()
+}
+
+// cancel stops forking after CANCEL of upstream request
+func (f *fork) cancel() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Transaction layer answered upstream INVITE with 487
+	f.final = true
+	f.stopped = true
+	f.cancelOthers(nil)
+}
+
+// cancelOthers cancels pending branches except b
+func (f *fork) cancelOthers(b *branch) {
+	for _, other := range f.branches {
+		if other != b && !other.done {
+			f.cancelBranch(other)
+		}
+	}
+}
+
+// cancelBranch sends CANCEL of INVITE branch. It waits for provisional response
+// when none was received yet.
+func (f *fork) cancelBranch(b *branch) {
+	if !f.invite {
+		return
+	}
+	if !b.provisional {
+		b.cancelPending = true
+		return
+	}
+	b.cancelPending = false
+
+	cancel := transaction.NewCancel(b.req)
+	if _, err := f.p.srv.TransactionLayer().Request(cancel, nil); err != nil {
+		slog.Error("send CANCEL failed", "err", err, "target", b.req.Msg.Request.String())
+	}
+}
+
+// sendBest sends best final response upstream (RFC 3261 16.7 step 6)
+func (f *fork) sendBest() {
+	if f.final {
+		return
+	}
+	f.final = true
+	f.p.removeFork(f)
+
+	best := bestResponse(f.responses)
+	if best == nil {
+		f.respond(message.NewResponse(f.req, 408, "Request Timeout"))
+		return
+	}
+
+	res := best.Clone()
+	switch res.Msg.Status {
+	case 503:
+		// 503 would make upstream stop using this proxy
+		res.Msg.Status, res.Msg.Phrase = 500, "Server Internal Error"
+	case 401, 407:
+		mergeChallenges(&res, f.responses)
+	}
+	f.respond(&res)
+}
+
+// forward sends response of branch upstream
+func (f *fork) forward(res *message.Message) {
+	f.respond(upstream(res))
+}
+
+// respond sends response through upstream server transaction
+func (f *fork) respond(res *message.Message) {
+	res.Transport = f.req.Transport
+	res.Source = f.req.Destination
+	res.Destination = f.req.Source
+	if err := f.p.srv.WriteResponse(res); err != nil {
+		slog.Error("forward response failed", "err", err, "status", res.Msg.Status)
+	}
+}
+
+// upstream returns copy of response of branch without own Via
+func upstream(res *message.Message) *message.Message {
+	fwd := res.Clone()
+	if fwd.Msg.Via != nil {
+		fwd.Msg.Via = fwd.Msg.Via.Next
+	}
+	return &fwd
+}
+
+// bestResponse picks response of branches to send upstream (RFC 3261 16.7 step 6).
+// Earlier response wins between equally ranked ones.
+func bestResponse(responses []*message.Message) *message.Message {
+	var best *message.Message
+	for _, res := range responses {
+		if best == nil || responseRank(res.Msg.Status) < responseRank(best.Msg.Status) {
+			best = res
+		}
+	}
+	return best
+}
+
+// responseRank orders final responses, lower is better: 6xx first, then lowest
+// class. Within 4xx, responses client can recover from by resubmitting
+// request (401, 407, 415, 420, 484) go before other 4xx.
+func responseRank(status int) int {
+	switch status {
+	case 401, 407, 415, 420, 484:
+		return 40
+	}
+	if status >= 600 {
+		return 0
+	}
+	return status/100*10 + 1
+}
+
+// mergeChallenges collects challenges of all 401 and 407 responses into res (RFC 3261 16.7 step 7).
+// Challenges other than first one are extension headers as gosip keeps single value of header.
+func mergeChallenges(res *message.Message, responses []*message.Message) {
+	var www, proxy []string
+	for _, r := range responses {
+		if r.Msg.Status != 401 && r.Msg.Status != 407 {
+			continue
+		}
+		www = appendChallenges(www, r.Msg.WWWAuthenticate, r.Msg.XHeader, "WWW-Authenticate")
+		proxy = appendChallenges(proxy, r.Msg.ProxyAuthenticate, r.Msg.XHeader, "Proxy-Authenticate")
+	}
+
+	// Extra challenges of res are among collected ones, other extension headers are kept
+	var kept []*sip.XHeader
+	for h := res.Msg.XHeader; h != nil; h = h.Next {
+		if !isChallenge(h.Name) {
+			kept = append(kept, h)
+		}
+	}
+	var extra *sip.XHeader
+	for i := len(kept) - 1; i >= 0; i-- {
+		extra = &sip.XHeader{Name: kept[i].Name, Value: kept[i].Value, Next: extra}
+	}
+
+	for i := len(proxy) - 1; i > 0; i-- {
+		extra = &sip.XHeader{Name: "Proxy-Authenticate", Value: []byte(proxy[i]), Next: extra}
+	}
+	for i := len(www) - 1; i > 0; i-- {
+		extra = &sip.XHeader{Name: "WWW-Authenticate", Value: []byte(www[i]), Next: extra}
+	}
+	if len(www) > 0 {
+		res.Msg.WWWAuthenticate = www[0]
+	}
+	if len(proxy) > 0 {
+		res.Msg.ProxyAuthenticate = proxy[0]
+	}
+	res.Msg.XHeader = extra
+}
+
+// appendChallenges appends header value and extension headers of name to challenges
+func appendChallenges(challenges []string, value string, xh *sip.XHeader, name string) []string {
+	if value != "" {
+		challenges = append(challenges, value)
+	}
+	for h := xh; h != nil; h = h.Next {
+		if strings.EqualFold(h.Name, name) {
+			challenges = append(challenges, string(h.Value))
+		}
+	}
+	return challenges
+}
+
+func isChallenge(name string) bool {
+	return strings.EqualFold(name, "WWW-Authenticate") || strings.EqualFold(name, "Proxy-Authenticate")
+}
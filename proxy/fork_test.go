@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+func newTestResponse(status int) *message.Message {
+	return &message.Message{Msg: &sip.Msg{Status: status, CSeqMethod: string(message.INVITE)}}
+}
+
+func TestBestResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+	}{
+		{name: "6xx wins", statuses: []int{404, 603, 200}, want: 603},
+		{name: "4xx before 5xx", statuses: []int{503, 486, 500}, want: 486},
+		{name: "3xx before 4xx", statuses: []int{404, 302}, want: 302},
+		{name: "challenge before other 4xx", statuses: []int{404, 408, 407}, want: 407},
+		{name: "recoverable 4xx", statuses: []int{486, 484}, want: 484},
+		{name: "first of equal rank", statuses: []int{486, 404}, want: 486},
+		{name: "none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var responses []*message.Message
+			for _, status := range tt.statuses {
+				responses = append(responses, newTestResponse(status))
+			}
+			got := 0
+			if best := bestResponse(responses); best != nil {
+				got = best.Msg.Status
+			}
+			if got != tt.want {
+				t.Errorf("best response %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeChallenges(t *testing.T) {
+	a := newTestResponse(401)
+	a.Msg.WWWAuthenticate = `Digest realm="a", algorithm=SHA-256`
+	a.Msg.XHeader = &sip.XHeader{
+		Name:  "WWW-Authenticate",
+		Value: []byte(`Digest realm="a", algorithm=MD5`),
+		Next:  &sip.XHeader{Name: "X-Branch", Value: []byte("a")},
+	}
+	b := newTestResponse(407)
+	b.Msg.ProxyAuthenticate = `Digest realm="b"`
+	other := newTestResponse(404)
+	other.Msg.WWWAuthenticate = `Digest realm="c"`
+
+	res := a.Clone()
+	mergeChallenges(&res, []*message.Message{a, b, other})
+
+	if got, want := res.Msg.WWWAuthenticate, a.Msg.WWWAuthenticate; got != want {
+		t.Errorf("WWW-Authenticate %q, want %q", got, want)
+	}
+	if got, want := res.Msg.ProxyAuthenticate, b.Msg.ProxyAuthenticate; got != want {
+		t.Errorf("Proxy-Authenticate %q, want %q", got, want)
+	}
+
+	var got []string
+	for h := res.Msg.XHeader; h != nil; h = h.Next {
+		got = append(got, h.Name+": "+string(h.Value))
+	}
+	want := []string{
+		`WWW-Authenticate: Digest realm="a", algorithm=MD5`,
+		"X-Branch: a",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("extension headers %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("extension header %d %q, want %q", i, got[i], want[i])
+		}
+	}
+}
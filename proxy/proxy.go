@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip"
+	"github.com/shend/simplesip/dialog"
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/registrar"
+)
+
+type ForkMode int
+
+const (
+	// Parallel sends request to all targets at once
+	Parallel ForkMode = iota
+	// Sequential tries targets by decreasing q-value, targets of equal q-value in parallel
+	Sequential
+)
+
+// Target is URI request is forked to
+type Target struct {
+	URI *sip.URI
+	Q   float64
+}
+
+// Locator returns targets of request. simplesip.ErrNoRoute is answered with 404,
+// no targets with 480.
+type Locator func(req *message.Message) ([]Target, error)
+
+// Proxy is stateful forking proxy (RFC 3261 16)
+//
+// Register its handler for all proxied methods, e.g.
+//
+//	p := proxy.New(srv, proxy.RegistrarLocator(reg))
+//	srv.OnInvite(p.Handler())
+//	srv.OnAck(p.Handler())
+//	srv.OnCancel(p.Handler())
+//	srv.OnBye(p.Handler())
+type Proxy struct {
+	srv    *simplesip.Server
+	Locate Locator
+
+	Mode ForkMode
+	// BranchTimeout limits waiting for final response of branch. INVITE branch
+	// with provisional response is canceled, others are treated as 408.
+	BranchTimeout time.Duration
+	// RecordRoute keeps proxy on path of requests within dialog
+	RecordRoute bool
+
+	mu    sync.Mutex
+	forks map[string]*fork
+}
+
+// New creates proxy forwarding requests of srv to targets of locate.
+// Dialog tracking of srv is disabled, as proxy is not part of dialogs, and
+// default request middleware is replaced, as forwarded requests must keep their To.
+func New(srv *simplesip.Server, locate Locator) *Proxy {
+	srv.DisableDialogs()
+	srv.ReplaceDefaultRequestMiddlware(func(req *message.Message) {})
+	return &Proxy{
+		srv:           srv,
+		Locate:        locate,
+		Mode:          Parallel,
+		BranchTimeout: 30 * time.Second,
+		RecordRoute:   true,
+		forks:         make(map[string]*fork),
+	}
+}
+
+// Handler returns request handler forwarding requests
+func (p *Proxy) Handler() message.RequestHandler {
+	return p.handleRequest
+}
+
+func (p *Proxy) handleRequest(ctx context.Context, req *message.Message) *message.Message {
+	switch message.RequestMethod(req.Msg.Method) {
+	case message.CANCEL:
+		// Transaction layer already answered CANCEL and INVITE
+		if f := p.getFork(forkKey(req)); f != nil {
+			f.cancel()
+		}
+		return nil
+	case message.ACK:
+		p.forwardAck(req)
+		return nil
+	}
+
+	if n, ok := req.MaxForwards(); ok && n == 0 {
+		return message.NewResponse(req, 483, "Too Many Hops")
+	}
+
+	targets, err := p.targets(req)
+	switch {
+	case errors.Is(err, simplesip.ErrNoRoute):
+		return message.NewResponse(req, 404, "Not Found")
+	case err != nil:
+		slog.Error("locate targets failed", "err", err)
+		return message.NewResponse(req, 500, "Server Internal Error")
+	case len(targets) == 0:
+		return message.NewResponse(req, 480, "Temporarily Unavailable")
+	}
+
+	if tx := p.srv.TransactionLayer().FindServerTx(req); tx != nil {
+		tx.MarkProxied()
+	}
+
+	f := newFork(p, req, p.groups(targets))
+	p.addFork(f)
+	f.start()
+
+	return nil
+}
+
+// targets returns Request-URI for request within dialog or with Route, targets of Locate otherwise
+func (p *Proxy) targets(req *message.Message) ([]Target, error) {
+	if dialog.IsInDialog(req) || req.Msg.Route != nil {
+		return []Target{{URI: req.Msg.Request, Q: 1}}, nil
+	}
+	return p.Locate(req)
+}
+
+// groups splits targets to groups tried one after another
+func (p *Proxy) groups(targets []Target) [][]Target {
+	if p.Mode == Parallel {
+		return [][]Target{targets}
+	}
+
+	sorted := append([]Target(nil), targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Q > sorted[j].Q
+	})
+
+	var groups [][]Target
+	for i, t := range sorted {
+		if i == 0 || t.Q != sorted[i-1].Q {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], t)
+	}
+	return groups
+}
+
+// forwardAck forwards ACK for 2xx, it is not part of any transaction
+func (p *Proxy) forwardAck(req *message.Message) {
+	if n, ok := req.MaxForwards(); ok && n == 0 {
+		return
+	}
+	fwd := req.Clone()
+	fwd.DecrementMaxForwards()
+	if _, err := p.srv.Forward(&fwd, nil); err != nil {
+		slog.Error("forward ACK failed", "err", err)
+	}
+}
+
+func (p *Proxy) addFork(f *fork) {
+	p.mu.Lock()
+	p.forks[f.key] = f
+	p.mu.Unlock()
+}
+
+func (p *Proxy) getFork(key string) *fork {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.forks[key]
+}
+
+func (p *Proxy) removeFork(f *fork) {
+	p.mu.Lock()
+	if p.forks[f.key] == f {
+		delete(p.forks, f.key)
+	}
+	p.mu.Unlock()
+}
+
+// RegistrarLocator returns locator of bindings of Request-URI in registrar
+func RegistrarLocator(r *registrar.Registrar) Locator {
+	return func(req *message.Message) ([]Target, error) {
+		bindings, err := r.Lookup(req.Msg.Request)
+		if err != nil {
+			return nil, err
+		}
+		targets := make([]Target, 0, len(bindings))
+		for _, b := range bindings {
+			targets = append(targets, Target{URI: b.Contact.Uri, Q: b.Q})
+		}
+		return targets, nil
+	}
+}
+
+// forkKey identifies INVITE and its CANCEL by top Via
+func forkKey(req *message.Message) string {
+	via := req.Msg.Via
+	return req.GetBranch() + "|" + via.Host + "|" + req.Msg.CallID
+}
@@ -0,0 +1,53 @@
+package simplesip
+
+import (
+	"testing"
+
+	jartsip "github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+func newProxiedRequest(method message.RequestMethod, branch string, toTag string) *message.Message {
+	to := &jartsip.Addr{Uri: &jartsip.URI{Scheme: "sip", User: "bob", Host: "example.com"}}
+	if toTag != "" {
+		to.Param = &jartsip.Param{Name: "tag", Value: toTag}
+	}
+	return &message.Message{Msg: &jartsip.Msg{
+		Method:     string(method),
+		Request:    &jartsip.URI{Scheme: "sip", User: "bob", Host: "example.com"},
+		Via:        &jartsip.Via{Transport: "UDP", Host: "192.0.2.1", Port: 5060, Param: &jartsip.Param{Name: "branch", Value: branch}},
+		From:       &jartsip.Addr{Uri: &jartsip.URI{Scheme: "sip", User: "alice", Host: "example.com"}, Param: &jartsip.Param{Name: "tag", Value: "a1"}},
+		To:         to,
+		CallID:     "call-1@192.0.2.1",
+		CSeq:       1,
+		CSeqMethod: string(method),
+	}}
+}
+
+func TestStatelessBranch(t *testing.T) {
+	tests := []struct {
+		name   string
+		branch string
+	}{
+		{name: "RFC 3261 branch", branch: "z9hG4bK776asdhds"},
+		{name: "RFC 2543 branch", branch: "0"},
+		{name: "no branch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invite := statelessBranch(newProxiedRequest(message.INVITE, tt.branch, ""))
+			// ACK of non-2xx carries To tag of response and must reach the same server transaction
+			if ack := statelessBranch(newProxiedRequest(message.ACK, tt.branch, "b1")); ack != invite {
+				t.Errorf("ACK branch %q, INVITE branch %q", ack, invite)
+			}
+			if cancel := statelessBranch(newProxiedRequest(message.CANCEL, tt.branch, "")); cancel != invite {
+				t.Errorf("CANCEL branch %q, INVITE branch %q", cancel, invite)
+			}
+			if other := statelessBranch(newProxiedRequest(message.INVITE, tt.branch+"1", "")); other == invite {
+				t.Errorf("different branches of previous hop got the same branch %q", other)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package simplesip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jartsip "github.com/jart/gosip/sip"
+	jartutil "github.com/jart/gosip/util"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/transport"
+)
+
+var (
+	ErrRegistererStarted    = errors.New("registerer already started")
+	ErrRegistererNotStarted = errors.New("registerer not started")
+)
+
+// registerRefreshMargin is time left before binding expires to refresh it
+const registerRefreshMargin = 30 * time.Second
+
+type RegistrationState int
+
+const (
+	RegistrationNone RegistrationState = iota
+	RegistrationRegistering
+	RegistrationRegistered
+	RegistrationFailed
+	RegistrationUnregistered
+)
+
+func (s RegistrationState) String() string {
+	switch s {
+	case RegistrationNone:
+		return "None"
+	case RegistrationRegistering:
+		return "Registering"
+	case RegistrationRegistered:
+		return "Registered"
+	case RegistrationFailed:
+		return "Failed"
+	case RegistrationUnregistered:
+		return "Unregistered"
+	}
+	return "Unknown"
+}
+
+// Registerer keeps binding of address-of-record at registrar, e.g. registration
+// of gateway to SIP trunk. Binding is refreshed before granted expiration runs out.
+// Challenges are answered with credentials set by Server.SetCredentials.
+type Registerer struct {
+	srv *Server
+
+	Registrar *jartsip.URI
+	AOR       *jartsip.Addr
+	// Contact is registered contact address. It is made of local address of transport when nil
+	Contact *jartsip.Addr
+	// Expires is requested expiration in seconds, read by Start. Registrar can raise
+	// it for running registration with 423 Interval Too Brief
+	Expires int
+	// RetryInterval is delay of new attempt after failed registration without Retry-After
+	RetryInterval time.Duration
+	// OnStateChange is called when registration state changes with response which caused it
+	OnStateChange func(state RegistrationState, res *message.Message)
+
+	mu      sync.Mutex
+	state   RegistrationState
+	callID  string
+	fromTag string
+	cseq    int
+	contact *jartsip.Addr
+	expires int
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewRegisterer creates registerer of aor at registrar. Fields can be changed before Start.
+func NewRegisterer(srv *Server, registrar *jartsip.URI, aor *jartsip.Addr) *Registerer {
+	return &Registerer{
+		srv:           srv,
+		Registrar:     registrar,
+		AOR:           aor,
+		Expires:       3600,
+		RetryInterval: 30 * time.Second,
+		callID:        jartutil.GenerateCallID(),
+		fromTag:       jartutil.GenerateTag(),
+	}
+}
+
+// State returns current registration state
+func (r *Registerer) State() RegistrationState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// Start registers in background and keeps refreshing binding until Stop
+func (r *Registerer) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return ErrRegistererStarted
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.expires = r.Expires
+	r.cancel = cancel
+	r.stopped = make(chan struct{})
+	go r.run(ctx)
+
+	return nil
+}
+
+// Stop stops refreshing and removes binding with Expires: 0. Ctx limits waiting for response.
+func (r *Registerer) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	cancel, stopped := r.cancel, r.stopped
+	r.cancel = nil
+	r.mu.Unlock()
+	if cancel == nil {
+		return ErrRegistererNotStarted
+	}
+
+	cancel()
+	<-stopped
+
+	if r.State() != RegistrationRegistered {
+		r.setState(RegistrationUnregistered, nil)
+		return nil
+	}
+
+	res, err := r.register(ctx, 0)
+	if err != nil {
+		r.setState(RegistrationUnregistered, nil)
+		return err
+	}
+	r.setState(RegistrationUnregistered, res)
+	if res.Msg.Status >= 300 {
+		return fmt.Errorf("unregister failed status=%d %s", res.Msg.Status, res.Msg.Phrase)
+	}
+	return nil
+}
+
+func (r *Registerer) run(ctx context.Context) {
+	defer close(r.stopped)
+
+	for {
+		delay := r.refresh(ctx)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// refresh sends REGISTER and returns delay of next one
+func (r *Registerer) refresh(ctx context.Context) time.Duration {
+	if r.State() != RegistrationRegistered {
+		r.setState(RegistrationRegistering, nil)
+	}
+
+	r.mu.Lock()
+	expires := r.expires
+	r.mu.Unlock()
+
+	res, err := r.register(ctx, expires)
+	if ctx.Err() != nil {
+		return 0
+	}
+	if err != nil {
+		slog.Error("send REGISTER failed", "err", err, "registrar", r.Registrar.String())
+		r.setState(RegistrationFailed, nil)
+		return r.RetryInterval
+	}
+
+	status := res.Msg.Status
+	switch {
+	case status >= 200 && status < 300:
+		r.setState(RegistrationRegistered, res)
+		return refreshAfter(r.granted(res, expires), r.RetryInterval)
+	case status == 423 && res.Msg.MinExpires > expires:
+		// Interval Too Brief, retry with Min-Expires of registrar (RFC 3261 10.2.8)
+		r.mu.Lock()
+		r.expires = res.Msg.MinExpires
+		r.mu.Unlock()
+		return 0
+	}
+
+	slog.Warn("REGISTER rejected", "status", status, "phrase", res.Msg.Phrase, "registrar", r.Registrar.String())
+	r.setState(RegistrationFailed, res)
+	return r.retryAfter(res)
+}
+
+// register sends REGISTER with expires and returns final response
+func (r *Registerer) register(ctx context.Context, expires int) (*message.Message, error) {
+	req, err := r.newRequest(expires)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := r.srv.Request(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var final *message.Message
+	for res := range ch {
+		final = res
+	}
+	if final == nil || final.Msg.Status < 200 {
+		return nil, ctx.Err()
+	}
+
+	// CSeq grows when challenge is answered
+	r.mu.Lock()
+	r.cseq = max(r.cseq, final.Msg.CSeq)
+	r.mu.Unlock()
+
+	return final, nil
+}
+
+// newRequest creates REGISTER. All requests share Call-ID and increase CSeq (RFC 3261 10.2).
+func (r *Registerer) newRequest(expires int) (*message.Message, error) {
+	r.mu.Lock()
+	r.cseq++
+	msg := &jartsip.Msg{
+		Method:  string(message.REGISTER),
+		Request: r.Registrar.Copy(),
+		From:    &jartsip.Addr{Uri: r.AOR.Uri.Copy(), Display: r.AOR.Display, Param: &jartsip.Param{Name: "tag", Value: r.fromTag}},
+		To:      &jartsip.Addr{Uri: r.AOR.Uri.Copy(), Display: r.AOR.Display},
+		CallID:  r.callID,
+		CSeq:    r.cseq,
+	}
+	contact := r.contact
+	r.mu.Unlock()
+
+	req := &message.Message{Msg: msg}
+	req.SetExpires(expires)
+	if err := r.srv.prepareRequest(req); err != nil {
+		return nil, err
+	}
+
+	if contact == nil {
+		contact = r.Contact
+	}
+	if contact == nil {
+		contact = localContact(r.AOR.Uri.User, req)
+	}
+	r.mu.Lock()
+	r.contact = contact
+	r.mu.Unlock()
+	msg.Contact = contact.Copy()
+	msg.Contact.Display = contact.Display
+
+	return req, nil
+}
+
+// granted returns expiration granted for our contact, requested expires when response tells none
+func (r *Registerer) granted(res *message.Message, expires int) int {
+	r.mu.Lock()
+	contact := r.contact
+	r.mu.Unlock()
+
+	for c := res.Msg.Contact; c != nil; c = c.Next {
+		if contact == nil || c.Uri.User != contact.Uri.User || !c.Uri.CompareHostPort(contact.Uri) {
+			continue
+		}
+		if p := c.Param.Get("expires"); p != nil {
+			if n, err := strconv.Atoi(p.Value); err == nil {
+				return n
+			}
+		}
+	}
+	if n, ok := res.Expires(); ok && n > 0 {
+		return n
+	}
+	return expires
+}
+
+// retryAfter returns delay of new attempt from Retry-After header or RetryInterval
+func (r *Registerer) retryAfter(res *message.Message) time.Duration {
+	value, _, _ := strings.Cut(res.Msg.RetryAfter, ";")
+	if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return r.RetryInterval
+}
+
+func (r *Registerer) setState(state RegistrationState, res *message.Message) {
+	r.mu.Lock()
+	changed := r.state != state
+	r.state = state
+	r.mu.Unlock()
+
+	if changed && r.OnStateChange != nil {
+		r.OnStateChange(state, res)
+	}
+}
+
+// refreshAfter returns delay of refresh leaving time for retransmissions and challenges.
+// Delay is never shorter than floor, so tiny or zero grants do not flood registrar.
+func refreshAfter(expires int, floor time.Duration) time.Duration {
+	d := time.Duration(expires) * time.Second
+	if d > 2*registerRefreshMargin {
+		d -= registerRefreshMargin
+	} else {
+		d /= 2
+	}
+	return max(d, floor)
+}
+
+// localContact creates Contact of user at address of Via of prepared request
+func localContact(user string, req *message.Message) *jartsip.Addr {
+	via := req.Msg.Via
+	uri := &jartsip.URI{
+		Scheme: "sip",
+		User:   user,
+		Host:   via.Host,
+		Port:   via.Port,
+	}
+	if req.Transport != transport.TransportUDP {
+		uri.Param = &jartsip.URIParam{Name: "transport", Value: transport.NetworkToLower(req.Transport)}
+	}
+	return &jartsip.Addr{Uri: uri}
+}
@@ -0,0 +1,27 @@
+package simplesip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires int
+		want    time.Duration
+	}{
+		{name: "long grant", expires: 3600, want: 3570 * time.Second},
+		{name: "short grant", expires: 50, want: 25 * time.Second},
+		{name: "below floor", expires: 20, want: 15 * time.Second},
+		{name: "zero grant", expires: 0, want: 15 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refreshAfter(tt.expires, 15*time.Second); got != tt.want {
+				t.Errorf("refreshAfter(%d) = %v, want %v", tt.expires, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package registrar
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+var (
+	ErrInvalidWildcard  = errors.New("wildcard Contact requires Expires: 0 and no other Contact")
+	ErrOutOfOrder       = errors.New("REGISTER with same Call-ID and lower CSeq")
+	ErrIntervalTooBrief = errors.New("expiration shorter than Min-Expires")
+)
+
+// Registrar handles REGISTER requests (RFC 3261 10.3) and keeps bindings in LocationStore
+type Registrar struct {
+	Store LocationStore
+
+	// DefaultExpires is used when REGISTER has no Expires header nor expires param
+	DefaultExpires int
+	// MinExpires is minimal accepted expiration, shorter intervals are answered with 423
+	MinExpires int
+	// MaxExpires limits expiration granted to UA
+	MaxExpires int
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+// New creates registrar storing bindings in store
+func New(store LocationStore) *Registrar {
+	return &Registrar{
+		Store:          store,
+		DefaultExpires: 3600,
+		MinExpires:     60,
+		MaxExpires:     7200,
+		now:            time.Now,
+	}
+}
+
+// Handler returns REGISTER handler of registrar with in-memory location store.
+// Expired bindings of the store are only hidden from lookups, long running servers
+// should use New with own MemoryStore and run its sweeper.
+func Handler() message.RequestHandler {
+	return New(NewMemoryStore()).Handler()
+}
+
+// Handler returns REGISTER handler, e.g. srv.OnRegister(r.Handler()).
+// Sweeping of store is up to caller, e.g. go store.RunSweeper(ctx, time.Minute),
+// otherwise expired bindings are only hidden from lookups.
+func (r *Registrar) Handler() message.RequestHandler {
+	return r.handleRegister
+}
+
+// Lookup returns current bindings of address-of-record URI sorted by q-value
+func (r *Registrar) Lookup(uri *sip.URI) ([]Binding, error) {
+	return r.Store.Get(AOR(uri))
+}
+
+func (r *Registrar) handleRegister(ctx context.Context, req *message.Message) *message.Message {
+	aor := AOR(req.Msg.To.Uri)
+
+	r.mu.Lock()
+	err := r.update(req, aor)
+	r.mu.Unlock()
+
+	switch {
+	case errors.Is(err, ErrInvalidWildcard):
+		return r.reply(req, 400, "Bad Request", nil)
+	case errors.Is(err, ErrOutOfOrder):
+		return r.reply(req, 500, "Server Internal Error", nil)
+	case errors.Is(err, ErrIntervalTooBrief):
+		res := r.reply(req, 423, "Interval Too Brief", nil)
+		res.Msg.MinExpires = r.MinExpires
+		return res
+	case err != nil:
+		slog.Error("registrar update failed", "err", err, "aor", aor)
+		return r.reply(req, 500, "Server Internal Error", nil)
+	}
+
+	bindings, err := r.Store.Get(aor)
+	if err != nil {
+		slog.Error("registrar lookup failed", "err", err, "aor", aor)
+		return r.reply(req, 500, "Server Internal Error", nil)
+	}
+
+	return r.reply(req, 200, "OK", bindings)
+}
+
+// update applies REGISTER to bindings of aor. Either all contacts are applied or none.
+func (r *Registrar) update(req *message.Message, aor string) error {
+	msg := req.Msg
+	current, err := r.Store.Get(aor)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]Binding, len(current))
+	for _, b := range current {
+		existing[b.Key()] = b
+	}
+
+	if IsWildcard(req) {
+		if expires, ok := req.Expires(); msg.Contact != nil || !ok || expires != 0 {
+			return ErrInvalidWildcard
+		}
+		for _, b := range current {
+			if b.CallID == msg.CallID && msg.CSeq <= b.CSeq {
+				return ErrOutOfOrder
+			}
+		}
+		for _, b := range current {
+			if err := r.Store.Delete(aor, b.Key()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	now := r.now()
+	updates := make([]Binding, 0, msg.Contact.Len())
+	for c := msg.Contact; c != nil; c = c.Next {
+		contact := &sip.Addr{Uri: c.Uri.Copy(), Display: c.Display, Param: c.Param}
+		expires := r.expires(req, contact)
+		if expires > 0 && expires < r.MinExpires {
+			return ErrIntervalTooBrief
+		}
+		expires = min(expires, r.MaxExpires)
+
+		b := Binding{
+			AOR:       aor,
+			Contact:   contact,
+			Expires:   now.Add(time.Duration(expires) * time.Second),
+			Q:         qValue(contact),
+			CallID:    msg.CallID,
+			CSeq:      msg.CSeq,
+			Source:    req.Source,
+			Transport: req.Transport,
+		}
+
+		if old, ok := existing[b.Key()]; ok && old.CallID == b.CallID && b.CSeq <= old.CSeq {
+			return ErrOutOfOrder
+		}
+		updates = append(updates, b)
+	}
+
+	for _, b := range updates {
+		if !b.Expires.After(now) {
+			if err := r.Store.Delete(aor, b.Key()); err != nil {
+				return err
+			}
+			continue
+		}
+		b.Contact.Param = message.RemoveParam(b.Contact.Param, "expires")
+		if err := r.Store.Put(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expires returns requested expiration of contact in seconds
+func (r *Registrar) expires(req *message.Message, contact *sip.Addr) int {
+	if p := contact.Param.Get("expires"); p != nil {
+		if n, err := strconv.Atoi(p.Value); err == nil && n >= 0 {
+			return n
+		}
+	}
+	if expires, ok := req.Expires(); ok {
+		return expires
+	}
+	return r.DefaultExpires
+}
+
+// reply creates response with current bindings as Contact list
+func (r *Registrar) reply(req *message.Message, status int, phrase string, bindings []Binding) *message.Message {
+	res := message.NewResponse(req, status, phrase)
+
+	now := r.now()
+	var last *sip.Addr
+	for _, b := range bindings {
+		remaining := int(b.Expires.Sub(now).Seconds())
+		c := &sip.Addr{
+			Uri:     b.Contact.Uri.Copy(),
+			Display: b.Contact.Display,
+			Param:   &sip.Param{Name: "expires", Value: strconv.Itoa(remaining), Next: b.Contact.Param},
+		}
+		if last == nil {
+			res.Msg.Contact = c
+		} else {
+			last.Next = c
+		}
+		last = c
+	}
+	if status == 200 {
+		res.Msg.Date = now.UTC().Format(time.RFC1123)
+		// Expires carries longest granted expiration, error response grants nothing
+		longest := 0
+		for _, b := range bindings {
+			longest = max(longest, int(b.Expires.Sub(now).Seconds()))
+		}
+		res.SetExpires(longest)
+	}
+
+	return res
+}
+
+// AOR returns canonical address-of-record of URI: scheme, user and lowercase host
+func AOR(uri *sip.URI) string {
+	scheme := uri.Scheme
+	if scheme == "" {
+		scheme = "sip"
+	}
+	host := strings.ToLower(uri.Host)
+	if uri.User == "" {
+		return scheme + ":" + host
+	}
+	return scheme + ":" + uri.User + "@" + host
+}
+
+// IsWildcard checks if REGISTER has "Contact: *"
+func IsWildcard(req *message.Message) bool {
+	h := req.Msg.XHeader.Get("Contact")
+	return h != nil && string(h.Value) == "*"
+}
+
+func qValue(contact *sip.Addr) float64 {
+	if p := contact.Param.Get("q"); p != nil {
+		if q, err := strconv.ParseFloat(p.Value, 64); err == nil {
+			return q
+		}
+	}
+	return 1
+}
@@ -0,0 +1,75 @@
+package registrar
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+func newTestRegister(expires int) *message.Message {
+	alice := &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}
+	msg := &sip.Msg{
+		Method:  string(message.REGISTER),
+		Request: &sip.URI{Scheme: "sip", Host: "example.com"},
+		Via: &sip.Via{
+			Transport: "UDP",
+			Host:      "192.0.2.1",
+			Port:      5060,
+			Param:     &sip.Param{Name: "branch", Value: "z9hG4bKreg1"},
+		},
+		From:       &sip.Addr{Uri: alice, Param: &sip.Param{Name: "tag", Value: "a1"}},
+		To:         &sip.Addr{Uri: alice},
+		Contact:    &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "192.0.2.1"}},
+		CallID:     "reg-1@192.0.2.1",
+		CSeq:       1,
+		CSeqMethod: string(message.REGISTER),
+	}
+	req := &message.Message{Msg: msg, Transport: "UDP", Source: "192.0.2.1:5060"}
+	req.SetExpires(expires)
+	return req
+}
+
+func TestRegisterResponseExpires(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires int
+		status  int
+		// want is Expires header line of response, empty for none
+		want string
+	}{
+		{name: "granted", expires: 3600, status: 200, want: "Expires: 3600"},
+		{name: "too brief", expires: 30, status: 423},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			store := NewMemoryStore()
+			store.now = func() time.Time { return now }
+			r := New(store)
+			r.now = store.now
+			res := r.Handler()(context.Background(), newTestRegister(tt.expires))
+			if res.Msg.Status != tt.status {
+				t.Fatalf("status %d, want %d", res.Msg.Status, tt.status)
+			}
+
+			var buf bytes.Buffer
+			res.Append(&buf)
+			var got string
+			for _, line := range strings.Split(buf.String(), "\r\n") {
+				if strings.HasPrefix(line, "Expires:") {
+					got = line
+				}
+			}
+			if got != tt.want {
+				t.Errorf("Expires line %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package registrar
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+)
+
+// Binding maps address-of-record to contact address
+type Binding struct {
+	AOR     string
+	Contact *sip.Addr
+	Expires time.Time
+	Q       float64
+
+	CallID string
+	CSeq   int
+
+	// Source and Transport of REGISTER, useful for reaching UA behind NAT
+	Source    string
+	Transport string
+}
+
+// Key identifies binding within address-of-record
+func (b Binding) Key() string {
+	return b.Contact.Uri.String()
+}
+
+// LocationStore keeps bindings of registrar
+type LocationStore interface {
+	// Get returns unexpired bindings of aor
+	Get(aor string) ([]Binding, error)
+	// Put adds or replaces binding with same aor and contact
+	Put(b Binding) error
+	// Delete removes binding of aor with contact key
+	Delete(aor string, key string) error
+}
+
+// MemoryStore is in-memory LocationStore
+type MemoryStore struct {
+	mu       sync.RWMutex
+	bindings map[string]map[string]Binding
+
+	now func() time.Time
+}
+
+// NewMemoryStore creates empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		bindings: make(map[string]map[string]Binding),
+		now:      time.Now,
+	}
+}
+
+func (s *MemoryStore) Get(aor string) ([]Binding, error) {
+	now := s.now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Binding, 0, len(s.bindings[aor]))
+	for _, b := range s.bindings[aor] {
+		if b.Expires.After(now) {
+			res = append(res, b)
+		}
+	}
+	SortByQ(res)
+	return res, nil
+}
+
+func (s *MemoryStore) Put(b Binding) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.bindings[b.AOR]
+	if !ok {
+		m = make(map[string]Binding)
+		s.bindings[b.AOR] = m
+	}
+	m[b.Key()] = b
+	return nil
+}
+
+func (s *MemoryStore) Delete(aor string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.bindings[aor], key)
+	if len(s.bindings[aor]) == 0 {
+		delete(s.bindings, aor)
+	}
+	return nil
+}
+
+// Sweep removes expired bindings
+func (s *MemoryStore) Sweep() {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for aor, m := range s.bindings {
+		for key, b := range m {
+			if !b.Expires.After(now) {
+				delete(m, key)
+			}
+		}
+		if len(m) == 0 {
+			delete(s.bindings, aor)
+		}
+	}
+}
+
+// RunSweeper removes expired bindings every interval until ctx is done
+func (s *MemoryStore) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+// SortByQ sorts bindings by q-value, highest first
+func SortByQ(bindings []Binding) {
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].Q > bindings[j].Q
+	})
+}
@@ -0,0 +1,148 @@
+package simplesip
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	jartsip "github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+// udpPeer is remote UA driven by test over raw UDP socket
+type udpPeer struct {
+	t    *testing.T
+	conn net.PacketConn
+	port int
+}
+
+func newUDPPeer(t *testing.T) *udpPeer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &udpPeer{t: t, conn: conn, port: conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// uri returns URI of user at peer
+func (p *udpPeer) uri(user string) *jartsip.URI {
+	return &jartsip.URI{Scheme: "sip", User: user, Host: "127.0.0.1", Port: uint16(p.port)}
+}
+
+// read returns next message from peer socket, retransmissions included
+func (p *udpPeer) read() (*message.Message, net.Addr) {
+	p.t.Helper()
+	buf := make([]byte, 65535)
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := p.conn.ReadFrom(buf)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	msg, err := parser.NewParser().ParseMsg(buf[:n])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return msg, addr
+}
+
+// expect returns next request of method, other messages are skipped
+func (p *udpPeer) expect(method message.RequestMethod) (*message.Message, net.Addr) {
+	p.t.Helper()
+	for {
+		msg, addr := p.read()
+		if !msg.Msg.IsResponse() && msg.Msg.Method == string(method) {
+			return msg, addr
+		}
+	}
+}
+
+func (p *udpPeer) write(msg *message.Message, addr net.Addr) {
+	p.t.Helper()
+	var buf bytes.Buffer
+	msg.Append(&buf)
+	if _, err := p.conn.WriteTo(buf.Bytes(), addr); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// serveUDP serves srv on local UDP port and waits until it answers requests
+func serveUDP(t *testing.T, srv *Server) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeUDP(conn)
+
+	// OPTIONS without handler is answered with 405 once server reads socket
+	p := newUDPPeer(t)
+	options := message.NewRequest(message.OPTIONS, p.uri("srv")).
+		From(&jartsip.Addr{Uri: p.uri("probe")}).
+		Via("127.0.0.1", p.port).
+		Transport("UDP").
+		Build()
+	p.write(options, conn.LocalAddr())
+	if res, _ := p.read(); !res.Msg.IsResponse() {
+		t.Fatalf("server answered probe with %s", res.Msg.Method)
+	}
+}
+
+func TestCanceledInviteAnswered(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	serveUDP(t, srv)
+	peer := newUDPPeer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := message.NewRequest(message.INVITE, peer.uri("bob")).
+		From(&jartsip.Addr{Uri: &jartsip.URI{Scheme: "sip", User: "alice", Host: "127.0.0.1"}}).
+		Build()
+	ch, err := srv.Request(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invite, addr := peer.expect(message.INVITE)
+	peer.write(message.NewRinging(invite), addr)
+	if res := <-ch; res.Msg.Status != 180 {
+		t.Fatalf("got %d, want 180", res.Msg.Status)
+	}
+	cancel()
+
+	// 200 of INVITE crosses CANCEL
+	cancelReq, addr := peer.expect(message.CANCEL)
+	peer.write(message.NewResponse(cancelReq, 200, ""), addr)
+	ok := message.NewResponse(invite, 200, "")
+	ok.Msg.Contact = &jartsip.Addr{Uri: peer.uri("bob")}
+	peer.write(ok, addr)
+
+	for res := range ch {
+		t.Errorf("response %d delivered after ctx was canceled", res.Msg.Status)
+	}
+
+	ack, _ := peer.expect(message.ACK)
+	if ack.GetToTag() != ok.GetToTag() || ack.Msg.CSeq != invite.Msg.CSeq {
+		t.Errorf("ACK To tag %q CSeq %d, want %q %d", ack.GetToTag(), ack.Msg.CSeq, ok.GetToTag(), invite.Msg.CSeq)
+	}
+	bye, addr := peer.expect(message.BYE)
+	if bye.GetCallID() != invite.GetCallID() || bye.GetToTag() != ok.GetToTag() {
+		t.Errorf("BYE of other dialog, Call-ID %q To tag %q", bye.GetCallID(), bye.GetToTag())
+	}
+	peer.write(message.NewResponse(bye, 200, ""), addr)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Dialogs().Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dialogs left after BYE", srv.Dialogs().Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
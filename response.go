@@ -2,13 +2,9 @@ package simplesip
 
 import "github.com/shend/simplesip/message"
 
+// NewResponseFromRequest creates response of request.
+//
+// Deprecated: use message.NewResponse, which leaves out body and headers not belonging to response.
 func NewResponseFromRequest(req *message.Message, status int, phrase string) *message.Message {
-	res := req.Clone()
-	res.Msg.Status = status
-	res.Msg.Phrase = phrase
-	if req.GetToTag() == "" {
-		res.Msg.To.Tag()
-	}
-	res.Destination, res.Source = res.Source, res.Destination
-	return &res
+	return message.NewResponse(req, status, phrase)
 }
@@ -0,0 +1,114 @@
+package simplesip
+
+import (
+	"fmt"
+
+	jartsip "github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/dialog"
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/transport"
+)
+
+// AddAlias adds host name of this server. Route and Request-URI with alias are
+// recognized as own, besides IP addresses of network interfaces.
+func (srv *Server) AddAlias(host string) {
+	srv.tp.AddAlias(host)
+}
+
+// RecordRoute inserts own Record-Route with lr param into request forwarded by
+// proxy, so requests within dialog pass this proxy too. Requests within dialog and
+// requests which can not create dialog are left as they are.
+func (srv *Server) RecordRoute(req *message.Message) error {
+	switch message.RequestMethod(req.Msg.Method) {
+	case message.ACK, message.CANCEL, message.REGISTER:
+		return nil
+	}
+	if dialog.IsInDialog(req) {
+		return nil
+	}
+
+	network := requestTransport(req.Msg)
+	dst, err := requestDestination(req.Msg, network)
+	if err != nil {
+		return err
+	}
+	host, port, err := srv.tp.LocalAddr(network, dst)
+	if err != nil {
+		return fmt.Errorf("resolve local address failed err=%w", err)
+	}
+
+	uri := &jartsip.URI{
+		Scheme: "sip",
+		Host:   host,
+		Port:   uint16(port),
+		Param:  &jartsip.URIParam{Name: "lr"},
+	}
+	if req.Msg.Request.Scheme == "sips" {
+		uri.Scheme = "sips"
+	}
+	if network != transport.TransportUDP {
+		uri.Param = &jartsip.URIParam{Name: "transport", Value: transport.NetworkToLower(network), Next: uri.Param}
+	}
+	req.Msg.RecordRoute = &jartsip.Addr{Uri: uri, Next: req.Msg.RecordRoute}
+
+	return nil
+}
+
+// processRoute handles Route of received request (RFC 3261 16.4). Request-URI
+// set by strict router is restored from last Route and own Route entries are removed.
+func (srv *Server) processRoute(req *message.Message) {
+	msg := req.Msg
+	if msg.Request != nil && msg.Route != nil && isLooseRoute(msg.Request) && srv.isOwnURI(msg.Request) {
+		// Previous hop is strict router, which put our Record-Route to Request-URI
+		var routes []*jartsip.Addr
+		for r := msg.Route; r != nil; r = r.Next {
+			routes = append(routes, r)
+		}
+		msg.Request = routes[len(routes)-1].Uri.Copy()
+		msg.Route = nil
+		for i := len(routes) - 2; i >= 0; i-- {
+			r := *routes[i]
+			r.Next = msg.Route
+			msg.Route = &r
+		}
+	}
+
+	for msg.Route != nil && srv.isOwnURI(msg.Route.Uri) {
+		msg.Route = msg.Route.Next
+	}
+}
+
+// isOwnURI checks if URI addresses this server
+func (srv *Server) isOwnURI(uri *jartsip.URI) bool {
+	return uri != nil && uri.User == "" && srv.tp.IsLocal(uri.Host, int(uri.Port))
+}
+
+// strictRoute rewrites request for next hop which is strict router (RFC 3261 12.2.1.1).
+// Request-URI is put as last Route and top Route becomes Request-URI.
+func strictRoute(msg *jartsip.Msg) {
+	if msg.Route == nil || isLooseRoute(msg.Route.Uri) {
+		return
+	}
+
+	next := msg.Route
+	route := next.Next.Copy()
+	last := &jartsip.Addr{Uri: msg.Request.Copy()}
+	if route == nil {
+		route = last
+	} else {
+		r := route
+		for r.Next != nil {
+			r = r.Next
+		}
+		r.Next = last
+	}
+
+	msg.Request = next.Uri.Copy()
+	msg.Route = route
+}
+
+// isLooseRoute checks lr param of URI
+func isLooseRoute(uri *jartsip.URI) bool {
+	return uri != nil && uri.Param.Get("lr") != nil
+}
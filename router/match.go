@@ -0,0 +1,150 @@
+package router
+
+import (
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/shend/simplesip/message"
+)
+
+// Matcher reports if request matches route
+type Matcher func(req *message.Message) bool
+
+// Method matches request of any of methods. Methods are compared as is, so
+// extension methods can be routed too.
+func Method(methods ...message.RequestMethod) Matcher {
+	return func(req *message.Message) bool {
+		for _, m := range methods {
+			if req.Msg.Method == string(m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// User matches user part of Request-URI
+func User(user string) Matcher {
+	return func(req *message.Message) bool {
+		return req.Msg.Request != nil && req.Msg.Request.User == user
+	}
+}
+
+// UserPrefix matches user part of Request-URI starting with prefix, e.g. dial plan prefix
+func UserPrefix(prefix string) Matcher {
+	return func(req *message.Message) bool {
+		return req.Msg.Request != nil && strings.HasPrefix(req.Msg.Request.User, prefix)
+	}
+}
+
+// UserRegexp matches user part of Request-URI by regular expression. It panics
+// when expr does not compile, as routes are set up before serving.
+func UserRegexp(expr string) Matcher {
+	re := regexp.MustCompile(expr)
+	return func(req *message.Message) bool {
+		return req.Msg.Request != nil && re.MatchString(req.Msg.Request.User)
+	}
+}
+
+// Host matches host of Request-URI, case-insensitive
+func Host(host string) Matcher {
+	return func(req *message.Message) bool {
+		return req.Msg.Request != nil && strings.EqualFold(req.Msg.Request.Host, host)
+	}
+}
+
+// HostRegexp matches host of Request-URI by regular expression. It panics when
+// expr does not compile.
+func HostRegexp(expr string) Matcher {
+	re := regexp.MustCompile(expr)
+	return func(req *message.Message) bool {
+		return req.Msg.Request != nil && re.MatchString(req.Msg.Request.Host)
+	}
+}
+
+// Header matches request having header of name with value. Name can be compact
+// form, value is compared case-insensitive. Empty value matches any request
+// having header.
+func Header(name string, value string) Matcher {
+	return func(req *message.Message) bool {
+		for _, v := range req.Headers(name) {
+			if value == "" || strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HeaderRegexp matches value of header of name by regular expression. It panics
+// when expr does not compile.
+func HeaderRegexp(name string, expr string) Matcher {
+	re := regexp.MustCompile(expr)
+	return func(req *message.Message) bool {
+		for _, v := range req.Headers(name) {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Transport matches request received over any of transports, e.g. transport.TransportTLS
+func Transport(transports ...string) Matcher {
+	return func(req *message.Message) bool {
+		for _, t := range transports {
+			if strings.EqualFold(req.Transport, t) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Source matches request received from address within any of networks given in
+// CIDR notation, e.g. "10.0.0.0/8". It panics when network does not parse.
+func Source(networks ...string) Matcher {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, n := range networks {
+		prefixes = append(prefixes, netip.MustParsePrefix(n).Masked())
+	}
+	return func(req *message.Message) bool {
+		host, _, err := net.SplitHostPort(req.Source)
+		if err != nil {
+			host = req.Source
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not matches request not matching m
+func Not(m Matcher) Matcher {
+	return func(req *message.Message) bool {
+		return !m(req)
+	}
+}
+
+// Any matches request matching any of matchers
+func Any(matchers ...Matcher) Matcher {
+	return func(req *message.Message) bool {
+		for _, m := range matchers {
+			if m(req) {
+				return true
+			}
+		}
+		return false
+	}
+}
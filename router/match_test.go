@@ -0,0 +1,99 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// newTestRequest creates request of method to user@host received from source
+func newTestRequest(method message.RequestMethod, user string, host string) *message.Message {
+	req := message.NewRequest(method, &sip.URI{Scheme: "sip", User: user, Host: host}).
+		From(&sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}}).
+		Via("192.0.2.1", 5060).
+		Build()
+	req.Transport = "UDP"
+	req.Source = "10.1.2.3:5060"
+	return req
+}
+
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher Matcher
+		// change adjusts request of INVITE to sip:+4930123@Example.COM from 10.1.2.3 over UDP
+		change func(req *message.Message)
+		want   bool
+	}{
+		{name: "method", matcher: Method(message.INVITE), want: true},
+		{name: "method of list", matcher: Method(message.BYE, message.INVITE), want: true},
+		{name: "other method", matcher: Method(message.BYE)},
+		{name: "extension method", matcher: Method("PING"), change: func(r *message.Message) { r.Msg.Method = "PING" }, want: true},
+		{name: "method case-sensitive", matcher: Method("invite")},
+		{name: "user", matcher: User("+4930123"), want: true},
+		{name: "other user", matcher: User("+49")},
+		{name: "user without Request-URI", matcher: User(""), change: func(r *message.Message) { r.Msg.Request = nil }},
+		{name: "user prefix", matcher: UserPrefix("+49"), want: true},
+		{name: "other user prefix", matcher: UserPrefix("00")},
+		{name: "user regexp", matcher: UserRegexp(`^\+49\d+$`), want: true},
+		{name: "user regexp mismatch", matcher: UserRegexp(`^\*\d+$`)},
+		{name: "host case-insensitive", matcher: Host("example.com"), want: true},
+		{name: "other host", matcher: Host("example.org")},
+		{name: "host regexp", matcher: HostRegexp(`(?i)^example\.`), want: true},
+		{name: "header", matcher: Header("Subject", "Hello"), change: func(r *message.Message) { r.SetHeader("Subject", "hello") }, want: true},
+		{name: "header compact name", matcher: Header("s", ""), change: func(r *message.Message) { r.SetHeader("Subject", "x") }, want: true},
+		{name: "missing header", matcher: Header("Subject", "")},
+		{name: "header other value", matcher: Header("Subject", "bye"), change: func(r *message.Message) { r.SetHeader("Subject", "hello") }},
+		{name: "extension header", matcher: Header("X-Tenant", "blue"), change: func(r *message.Message) { r.AddHeader("X-Tenant", "blue") }, want: true},
+		{name: "header regexp", matcher: HeaderRegexp("User-Agent", `^Yealink`), change: func(r *message.Message) { r.SetHeader("User-Agent", "Yealink T46S") }, want: true},
+		{name: "transport case-insensitive", matcher: Transport("tls", "udp"), want: true},
+		{name: "other transport", matcher: Transport("TLS")},
+		{name: "source network", matcher: Source("10.0.0.0/8"), want: true},
+		{name: "source of list", matcher: Source("192.168.0.0/16", "10.1.2.3/32"), want: true},
+		{name: "other source", matcher: Source("192.168.0.0/16")},
+		{name: "source without port", matcher: Source("10.0.0.0/8"), change: func(r *message.Message) { r.Source = "10.9.9.9" }, want: true},
+		{name: "IPv4-mapped source", matcher: Source("10.0.0.0/8"), change: func(r *message.Message) { r.Source = "[::ffff:10.1.2.3]:5060" }, want: true},
+		{name: "IPv6 source", matcher: Source("2001:db8::/32"), change: func(r *message.Message) { r.Source = "[2001:db8::1]:5060" }, want: true},
+		{name: "unknown source", matcher: Source("0.0.0.0/0"), change: func(r *message.Message) { r.Source = "" }},
+		{name: "not", matcher: Not(Method(message.BYE)), want: true},
+		{name: "any", matcher: Any(Method(message.BYE), UserPrefix("+")), want: true},
+		{name: "any of none", matcher: Any()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest(message.INVITE, "+4930123", "Example.COM")
+			if tt.change != nil {
+				tt.change(req)
+			}
+			if got := tt.matcher(req); got != tt.want {
+				t.Errorf("match %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatcherInvalidPattern(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func()
+	}{
+		{name: "user regexp", new: func() { UserRegexp("(") }},
+		{name: "host regexp", new: func() { HostRegexp("[") }},
+		{name: "header regexp", new: func() { HeaderRegexp("Subject", "(") }},
+		{name: "source", new: func() { Source("10.0.0.0") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("invalid pattern accepted")
+				}
+			}()
+			tt.new()
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package router
+
+import (
+	"context"
+	"sync"
+
+	"github.com/shend/simplesip/message"
+)
+
+// Router dispatches requests to handlers of first matching route. Routes are
+// tried in order they were added. Groups share matchers and middlewares of
+// their routes, similar to HTTP routers:
+//
+//	r := router.New()
+//	r.Use(logging)
+//	r.Handle(voicemail, router.Method(message.INVITE), router.User("*98"))
+//	pstn := r.Group(router.UserPrefix("+"), router.Source("10.0.0.0/8"))
+//	pstn.Use(auth.Wrap)
+//	pstn.Handle(gateway, router.Method(message.INVITE))
+type Router struct {
+	mu          sync.RWMutex
+	middlewares []message.Middleware
+	entries     []*entry
+	// methods are routes added by HandleMethod, which replaces handler of method
+	methods map[message.RequestMethod]*entry
+}
+
+// entry is route or group of router
+type entry struct {
+	matchers []Matcher
+	handler  message.RequestHandler
+	group    *Router
+}
+
+// New creates empty router
+func New() *Router {
+	return &Router{
+		methods: make(map[message.RequestMethod]*entry),
+	}
+}
+
+// Use appends middlewares wrapping handlers of router and its groups.
+// Middleware added first is outermost.
+func (r *Router) Use(middlewares ...message.Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Handle adds route of handler for requests matching all matchers
+func (r *Router) Handle(handler message.RequestHandler, matchers ...Matcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, &entry{matchers: matchers, handler: handler})
+}
+
+// HandleMethod adds route of handler for method. Handler of method added
+// before is replaced, route keeps its position.
+func (r *Router) HandleMethod(method message.RequestMethod, handler message.RequestHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.methods[method]; ok {
+		e.handler = handler
+		return
+	}
+	e := &entry{matchers: []Matcher{Method(method)}, handler: handler}
+	r.methods[method] = e
+	r.entries = append(r.entries, e)
+}
+
+// Group adds group of routes for requests matching all matchers. Group has own middlewares.
+func (r *Router) Group(matchers ...Matcher) *Router {
+	g := New()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, &entry{matchers: matchers, group: g})
+	return g
+}
+
+// Match returns handler of first route matching request wrapped with middlewares
+// of its groups, nil when no route matches
+func (r *Router) Match(req *message.Message) message.RequestHandler {
+	r.mu.RLock()
+	entries := r.entries
+	middlewares := r.middlewares
+	r.mu.RUnlock()
+
+	for _, e := range entries {
+		if !matchAll(e.matchers, req) {
+			continue
+		}
+
+		handler := e.handler
+		if e.group != nil {
+			if handler = e.group.Match(req); handler == nil {
+				continue
+			}
+		}
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+		return handler
+	}
+	return nil
+}
+
+// Handler returns request handler dispatching requests by router. Requests
+// matching no route are passed to notFound.
+func (r *Router) Handler(notFound message.RequestHandler) message.RequestHandler {
+	return func(ctx context.Context, req *message.Message) *message.Message {
+		if h := r.Match(req); h != nil {
+			return h(ctx, req)
+		}
+		return notFound(ctx, req)
+	}
+}
+
+func matchAll(matchers []Matcher, req *message.Message) bool {
+	for _, m := range matchers {
+		if !m(req) {
+			return false
+		}
+	}
+	return true
+}
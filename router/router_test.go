@@ -0,0 +1,130 @@
+package router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shend/simplesip/message"
+)
+
+// respond returns handler answering with status
+func respond(status int) message.RequestHandler {
+	return func(ctx context.Context, req *message.Message) *message.Message {
+		return message.NewResponse(req, status, "")
+	}
+}
+
+// status returns status of response of handler, 0 when there is none
+func status(h message.RequestHandler, req *message.Message) int {
+	if h == nil {
+		return 0
+	}
+	if res := h(context.Background(), req); res != nil {
+		return res.Msg.Status
+	}
+	return 0
+}
+
+// record returns middleware appending name to trace when it is called
+func record(trace *[]string, name string) message.Middleware {
+	return func(next message.RequestHandler) message.RequestHandler {
+		return func(ctx context.Context, req *message.Message) *message.Message {
+			*trace = append(*trace, name)
+			return next(ctx, req)
+		}
+	}
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	r := New()
+	// Overlapping routes, the first one added wins
+	r.Handle(respond(201), Method(message.INVITE), User("*98"))
+	r.Handle(respond(202), Method(message.INVITE), UserPrefix("*"))
+	pstn := r.Group(UserPrefix("+"))
+	pstn.Handle(respond(203), Source("10.0.0.0/8"))
+	r.Handle(respond(204), Method(message.INVITE))
+	r.HandleMethod(message.OPTIONS, respond(205))
+	r.Handle(respond(206))
+	// Later handler of method keeps position of the first one
+	r.HandleMethod(message.OPTIONS, respond(207))
+
+	tests := []struct {
+		name   string
+		method message.RequestMethod
+		user   string
+		source string
+		want   int
+	}{
+		{name: "exact user before prefix", method: message.INVITE, user: "*98", want: 201},
+		{name: "prefix", method: message.INVITE, user: "*99", want: 202},
+		{name: "group", method: message.INVITE, user: "+4930", want: 203},
+		{name: "group without matching route falls through", method: message.INVITE, user: "+4930", source: "192.0.2.1:5060", want: 204},
+		{name: "group matches any method", method: message.MESSAGE, user: "+4930", want: 203},
+		{name: "method", method: message.INVITE, user: "bob", want: 204},
+		{name: "replaced method handler keeps position", method: message.OPTIONS, user: "bob", want: 207},
+		{name: "catch-all", method: message.BYE, user: "bob", want: 206},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest(tt.method, tt.user, "example.com")
+			if tt.source != "" {
+				req.Source = tt.source
+			}
+			if got := status(r.Match(req), req); got != tt.want {
+				t.Errorf("routed to %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterMiddlewares(t *testing.T) {
+	var trace []string
+	r := New()
+	r.Use(record(&trace, "outer"), record(&trace, "inner"))
+	g := r.Group(Method(message.INVITE))
+	g.Use(record(&trace, "group"))
+	g.Handle(respond(200), UserPrefix("+"))
+	r.Handle(respond(404))
+
+	tests := []struct {
+		name string
+		user string
+		want []string
+	}{
+		{name: "route of group", user: "+4930", want: []string{"outer", "inner", "group"}},
+		{name: "route of router", user: "bob", want: []string{"outer", "inner"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trace = nil
+			req := newTestRequest(message.INVITE, tt.user, "example.com")
+			status(r.Match(req), req)
+			if len(trace) != len(tt.want) {
+				t.Fatalf("middlewares %v, want %v", trace, tt.want)
+			}
+			for i := range trace {
+				if trace[i] != tt.want[i] {
+					t.Fatalf("middlewares %v, want %v", trace, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRouterHandler(t *testing.T) {
+	r := New()
+	r.Handle(respond(200), Method(message.INVITE))
+	h := r.Handler(respond(405))
+
+	for method, want := range map[message.RequestMethod]int{message.INVITE: 200, message.BYE: 405} {
+		req := newTestRequest(method, "bob", "example.com")
+		if got := status(h, req); got != want {
+			t.Errorf("%s answered with %d, want %d", method, got, want)
+		}
+	}
+	if h := New().Match(newTestRequest(message.INVITE, "bob", "example.com")); h != nil {
+		t.Error("empty router matched request")
+	}
+}
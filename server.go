@@ -2,217 +2,470 @@ package simplesip
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
 	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
 
+	"github.com/shend/simplesip/dialog"
 	"github.com/shend/simplesip/message"
 	"github.com/shend/simplesip/parser"
+	"github.com/shend/simplesip/router"
+	"github.com/shend/simplesip/transaction"
 	"github.com/shend/simplesip/transport"
 
 	jartsip "github.com/jart/gosip/sip"
-	jartutil "github.com/jart/gosip/util"
 )
 
+// shutdownPollInterval is how often Shutdown checks pending transactions
+const shutdownPollInterval = 50 * time.Millisecond
+
 // Server is a SIP server
 type Server struct {
 	tp *transport.Layer
-	// requestHandlers map of all registered request handlers
-	requestHandlers map[message.RequestMethod]message.RequestHandler
-	noRouteHandler  message.RequestHandler
+	tx *transaction.Layer
+
+	dialogs *dialog.Manager
+	// noDialogs turns off dialog tracking of proxies
+	noDialogs bool
+	auth      *clientAuth
+	// routes dispatch requests to registered handlers
+	routes         *router.Router
+	noRouteHandler message.RequestHandler
+	// responseHandlers get responses of client transactions, strayHandler the others
+	responseHandlers []message.ResponseHandler
+	strayHandler     message.ResponseHandler
+	// router turns on stateless proxy mode for requests without handler
+	router Router
 
 	requestMiddlewares  []message.RequestMiddleware
 	responseMiddlewares []message.ResponseMiddleware
+	// middlewares wrap handler of every request, first one is outermost
+	middlewares []message.Middleware
+
+	// HandlerTimeout is deadline of context passed to request handlers. It can be changed before serving.
+	HandlerTimeout time.Duration
+
+	// ctx is parent of handler contexts, it is canceled when server stops
+	ctx          context.Context
+	cancel       context.CancelFunc
+	shuttingDown atomic.Bool
 }
 
 func NewServer() (*Server, error) {
+	tp := transport.NewLayer(parser.NewParser())
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Server{
-		tp:                  transport.NewLayer(parser.NewParser()),
-		requestHandlers:     make(map[message.RequestMethod]message.RequestHandler),
-		requestMiddlewares:  make([]message.RequestMiddleware, 1),
-		responseMiddlewares: make([]message.ResponseMiddleware, 1),
+		tp:                 tp,
+		tx:                 transaction.NewLayer(tp),
+		dialogs:            dialog.NewManager(),
+		auth:               newClientAuth(),
+		routes:             router.New(),
+		requestMiddlewares: make([]message.RequestMiddleware, 1),
+		ctx:                ctx,
+		cancel:             cancel,
 	}
+	// Server transaction does not outlive 64*T1 without final response
+	s.HandlerTimeout = 64 * s.tx.Timings.T1
 
 	s.requestMiddlewares[0] = s.defaultRequestMiddleware
-	s.responseMiddlewares[0] = s.defaultResponseMiddleware
 	s.noRouteHandler = s.defaultUnhandledHandler
 
+	s.tx.OnRequest(s.handleRequest)
+	s.tx.OnCancel(s.handleCancel)
+	s.tx.OnResponse(s.handleResponse)
+	s.tx.OnUnmatchedResponse(s.handleStrayResponse)
+	s.tp.AppendHandlers(s.handleMessage)
+
 	return s, nil
 }
 
-// ListenAndServe will fire all listeners. Ctx allows canceling
+// ListenAndServe listens on network address and serves until listener is closed.
+// Done ctx closes listener.
 func (srv *Server) ListenAndServe(ctx context.Context, network string, addr string) error {
-	srv.tp.AppendHandlers(srv.handleRequest)
-	return srv.tp.ListenAndServe(network, addr)
+	return srv.tp.ListenAndServe(ctx, network, addr)
 }
 
 // ServeUDP starts serving request on UDP type listener.
 func (srv *Server) ServeUDP(l net.PacketConn) error {
-	srv.tp.AppendHandlers(srv.handleRequest)
 	return srv.tp.ServeUDP(l)
 }
 
 // ServeTCP starts serving request on TCP type listener.
 func (srv *Server) ServeTCP(l net.Listener) error {
-	srv.tp.AppendHandlers(srv.handleRequest)
 	return srv.tp.ServeTCP(l)
 }
 
-// onRequest gets request from Transaction layer
-func (srv *Server) onRequest(req *message.Message) {
-	go srv.handleRequest(req)
+// ServeTLS starts serving request on TCP type listener wrapped with TLS.
+func (srv *Server) ServeTLS(l net.Listener) error {
+	return srv.tp.ServeTLS(l)
+}
+
+// WebSocketHandler returns http.Handler serving SIP over WebSocket.
+// Mount it on any http server, e.g. http.Handle("/sip", srv.WebSocketHandler())
+func (srv *Server) WebSocketHandler() http.Handler {
+	return srv.tp.WSHandler()
+}
+
+// SetTLSConfig sets certificates and client auth used by TLS transport
+func (srv *Server) SetTLSConfig(config *tls.Config) {
+	srv.tp.SetTLSConfig(config)
+}
+
+// SetParser sets parser of received messages, e.g. parser.NewNativeParser for
+// proxies. It must be called before serving.
+func (srv *Server) SetParser(p parser.Parser) {
+	srv.tp.SetParser(p)
+}
+
+// handleMessage passes messages from transport layer to transaction layer.
+// Requests forwarded statelessly bypass transaction layer.
+func (srv *Server) handleMessage(msg *message.Message) {
+	if !msg.Msg.IsResponse() {
+		srv.processRoute(msg)
+	}
+	if srv.router != nil && !msg.Msg.IsResponse() && !srv.isLocal(msg) {
+		if srv.refuses(msg) {
+			srv.proxyReply(msg, 503, "Service Unavailable")
+			return
+		}
+		srv.proxyRequest(msg)
+		return
+	}
+	srv.tx.HandleMessage(msg)
+}
+
+// handleResponse passes response of client transaction to OnResponse handlers
+func (srv *Server) handleResponse(res *message.Message) {
+	for _, h := range srv.responseHandlers {
+		h(res)
+	}
+}
+
+// handleStrayResponse gets responses matching no client transaction. Responses of
+// stateless proxy are forwarded, others go to stray handler or are dropped.
+func (srv *Server) handleStrayResponse(res *message.Message) {
+	if srv.router != nil && srv.proxyResponse(res) {
+		return
+	}
+	if srv.strayHandler != nil {
+		srv.strayHandler(res)
+		return
+	}
+	slog.Debug("drop response matching no transaction", "status", res.Msg.Status, "cseq", res.Msg.CSeq, "method", res.Msg.CSeqMethod)
 }
 
-// handleRequest must be run in separate goroutine
-func (srv *Server) handleRequest(req *message.Message) *message.Message {
+// handleRequest passes request through middlewares to its handler
+func (srv *Server) handleRequest(req *message.Message) {
+	if srv.refuses(req) {
+		res := message.NewResponse(req, 503, "Service Unavailable")
+		if err := srv.WriteResponse(res); err != nil {
+			slog.Error("respond '503 Service Unavailable' failed", "err", err)
+		}
+		return
+	}
+	if !srv.noDialogs && dialog.IsInDialog(req) && !srv.matchDialog(req) {
+		return
+	}
+
 	for _, mid := range srv.requestMiddlewares {
 		mid(req)
 	}
 
-	var method string
-	if req.Msg.IsResponse() {
-		method = req.Msg.CSeqMethod
-	} else {
-		method = req.Msg.Method
+	ctx, cancel := context.WithTimeout(srv.ctx, srv.HandlerTimeout)
+	defer cancel()
+
+	handler := srv.routes.Match(req)
+	if handler == nil {
+		handler = srv.noRouteHandler
+	}
+	for i := len(srv.middlewares) - 1; i >= 0; i-- {
+		handler = srv.middlewares[i](handler)
 	}
-	handler := srv.getHandler(message.FromString(method))
-	res := handler(req)
+	res := handler(ctx, req)
 
-	final := false
 	for _, mid := range srv.responseMiddlewares {
-		if final {
-			break
+		if mid(res) {
+			return
 		}
-		final = mid(res)
+	}
+	srv.defaultResponseMiddleware(res)
+}
+
+// handleCancel removes early dialogs of canceled INVITE and passes CANCEL to its
+// handler, e.g. for proxy to cancel branches. Transaction layer already answered
+// CANCEL and INVITE, so response returned by handler is dropped.
+func (srv *Server) handleCancel(req *message.Message) {
+	if !srv.noDialogs {
+		srv.dialogs.OnCancel(req)
+	}
+
+	handler := srv.routes.Match(req)
+	if handler == nil {
+		return
+	}
+	for i := len(srv.middlewares) - 1; i >= 0; i-- {
+		handler = srv.middlewares[i](handler)
+	}
+
+	ctx, cancel := context.WithTimeout(srv.ctx, srv.HandlerTimeout)
+	defer cancel()
+	if res := handler(ctx, req); res != nil {
+		slog.Debug("drop response to answered CANCEL", "status", res.Msg.Status)
+	}
+}
+
+// refuses reports if request is refused while shutting down. Only requests
+// within dialog and ACK and CANCEL are served then.
+func (srv *Server) refuses(req *message.Message) bool {
+	if !srv.shuttingDown.Load() || dialog.IsInDialog(req) {
+		return false
+	}
+	method := message.RequestMethod(req.Msg.Method)
+	return method != message.ACK && method != message.CANCEL
+}
+
+// matchDialog checks request received within dialog. Unknown dialog is answered
+// with 481 and request with lower CSeq with 500 (RFC 3261 12.2.2).
+func (srv *Server) matchDialog(req *message.Message) bool {
+	_, err := srv.dialogs.OnRequest(req)
+	if err == nil {
+		return true
 	}
 
-	return nil
+	// ACK can not be answered
+	if req.Msg.Method == string(message.ACK) {
+		return false
+	}
+
+	var res *message.Message
+	switch err {
+	case dialog.ErrDialogNotFound:
+		res = message.NewResponse(req, 481, "Call/Transaction Does Not Exist")
+	default:
+		res = message.NewResponse(req, 500, "Server Internal Error")
+	}
+	if err := srv.WriteResponse(res); err != nil {
+		slog.Error("respond to request outside dialog failed", "err", err)
+	}
+	return false
 }
 
-// WriteResponse will proxy message to transport layer. Use it in stateless mode
+// WriteResponse sends response through matching server transaction.
+// Response is sent statelessly when there is no transaction. Missing Contact of
+// dialog creating response is set to local address.
 func (srv *Server) WriteResponse(r *message.Message) error {
-	return srv.tp.WriteMsg(r)
+	if r.Msg.Contact == nil && !srv.noDialogs && needsContact(r) {
+		srv.addContact(r)
+	}
+	if tx := srv.tx.FindServerTx(r); tx != nil && !srv.noDialogs {
+		if _, err := srv.dialogs.OnResponse(tx.Request(), r); err != nil {
+			slog.Debug("dialog not created", "err", err)
+		}
+	}
+	return srv.tx.Respond(r)
+}
+
+// needsContact reports if response creates dialog and so must carry Contact (RFC 3261 12.1.1)
+func needsContact(res *message.Message) bool {
+	status := res.Msg.Status
+	switch message.RequestMethod(res.Msg.CSeqMethod) {
+	case message.INVITE:
+		return status > 100 && status < 300
+	case message.SUBSCRIBE, message.REFER, message.UPDATE:
+		return status >= 200 && status < 300
+	}
+	return false
 }
 
-// Close gracefully shutdowns SIP server
+// addContact sets Contact of response to local address it is sent from
+func (srv *Server) addContact(res *message.Message) {
+	host, port, err := srv.tp.LocalAddr(res.Transport, res.Destination)
+	if err != nil {
+		slog.Debug("contact of response not added", "err", err)
+		return
+	}
+	uri := &jartsip.URI{
+		Scheme: "sip",
+		User:   res.Msg.To.Uri.User,
+		Host:   host,
+		Port:   uint16(port),
+	}
+	if res.Transport != transport.TransportUDP {
+		uri.Param = &jartsip.URIParam{Name: "transport", Value: transport.NetworkToLower(res.Transport)}
+	}
+	res.Msg.Contact = &jartsip.Addr{Uri: uri}
+}
+
+// Shutdown stops server gracefully. New requests outside dialog are answered with
+// 503, while pending transactions finish. Ringing INVITEs sent by server are
+// canceled, as they can ring without limit. Once transactions are done or ctx
+// is done, handler contexts are canceled and listeners and connections are closed.
+//
+// Shutdown waits for request handlers, so it must not be called from one. Handler
+// starts it on own goroutine instead, e.g. go srv.Shutdown(ctx).
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.shuttingDown.Store(true)
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+
+	var err error
+	for err == nil {
+		// INVITE reaching Proceeding after previous poll is canceled too
+		srv.tx.CancelInvites()
+		if srv.tx.Pending() == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	srv.Close()
+	return err
+}
+
+// Close stops SIP server immediately. Transactions are terminated, handler contexts
+// canceled and listeners and connections closed. Like Shutdown, it waits for
+// request handlers and must not be called from one.
 func (srv *Server) Close() {
+	srv.shuttingDown.Store(true)
+	srv.cancel()
+	srv.tx.Close()
 	// stop transport layer
 	srv.tp.Close()
 }
 
+// OnResponse adds handler of responses received for requests sent by server,
+// e.g. for logging. Responses of single request are delivered by Request.
+func (srv *Server) OnResponse(handler message.ResponseHandler) {
+	srv.responseHandlers = append(srv.responseHandlers, handler)
+}
+
+// OnStrayResponse registers handler of responses matching no client transaction,
+// e.g. 2xx retransmissions of forked INVITE. They are dropped by default.
+func (srv *Server) OnStrayResponse(handler message.ResponseHandler) {
+	srv.strayHandler = handler
+}
+
+// Routes returns router of requests. Routes can match method, Request-URI,
+// headers and source, OnInvite and the like are shortcuts for method routes.
+// Routes are added before serving.
+func (srv *Server) Routes() *router.Router {
+	return srv.routes
+}
+
+// OnMethod registers request handler of method, including extension methods
+func (srv *Server) OnMethod(method message.RequestMethod, handler message.RequestHandler) {
+	srv.routes.HandleMethod(method, handler)
+}
+
 // OnInvite registers Invite request handler
 func (srv *Server) OnInvite(handler message.RequestHandler) {
-	srv.requestHandlers[message.INVITE] = handler
+	srv.routes.HandleMethod(message.INVITE, handler)
 }
 
 // OnAck registers Ack request handler
 func (srv *Server) OnAck(handler message.RequestHandler) {
-	srv.requestHandlers[message.ACK] = handler
+	srv.routes.HandleMethod(message.ACK, handler)
 }
 
-// OnCancel registers Cancel request handler
+// OnCancel registers handler of CANCEL which terminated pending INVITE. CANCEL
+// is answered by transaction layer, with 481 when no INVITE is pending, so
+// handler is only notified and its response is dropped.
 func (srv *Server) OnCancel(handler message.RequestHandler) {
-	srv.requestHandlers[message.CANCEL] = handler
+	srv.routes.HandleMethod(message.CANCEL, handler)
 }
 
 // OnBye registers Bye request handler
 func (srv *Server) OnBye(handler message.RequestHandler) {
-	srv.requestHandlers[message.BYE] = handler
+	srv.routes.HandleMethod(message.BYE, handler)
 }
 
 // OnRegister registers Register request handler
 func (srv *Server) OnRegister(handler message.RequestHandler) {
-	srv.requestHandlers[message.REGISTER] = handler
+	srv.routes.HandleMethod(message.REGISTER, handler)
 }
 
 // OnOptions registers Options request handler
 func (srv *Server) OnOptions(handler message.RequestHandler) {
-	srv.requestHandlers[message.OPTIONS] = handler
+	srv.routes.HandleMethod(message.OPTIONS, handler)
 }
 
 // OnSubscribe registers Subscribe request handler
 func (srv *Server) OnSubscribe(handler message.RequestHandler) {
-	srv.requestHandlers[message.SUBSCRIBE] = handler
+	srv.routes.HandleMethod(message.SUBSCRIBE, handler)
 }
 
 // OnNotify registers Notify request handler
 func (srv *Server) OnNotify(handler message.RequestHandler) {
-	srv.requestHandlers[message.NOTIFY] = handler
+	srv.routes.HandleMethod(message.NOTIFY, handler)
 }
 
 // OnRefer registers Refer request handler
 func (srv *Server) OnRefer(handler message.RequestHandler) {
-	srv.requestHandlers[message.REFER] = handler
+	srv.routes.HandleMethod(message.REFER, handler)
 }
 
 // OnInfo registers Info request handler
 func (srv *Server) OnInfo(handler message.RequestHandler) {
-	srv.requestHandlers[message.INFO] = handler
+	srv.routes.HandleMethod(message.INFO, handler)
 }
 
 // OnMessage registers Message request handler
 func (srv *Server) OnMessage(handler message.RequestHandler) {
-	srv.requestHandlers[message.MESSAGE] = handler
+	srv.routes.HandleMethod(message.MESSAGE, handler)
 }
 
 // OnPrack registers Prack request handler
 func (srv *Server) OnPrack(handler message.RequestHandler) {
-	srv.requestHandlers[message.PRACK] = handler
+	srv.routes.HandleMethod(message.PRACK, handler)
 }
 
 // OnUpdate registers Update request handler
 func (srv *Server) OnUpdate(handler message.RequestHandler) {
-	srv.requestHandlers[message.UPDATE] = handler
+	srv.routes.HandleMethod(message.UPDATE, handler)
 }
 
 // OnPublish registers Publish request handler
 func (srv *Server) OnPublish(handler message.RequestHandler) {
-	srv.requestHandlers[message.PUBLISH] = handler
-}
-
-func (srv *Server) getHandler(method message.RequestMethod) (handler message.RequestHandler) {
-	handler, ok := srv.requestHandlers[method]
-	if !ok {
-		return srv.defaultUnhandledHandler
-	}
-	return handler
+	srv.routes.HandleMethod(message.PUBLISH, handler)
 }
 
+// defaultRequestMiddleware sets To tag of request outside dialog to tag of its
+// responses, so handlers see tag of dialog they create
 func (srv *Server) defaultRequestMiddleware(req *message.Message) {
-	hTo := req.Msg.To.Copy()
-	hToParam := hTo.Param
-	if hToParam.Get("tag") != nil {
+	if req.GetToTag() != "" {
 		return
 	}
-	hToTagParam := &jartsip.Param{
-		Name:  "tag",
-		Value: jartutil.GenerateTag(),
-	}
-	if hToParam == nil {
-		hToParam = hToTagParam
-	} else {
-		hToParam.Next = hToTagParam
-	}
-	hTo.Param = hToParam
-	req.Msg.To = hTo
+	to := req.Msg.To.Copy()
+	to.Display = req.Msg.To.Display
+	to.Param = &jartsip.Param{Name: "tag", Value: message.ToTag(req), Next: to.Param}
+	req.Msg.To = to
 }
 
-func (srv *Server) defaultResponseMiddleware(res *message.Message) bool {
+// defaultResponseMiddleware sends response returned by handler
+func (srv *Server) defaultResponseMiddleware(res *message.Message) {
 	if res != nil {
 		if err := srv.WriteResponse(res); err != nil {
 			slog.Error("respond failed", "err", err)
 		}
 	}
-	return true
 }
 
-func (srv *Server) defaultUnhandledHandler(req *message.Message) *message.Message {
-	slog.Warn("SIP request handler not found")
-	res := NewResponseFromRequest(req, 405, "Method Not Allowed")
-	res.Msg.Payload = nil
-	if err := srv.WriteResponse(res); err != nil {
-		slog.Error("respond '405 Method Not Allowed' failed", "err", err)
+func (srv *Server) defaultUnhandledHandler(ctx context.Context, req *message.Message) *message.Message {
+	if req.Msg.Method == string(message.ACK) {
+		// ACK of 2xx is not answered, there is nothing to do without handler
+		return nil
 	}
-	return nil
+	slog.Warn("SIP request handler not found")
+	res := message.NewResponse(req, 405, "Method Not Allowed")
+	return res
 }
 
 // ReplaceDefaultRequestMiddlware adds a middleware to preprocessing message
@@ -225,6 +478,40 @@ func (srv *Server) AddRequestMiddleware(f message.RequestMiddleware) {
 	srv.requestMiddlewares = append(srv.requestMiddlewares, f)
 }
 
+// AddResponseMiddleware adds a middleware getting response returned by handler
+// before it is sent. Middleware returning true stops the chain and response is
+// not sent by server.
+func (srv *Server) AddResponseMiddleware(f message.ResponseMiddleware) {
+	srv.responseMiddlewares = append(srv.responseMiddlewares, f)
+}
+
+// Use adds middlewares wrapping handler of every request, including requests
+// without route. Middleware can answer request itself without calling next,
+// e.g. with 403, change request or response, or measure handling. Middleware
+// added first is outermost. Middlewares are added before serving.
+//
+//	srv.Use(middleware.Recover(), middleware.Logging(), middleware.MaxForwards())
+func (srv *Server) Use(middlewares ...message.Middleware) {
+	srv.middlewares = append(srv.middlewares, middlewares...)
+}
+
+// DisableDialogs stops tracking of dialogs and answering 481 to requests of unknown
+// dialog. Proxies forwarding in-dialog requests call it, as they are not part of dialogs.
+func (srv *Server) DisableDialogs() {
+	srv.noDialogs = true
+}
+
+// Dialogs returns dialog manager. Handlers can look up dialog of in-dialog request with Dialogs().Lookup(req)
+func (srv *Server) Dialogs() *dialog.Manager {
+	return srv.dialogs
+}
+
+// TransactionLayer is function to get transaction layer of server.
+// Can be used for changing timers or sending requests statefully
+func (srv *Server) TransactionLayer() *transaction.Layer {
+	return srv.tx
+}
+
 // TransportLayer is function to get transport layer of server
 // Can be used for modifying
 func (srv *Server) TransportLayer() *transport.Layer {
@@ -0,0 +1,255 @@
+package transaction
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shend/simplesip/message"
+)
+
+// ClientTx is INVITE or non-INVITE client transaction
+type ClientTx struct {
+	key      string
+	layer    *Layer
+	request  *message.Message
+	invite   bool
+	reliable bool
+	handler  ResponseHandler
+
+	mu       sync.Mutex
+	state    State
+	interval time.Duration
+	ack      *message.Message
+	// canceled is set once CANCEL of INVITE was sent by layer
+	canceled bool
+
+	// timerA retransmits INVITE, timerE retransmits non-INVITE request
+	timerA Timer
+	timerE Timer
+	// timerB and timerF limit transaction lifetime
+	timerB Timer
+	timerF Timer
+	// timerD and timerK absorb response retransmissions
+	timerD Timer
+	timerK Timer
+	// timerM keeps accepted INVITE transaction for forked 2xx (RFC 6026)
+	timerM Timer
+}
+
+func newClientTx(l *Layer, key string, req *message.Message, handler ResponseHandler) *ClientTx {
+	tx := &ClientTx{
+		key:      key,
+		layer:    l,
+		request:  req,
+		invite:   req.Msg.Method == string(message.INVITE),
+		reliable: IsReliable(req.Transport),
+		handler:  handler,
+	}
+
+	if tx.invite {
+		tx.state = StateCalling
+	} else {
+		tx.state = StateTrying
+	}
+
+	return tx
+}
+
+// Key returns transaction key
+func (tx *ClientTx) Key() string {
+	return tx.key
+}
+
+// Request returns request sent by transaction
+func (tx *ClientTx) Request() *message.Message {
+	return tx.request
+}
+
+// State returns current state of transaction
+func (tx *ClientTx) State() State {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.state
+}
+
+// start sends request and starts timers
+func (tx *ClientTx) start() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.layer.tp.WriteMsg(tx.request); err != nil {
+		tx.state = StateTerminated
+		return err
+	}
+
+	clock := tx.layer.Clock
+	timings := tx.layer.Timings
+	tx.interval = timings.T1
+	if tx.invite {
+		if !tx.reliable {
+			tx.timerA = clock.AfterFunc(tx.interval, tx.retransmit)
+		}
+		tx.timerB = clock.AfterFunc(64*timings.T1, tx.timeout)
+	} else {
+		if !tx.reliable {
+			tx.timerE = clock.AfterFunc(tx.interval, tx.retransmit)
+		}
+		tx.timerF = clock.AfterFunc(64*timings.T1, tx.timeout)
+	}
+
+	return nil
+}
+
+// receive handles response matching transaction
+func (tx *ClientTx) receive(res *message.Message) {
+	tx.mu.Lock()
+	deliver := tx.receiveLocked(res)
+	tx.mu.Unlock()
+
+	if deliver && tx.handler != nil {
+		tx.handler(res, nil)
+	}
+}
+
+func (tx *ClientTx) receiveLocked(res *message.Message) bool {
+	status := res.Msg.Status
+	clock := tx.layer.Clock
+	timings := tx.layer.Timings
+
+	if tx.invite {
+		switch tx.state {
+		case StateCalling, StateProceeding:
+			stopTimer(tx.timerA)
+			stopTimer(tx.timerB)
+			switch {
+			case status < 200:
+				tx.state = StateProceeding
+			case status < 300:
+				tx.state = StateAccepted
+				tx.timerM = clock.AfterFunc(64*timings.T1, tx.Terminate)
+			default:
+				tx.state = StateCompleted
+				tx.ack = newAck(tx.request, res)
+				tx.sendAck()
+				tx.timerD = clock.AfterFunc(tx.wait(TimerD), tx.Terminate)
+			}
+			return true
+		case StateAccepted:
+			// Retransmitted or forked 2xx must reach TU, which sends ACK
+			return status >= 200 && status < 300
+		case StateCompleted:
+			if status >= 300 {
+				tx.sendAck()
+			}
+		}
+		return false
+	}
+
+	switch tx.state {
+	case StateTrying, StateProceeding:
+		if status < 200 {
+			tx.state = StateProceeding
+			return true
+		}
+		stopTimer(tx.timerE)
+		stopTimer(tx.timerF)
+		tx.state = StateCompleted
+		tx.timerK = clock.AfterFunc(tx.wait(timings.T4), tx.Terminate)
+		return true
+	}
+	return false
+}
+
+// Terminate stops all timers and removes transaction from layer
+func (tx *ClientTx) Terminate() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.terminate()
+}
+
+func (tx *ClientTx) terminate() {
+	if tx.state == StateTerminated {
+		return
+	}
+	tx.state = StateTerminated
+	stopTimer(tx.timerA)
+	stopTimer(tx.timerB)
+	stopTimer(tx.timerD)
+	stopTimer(tx.timerE)
+	stopTimer(tx.timerF)
+	stopTimer(tx.timerK)
+	stopTimer(tx.timerM)
+	tx.layer.removeClient(tx)
+}
+
+// fail terminates transaction and reports err to handler
+func (tx *ClientTx) fail(err error) {
+	tx.mu.Lock()
+	if tx.state == StateTerminated {
+		tx.mu.Unlock()
+		return
+	}
+	tx.terminate()
+	tx.mu.Unlock()
+
+	if tx.handler != nil {
+		tx.handler(nil, err)
+	}
+}
+
+func (tx *ClientTx) timeout() {
+	tx.mu.Lock()
+	waiting := tx.state == StateCalling || tx.state == StateTrying || tx.state == StateProceeding
+	tx.mu.Unlock()
+
+	if waiting {
+		slog.Debug("transaction timed out", slog.String("transaction", tx.key))
+		tx.fail(ErrTimeout)
+	}
+}
+
+func (tx *ClientTx) retransmit() {
+	tx.mu.Lock()
+	var err error
+	switch tx.state {
+	case StateCalling:
+		if err = tx.layer.tp.WriteMsg(tx.request); err == nil {
+			tx.interval *= 2
+			tx.timerA = tx.layer.Clock.AfterFunc(tx.interval, tx.retransmit)
+		}
+	case StateTrying, StateProceeding:
+		if tx.invite {
+			break
+		}
+		if err = tx.layer.tp.WriteMsg(tx.request); err == nil {
+			// In Proceeding state request is retransmitted every T2
+			if tx.state == StateProceeding {
+				tx.interval = tx.layer.Timings.T2
+			} else {
+				tx.interval = min(2*tx.interval, tx.layer.Timings.T2)
+			}
+			tx.timerE = tx.layer.Clock.AfterFunc(tx.interval, tx.retransmit)
+		}
+	}
+	tx.mu.Unlock()
+
+	if err != nil {
+		slog.Error("transaction retransmit failed", "err", err, "transaction", tx.key)
+		tx.fail(err)
+	}
+}
+
+func (tx *ClientTx) sendAck() {
+	if err := tx.layer.tp.WriteMsg(tx.ack); err != nil {
+		slog.Error("transaction send ACK failed", "err", err, "transaction", tx.key)
+	}
+}
+
+// wait returns d for unreliable transports and zero for reliable ones
+func (tx *ClientTx) wait(d time.Duration) time.Duration {
+	if tx.reliable {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,218 @@
+package transaction
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/shend/simplesip/message"
+)
+
+func TestClientTxTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    message.RequestMethod
+		transport string
+		// sends are times request is written at, retransmissions included
+		sends []time.Duration
+	}{
+		{
+			// Timer A doubles from T1, Timer B fires at 64*T1
+			name:      "INVITE over UDP",
+			method:    message.INVITE,
+			transport: "UDP",
+			sends:     seconds(0, 0.5, 1.5, 3.5, 7.5, 15.5, 31.5),
+		},
+		{
+			name:      "INVITE over TCP",
+			method:    message.INVITE,
+			transport: "TCP",
+			sends:     seconds(0),
+		},
+		{
+			// Timer E doubles from T1 up to T2, Timer F fires at 64*T1
+			name:      "non-INVITE over UDP",
+			method:    message.OPTIONS,
+			transport: "UDP",
+			sends:     seconds(0, 0.5, 1.5, 3.5, 7.5, 11.5, 15.5, 19.5, 23.5, 27.5, 31.5),
+		},
+		{
+			name:      "non-INVITE over TCP",
+			method:    message.OPTIONS,
+			transport: "TCP",
+			sends:     seconds(0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock, tp := newTestLayer()
+			var errs []error
+			req := newTestRequest(tt.method, tt.transport, "")
+			if _, err := l.Request(req, func(res *message.Message, err error) { errs = append(errs, err) }); err != nil {
+				t.Fatal(err)
+			}
+
+			timerB := 64 * l.Timings.T1
+			clock.Advance(timerB - time.Millisecond)
+			if len(errs) != 0 {
+				t.Fatalf("transaction failed before 64*T1: %v", errs)
+			}
+			clock.Advance(time.Millisecond)
+
+			if got := tp.times(isMethod(tt.method)); !slices.Equal(got, tt.sends) {
+				t.Errorf("request sent at %v, want %v", got, tt.sends)
+			}
+			if len(errs) != 1 || !errors.Is(errs[0], ErrTimeout) {
+				t.Errorf("handler got %v, want single ErrTimeout", errs)
+			}
+			if l.Len() != 0 {
+				t.Errorf("%d transactions left", l.Len())
+			}
+		})
+	}
+}
+
+func TestClientTxFinalResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    message.RequestMethod
+		transport string
+		status    int
+		// wait is time transaction absorbs retransmitted responses, Timer D or K
+		wait time.Duration
+		// acks are times ACK is written at
+		acks []time.Duration
+	}{
+		{
+			name:      "INVITE rejected over UDP",
+			method:    message.INVITE,
+			transport: "UDP",
+			status:    486,
+			wait:      TimerD,
+			acks:      seconds(1, 2),
+		},
+		{
+			name:      "INVITE rejected over TCP",
+			method:    message.INVITE,
+			transport: "TCP",
+			status:    486,
+			acks:      seconds(1),
+		},
+		{
+			name:      "non-INVITE over UDP",
+			method:    message.OPTIONS,
+			transport: "UDP",
+			status:    200,
+			wait:      DefaultTimings.T4,
+		},
+		{
+			name:      "non-INVITE over TCP",
+			method:    message.OPTIONS,
+			transport: "TCP",
+			status:    200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock, tp := newTestLayer()
+			var delivered []int
+			req := newTestRequest(tt.method, tt.transport, "")
+			tx, err := l.Request(req, func(res *message.Message, err error) {
+				if err != nil {
+					t.Errorf("handler got error: %v", err)
+					return
+				}
+				delivered = append(delivered, res.Msg.Status)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clock.Advance(time.Second)
+			res := message.NewResponse(req, tt.status, "")
+			l.HandleMessage(res)
+			sends := len(tp.times(isMethod(tt.method)))
+
+			// Retransmitted final response is absorbed, ACK is sent again
+			if tt.wait > 0 {
+				clock.Advance(time.Second)
+				l.HandleMessage(res)
+			}
+
+			if got := tp.times(isMethod(tt.method)); len(got) != sends {
+				t.Errorf("request retransmitted after final response at %v", got[sends:])
+			}
+			if !slices.Equal(delivered, []int{tt.status}) {
+				t.Errorf("handler got %v, want %d once", delivered, tt.status)
+			}
+			if got := tp.times(isMethod(message.ACK)); !slices.Equal(got, tt.acks) {
+				t.Errorf("ACK sent at %v, want %v", got, tt.acks)
+			}
+
+			if tt.wait > 0 {
+				clock.Advance(tt.wait - time.Second - time.Millisecond)
+				if tx.State() != StateCompleted {
+					t.Errorf("state %s before Timer D or K, want Completed", tx.State())
+				}
+			}
+			clock.Advance(time.Second + time.Millisecond)
+			if tx.State() != StateTerminated || l.Len() != 0 {
+				t.Errorf("state %s with %d transactions after Timer D or K, want Terminated", tx.State(), l.Len())
+			}
+		})
+	}
+}
+
+func TestClientTxProvisional(t *testing.T) {
+	l, clock, tp := newTestLayer()
+	req := newTestRequest(message.OPTIONS, "UDP", "")
+	if _, err := l.Request(req, func(res *message.Message, err error) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Provisional response slows Timer E down to T2
+	clock.Advance(600 * time.Millisecond)
+	l.HandleMessage(message.NewResponse(req, 100, ""))
+	clock.Advance(10 * time.Second)
+
+	want := seconds(0, 0.5, 1.5, 5.5, 9.5)
+	if got := tp.times(isMethod(message.OPTIONS)); !slices.Equal(got, want) {
+		t.Errorf("request sent at %v, want %v", got, want)
+	}
+}
+
+func TestCancelInvites(t *testing.T) {
+	l, clock, tp := newTestLayer()
+	req := newTestRequest(message.INVITE, "UDP", "")
+	if _, err := l.Request(req, func(res *message.Message, err error) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// CANCEL is not sent before provisional response
+	l.CancelInvites()
+	if got := tp.times(isMethod(message.CANCEL)); len(got) != 0 {
+		t.Fatalf("CANCEL sent in Calling state at %v", got)
+	}
+	if n := l.Pending(); n != 1 {
+		t.Errorf("%d pending transactions in Calling state, want 1", n)
+	}
+
+	clock.Advance(time.Second)
+	l.HandleMessage(message.NewResponse(req, 180, ""))
+	if n := l.Pending(); n != 0 {
+		t.Errorf("%d pending transactions while ringing, want 0", n)
+	}
+
+	l.CancelInvites()
+	l.CancelInvites()
+	if got := tp.times(isMethod(message.CANCEL)); !slices.Equal(got, seconds(1)) {
+		t.Errorf("CANCEL sent at %v, want once at 1s", got)
+	}
+	// Shutdown waits for CANCEL transaction
+	if n := l.Pending(); n != 1 {
+		t.Errorf("%d pending transactions after CANCEL, want 1", n)
+	}
+}
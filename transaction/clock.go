@@ -0,0 +1,32 @@
+package transaction
+
+import "time"
+
+// Timer is a stoppable timer created by Clock
+type Timer interface {
+	Stop() bool
+}
+
+// Clock abstracts time, so tests can inject fake clock and fire timers manually
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// RealClock is Clock based on time package
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// stopTimer stops timer if it is set
+func stopTimer(t Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
@@ -0,0 +1,350 @@
+package transaction
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/shend/simplesip/message"
+)
+
+// Layer keeps client and server transactions. It absorbs retransmissions and
+// passes only new requests and unmatched responses to transaction user.
+type Layer struct {
+	tp Transport
+
+	// Timings can be overridden before serving
+	Timings Timings
+	// Clock can be overridden before serving, e.g. with fake clock in tests
+	Clock Clock
+
+	mu       sync.RWMutex
+	servers  map[string]*ServerTx
+	clients  map[string]*ClientTx
+	accepted map[string]*ServerTx
+
+	requestHandler   func(req *message.Message)
+	cancelHandler    func(cancel *message.Message)
+	responseHandler  func(res *message.Message)
+	unmatchedHandler func(res *message.Message)
+}
+
+// NewLayer creates transaction layer sending messages through tp
+func NewLayer(tp Transport) *Layer {
+	return &Layer{
+		tp:       tp,
+		Timings:  DefaultTimings,
+		Clock:    RealClock{},
+		servers:  make(map[string]*ServerTx),
+		clients:  make(map[string]*ClientTx),
+		accepted: make(map[string]*ServerTx),
+	}
+}
+
+// OnRequest sets handler of new requests
+func (l *Layer) OnRequest(h func(req *message.Message)) {
+	l.requestHandler = h
+}
+
+// OnCancel sets handler of CANCEL requests which terminated pending INVITE.
+// CANCEL and INVITE are already answered by layer when it is called.
+func (l *Layer) OnCancel(h func(cancel *message.Message)) {
+	l.cancelHandler = h
+}
+
+// OnResponse sets handler of responses matching client transaction. It is called
+// after transaction handled response, retransmissions included.
+func (l *Layer) OnResponse(h func(res *message.Message)) {
+	l.responseHandler = h
+}
+
+// OnUnmatchedResponse sets handler of responses which match no client transaction
+func (l *Layer) OnUnmatchedResponse(h func(res *message.Message)) {
+	l.unmatchedHandler = h
+}
+
+// HandleMessage is called by transport layer on every received message
+func (l *Layer) HandleMessage(msg *message.Message) {
+	if msg.Msg.IsResponse() {
+		l.handleResponse(msg)
+		return
+	}
+	l.handleRequest(msg)
+}
+
+func (l *Layer) handleRequest(req *message.Message) {
+	key, err := serverKey(req)
+	if err != nil {
+		slog.Debug("can not match request to transaction", "err", err)
+		return
+	}
+
+	l.mu.Lock()
+	tx, ok := l.servers[key]
+	if !ok && req.Msg.Method != string(message.ACK) {
+		tx = newServerTx(l, key, req)
+		l.servers[key] = tx
+	}
+	l.mu.Unlock()
+
+	if ok {
+		tx.receive(req)
+		return
+	}
+
+	switch req.Msg.Method {
+	case string(message.ACK):
+		// ACK for 2xx is new transaction and goes to TU
+		l.mu.RLock()
+		atx := l.accepted[ackKey(req)]
+		l.mu.RUnlock()
+		if atx != nil {
+			atx.ackReceived()
+		}
+	case string(message.CANCEL):
+		// CANCEL is answered by layer and never reaches request handler
+		l.handleCancel(tx, req)
+		return
+	}
+
+	if l.requestHandler != nil {
+		l.requestHandler(req)
+	}
+}
+
+// handleCancel answers CANCEL (RFC 3261 9.2). CANCEL matching INVITE transaction
+// gets 200 and pending INVITE is terminated with 487, cancel handler is called then.
+// CANCEL matching no transaction gets 481.
+func (l *Layer) handleCancel(tx *ServerTx, cancel *message.Message) {
+	invite := cancel.Clone()
+	invite.Msg.Method = string(message.INVITE)
+	var itx *ServerTx
+	if key, err := serverKey(&invite); err == nil {
+		l.mu.RLock()
+		itx = l.servers[key]
+		l.mu.RUnlock()
+	}
+	if itx == nil {
+		if err := tx.Respond(message.NewResponse(cancel, 481, "Call/Transaction Does Not Exist")); err != nil {
+			slog.Error("respond '481 Call/Transaction Does Not Exist' failed", "err", err)
+		}
+		return
+	}
+
+	if err := tx.Respond(message.NewResponse(cancel, 200, "OK")); err != nil {
+		slog.Error("respond CANCEL failed", "err", err)
+	}
+	// INVITE which already got final response is left alone
+	if itx.State() != StateProceeding {
+		return
+	}
+	if err := itx.Respond(message.NewResponse(itx.request, 487, "Request Terminated")); err != nil {
+		if !errors.Is(err, ErrTerminated) {
+			slog.Error("respond '487 Request Terminated' failed", "err", err)
+		}
+		return
+	}
+	if l.cancelHandler != nil {
+		l.cancelHandler(cancel)
+	}
+}
+
+func (l *Layer) handleResponse(res *message.Message) {
+	key, err := clientKey(res)
+	if err != nil {
+		slog.Debug("can not match response to transaction", "err", err)
+		return
+	}
+
+	l.mu.RLock()
+	tx := l.clients[key]
+	l.mu.RUnlock()
+
+	if tx != nil {
+		tx.receive(res)
+		if l.responseHandler != nil {
+			l.responseHandler(res)
+		}
+		return
+	}
+
+	if l.unmatchedHandler != nil {
+		l.unmatchedHandler(res)
+	}
+}
+
+// Respond sends response through matching server transaction.
+// Response is sent statelessly when no transaction matches.
+func (l *Layer) Respond(res *message.Message) error {
+	if tx := l.FindServerTx(res); tx != nil {
+		return tx.Respond(res)
+	}
+	return l.tp.WriteMsg(res)
+}
+
+// FindServerTx returns server transaction of request or response, nil if none matches
+func (l *Layer) FindServerTx(msg *message.Message) *ServerTx {
+	key, err := serverKey(msg)
+	if err != nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.servers[key]
+}
+
+// Request sends request through new client transaction. Handler is called
+// for every response passed by transaction and on timeout or transport failure.
+// Via branch is generated when request has none.
+func (l *Layer) Request(req *message.Message, handler ResponseHandler) (*ClientTx, error) {
+	if req.Msg.Via == nil {
+		return nil, ErrMissingVia
+	}
+	if req.GetBranch() == "" {
+		req.Msg.Via.Param = message.RemoveParam(req.Msg.Via.Param, "branch")
+		req.Msg.Via = req.Msg.Via.Branch()
+	}
+	req.Msg.CSeqMethod = req.Msg.Method
+
+	key, err := clientKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newClientTx(l, key, req, handler)
+
+	l.mu.Lock()
+	if _, ok := l.clients[key]; ok {
+		l.mu.Unlock()
+		return nil, ErrTransactionID
+	}
+	l.clients[key] = tx
+	l.mu.Unlock()
+
+	if err := tx.start(); err != nil {
+		l.removeClient(tx)
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// Len returns number of active server and client transactions
+func (l *Layer) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.servers) + len(l.clients)
+}
+
+// Pending returns number of transactions without final response yet. INVITE
+// client transactions in Proceeding state are left out, as ringing can last
+// without limit; CancelInvites stops them.
+func (l *Layer) Pending() int {
+	l.mu.RLock()
+	servers := make([]*ServerTx, 0, len(l.servers))
+	for _, tx := range l.servers {
+		servers = append(servers, tx)
+	}
+	clients := make([]*ClientTx, 0, len(l.clients))
+	for _, tx := range l.clients {
+		clients = append(clients, tx)
+	}
+	l.mu.RUnlock()
+
+	n := 0
+	for _, tx := range servers {
+		switch tx.State() {
+		case StateTrying, StateProceeding:
+			n++
+		}
+	}
+	for _, tx := range clients {
+		switch tx.State() {
+		case StateProceeding:
+			if !tx.invite {
+				n++
+			}
+		case StateCalling, StateTrying:
+			n++
+		}
+	}
+	return n
+}
+
+// CancelInvites sends CANCEL for INVITE client transactions in Proceeding state,
+// e.g. before shutdown. CANCEL is sent once per transaction, INVITE still in
+// Calling state is canceled by later call once provisional response arrives
+// (RFC 3261 9.1).
+func (l *Layer) CancelInvites() {
+	l.mu.RLock()
+	invites := make([]*ClientTx, 0, len(l.clients))
+	for _, tx := range l.clients {
+		if tx.invite {
+			invites = append(invites, tx)
+		}
+	}
+	l.mu.RUnlock()
+
+	for _, tx := range invites {
+		tx.mu.Lock()
+		cancel := tx.state == StateProceeding && !tx.canceled
+		if cancel {
+			tx.canceled = true
+		}
+		tx.mu.Unlock()
+		if !cancel {
+			continue
+		}
+		// CANCEL can already be sent by TU, e.g. by proxy canceling branches
+		if _, err := l.Request(NewCancel(tx.request), nil); err != nil && !errors.Is(err, ErrTransactionID) {
+			slog.Error("send CANCEL failed", "err", err, "transaction", tx.key)
+		}
+	}
+}
+
+// Close terminates all transactions
+func (l *Layer) Close() {
+	l.mu.RLock()
+	servers := make([]*ServerTx, 0, len(l.servers))
+	for _, tx := range l.servers {
+		servers = append(servers, tx)
+	}
+	clients := make([]*ClientTx, 0, len(l.clients))
+	for _, tx := range l.clients {
+		clients = append(clients, tx)
+	}
+	l.mu.RUnlock()
+
+	for _, tx := range servers {
+		tx.Terminate()
+	}
+	for _, tx := range clients {
+		tx.fail(ErrTerminated)
+	}
+}
+
+func (l *Layer) addAccepted(tx *ServerTx) {
+	l.mu.Lock()
+	l.accepted[ackKey(tx.request)] = tx
+	l.mu.Unlock()
+}
+
+func (l *Layer) removeServer(tx *ServerTx) {
+	l.mu.Lock()
+	if l.servers[tx.key] == tx {
+		delete(l.servers, tx.key)
+	}
+	akey := ackKey(tx.request)
+	if l.accepted[akey] == tx {
+		delete(l.accepted, akey)
+	}
+	l.mu.Unlock()
+}
+
+func (l *Layer) removeClient(tx *ClientTx) {
+	l.mu.Lock()
+	if l.clients[tx.key] == tx {
+		delete(l.clients, tx.key)
+	}
+	l.mu.Unlock()
+}
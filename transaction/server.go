@@ -0,0 +1,241 @@
+package transaction
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shend/simplesip/message"
+)
+
+// trying100Delay is time after which INVITE server transaction answers 100 Trying
+// if TU did not respond yet (RFC 3261 17.2.1)
+const trying100Delay = 200 * time.Millisecond
+
+// ServerTx is INVITE or non-INVITE server transaction
+type ServerTx struct {
+	key      string
+	layer    *Layer
+	request  *message.Message
+	invite   bool
+	reliable bool
+	proxied  bool
+
+	mu       sync.Mutex
+	state    State
+	last     *message.Message
+	interval time.Duration
+
+	timerTrying Timer
+	// timerG retransmits final response of INVITE
+	timerG Timer
+	// timerH waits for ACK
+	timerH Timer
+	// timerI absorbs ACK retransmissions
+	timerI Timer
+	// timerJ absorbs non-INVITE request retransmissions
+	timerJ Timer
+	// timerL keeps accepted INVITE transaction for 2xx retransmissions (RFC 6026)
+	timerL Timer
+}
+
+func newServerTx(l *Layer, key string, req *message.Message) *ServerTx {
+	tx := &ServerTx{
+		key:      key,
+		layer:    l,
+		request:  req,
+		invite:   req.Msg.Method == string(message.INVITE),
+		reliable: IsReliable(req.Transport),
+	}
+
+	if tx.invite {
+		tx.state = StateProceeding
+		tx.timerTrying = l.Clock.AfterFunc(trying100Delay, tx.sendTrying)
+	} else {
+		tx.state = StateTrying
+	}
+
+	return tx
+}
+
+// Key returns transaction key
+func (tx *ServerTx) Key() string {
+	return tx.key
+}
+
+// Request returns request which created transaction
+func (tx *ServerTx) Request() *message.Message {
+	return tx.request
+}
+
+// State returns current state of transaction
+func (tx *ServerTx) State() State {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.state
+}
+
+// receive handles retransmitted request or ACK matching transaction
+func (tx *ServerTx) receive(req *message.Message) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if req.Msg.Method == string(message.ACK) {
+		if tx.state == StateCompleted {
+			stopTimer(tx.timerG)
+			stopTimer(tx.timerH)
+			tx.state = StateConfirmed
+			tx.timerI = tx.layer.Clock.AfterFunc(tx.timeout(tx.layer.Timings.T4), tx.Terminate)
+		}
+		return
+	}
+
+	switch tx.state {
+	case StateProceeding, StateCompleted:
+		// Request retransmission, resend last response
+		if tx.last != nil {
+			tx.send(tx.last)
+		}
+	}
+}
+
+// Respond sends response through transaction. Retransmissions are handled by transaction.
+func (tx *ServerTx) Respond(res *message.Message) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	status := res.Msg.Status
+	switch tx.state {
+	case StateTrying, StateProceeding:
+	case StateAccepted:
+		// Additional 2xx can still be sent by TU
+		if status < 200 || status >= 300 {
+			return ErrTerminated
+		}
+	default:
+		return ErrTerminated
+	}
+
+	stopTimer(tx.timerTrying)
+	tx.last = res
+	if err := tx.send(res); err != nil {
+		tx.terminate()
+		return err
+	}
+
+	if status < 200 {
+		tx.state = StateProceeding
+		return nil
+	}
+
+	if tx.invite {
+		if status < 300 {
+			if tx.state != StateAccepted {
+				tx.state = StateAccepted
+				tx.layer.addAccepted(tx)
+				tx.timerL = tx.layer.Clock.AfterFunc(64*tx.layer.Timings.T1, tx.Terminate)
+			}
+			// UAS core retransmits 2xx until ACK arrives (RFC 3261 13.3.1.4)
+			if !tx.reliable && !tx.proxied {
+				stopTimer(tx.timerG)
+				tx.interval = tx.layer.Timings.T1
+				tx.timerG = tx.layer.Clock.AfterFunc(tx.interval, tx.retransmit)
+			}
+			return nil
+		}
+
+		tx.state = StateCompleted
+		if !tx.reliable {
+			tx.interval = tx.layer.Timings.T1
+			tx.timerG = tx.layer.Clock.AfterFunc(tx.interval, tx.retransmit)
+		}
+		tx.timerH = tx.layer.Clock.AfterFunc(64*tx.layer.Timings.T1, tx.ackTimeout)
+		return nil
+	}
+
+	tx.state = StateCompleted
+	tx.timerJ = tx.layer.Clock.AfterFunc(tx.timeout(64*tx.layer.Timings.T1), tx.Terminate)
+	return nil
+}
+
+// MarkProxied tells transaction its request is forwarded by stateful proxy.
+// 2xx is then sent once, as its retransmissions come from downstream (RFC 3261 16.7).
+func (tx *ServerTx) MarkProxied() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.proxied = true
+}
+
+// ackReceived stops 2xx retransmissions once ACK for 2xx was received
+func (tx *ServerTx) ackReceived() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	stopTimer(tx.timerG)
+}
+
+// Terminate stops all timers and removes transaction from layer
+func (tx *ServerTx) Terminate() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.terminate()
+}
+
+func (tx *ServerTx) terminate() {
+	if tx.state == StateTerminated {
+		return
+	}
+	tx.state = StateTerminated
+	stopTimer(tx.timerTrying)
+	stopTimer(tx.timerG)
+	stopTimer(tx.timerH)
+	stopTimer(tx.timerI)
+	stopTimer(tx.timerJ)
+	stopTimer(tx.timerL)
+	tx.layer.removeServer(tx)
+}
+
+func (tx *ServerTx) sendTrying() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.state != StateProceeding || tx.last != nil {
+		return
+	}
+	res := message.NewResponse(tx.request, 100, "Trying")
+	tx.last = res
+	tx.send(res)
+}
+
+func (tx *ServerTx) retransmit() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.state != StateCompleted && tx.state != StateAccepted {
+		return
+	}
+	if err := tx.send(tx.last); err != nil {
+		tx.terminate()
+		return
+	}
+	tx.interval = min(2*tx.interval, tx.layer.Timings.T2)
+	tx.timerG = tx.layer.Clock.AfterFunc(tx.interval, tx.retransmit)
+}
+
+func (tx *ServerTx) ackTimeout() {
+	slog.Debug("ACK was not received", slog.String("transaction", tx.key))
+	tx.Terminate()
+}
+
+// timeout returns d for unreliable transports and zero for reliable ones
+func (tx *ServerTx) timeout(d time.Duration) time.Duration {
+	if tx.reliable {
+		return 0
+	}
+	return d
+}
+
+func (tx *ServerTx) send(res *message.Message) error {
+	if err := tx.layer.tp.WriteMsg(res); err != nil {
+		slog.Error("transaction send response failed", "err", err, "transaction", tx.key)
+		return err
+	}
+	return nil
+}
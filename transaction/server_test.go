@@ -0,0 +1,167 @@
+package transaction
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/shend/simplesip/message"
+)
+
+func TestServerTxRejectedInvite(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		// ack is time ACK arrives at, 0 for none
+		ack time.Duration
+		// responses are times 486 is written at, retransmissions included
+		responses []time.Duration
+		// end is time transaction terminates at, by Timer H or Timer I
+		end time.Duration
+	}{
+		{
+			// Timer G doubles from T1 up to T2 until Timer H fires at 64*T1
+			name:      "no ACK over UDP",
+			transport: "UDP",
+			responses: seconds(0, 0.5, 1.5, 3.5, 7.5, 11.5, 15.5, 19.5, 23.5, 27.5, 31.5),
+			end:       32 * time.Second,
+		},
+		{
+			name:      "no ACK over TCP",
+			transport: "TCP",
+			responses: seconds(0),
+			end:       32 * time.Second,
+		},
+		{
+			// ACK stops Timer G, Timer I absorbs ACK retransmissions for T4
+			name:      "ACK over UDP",
+			transport: "UDP",
+			ack:       2 * time.Second,
+			responses: seconds(0, 0.5, 1.5),
+			end:       7 * time.Second,
+		},
+		{
+			name:      "ACK over TCP",
+			transport: "TCP",
+			ack:       2 * time.Second,
+			responses: seconds(0),
+			end:       2 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock, tp := newTestLayer()
+			invite := newTestRequest(message.INVITE, tt.transport, MagicCookie+"inv1")
+			l.HandleMessage(invite)
+			tx := l.FindServerTx(invite)
+			if err := tx.Respond(message.NewResponse(invite, 486, "")); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.ack > 0 {
+				clock.Advance(tt.ack)
+				ack := newTestRequest(message.ACK, tt.transport, MagicCookie+"inv1")
+				l.HandleMessage(ack)
+				clock.Advance(0)
+				if tt.end > tt.ack && tx.State() != StateConfirmed {
+					t.Errorf("state %s after ACK, want Confirmed", tx.State())
+				}
+			}
+
+			if wait := tt.end - clock.elapsed(); wait > 0 {
+				clock.Advance(wait - time.Millisecond)
+				if tx.State() == StateTerminated {
+					t.Errorf("transaction terminated before %v", tt.end)
+				}
+				clock.Advance(time.Millisecond)
+			}
+			if tx.State() != StateTerminated || l.Len() != 0 {
+				t.Errorf("state %s with %d transactions at %v, want Terminated", tx.State(), l.Len(), tt.end)
+			}
+
+			if got := tp.times(isResponse(486, message.INVITE)); !slices.Equal(got, tt.responses) {
+				t.Errorf("486 sent at %v, want %v", got, tt.responses)
+			}
+		})
+	}
+}
+
+func TestServerTxRetransmission(t *testing.T) {
+	tests := []struct {
+		name   string
+		method message.RequestMethod
+		// status is response of TU, 0 when TU does not respond
+		status int
+		// wantStatus is response resent to retransmitted request
+		wantStatus int
+	}{
+		{name: "INVITE before response", method: message.INVITE, wantStatus: 100},
+		{name: "INVITE after provisional", method: message.INVITE, status: 180, wantStatus: 180},
+		{name: "INVITE after final", method: message.INVITE, status: 486, wantStatus: 486},
+		{name: "non-INVITE after provisional", method: message.OPTIONS, status: 100, wantStatus: 100},
+		{name: "non-INVITE after final", method: message.OPTIONS, status: 200, wantStatus: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock, tp := newTestLayer()
+			var requests int
+			l.OnRequest(func(req *message.Message) { requests++ })
+
+			req := newTestRequest(tt.method, "UDP", MagicCookie+"req1")
+			l.HandleMessage(req)
+			if tt.status != 0 {
+				if err := l.Respond(message.NewResponse(req, tt.status, "")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// INVITE server transaction answers 100 Trying when TU is slow.
+			// Retransmitted request arrives before Timer G.
+			clock.Advance(300 * time.Millisecond)
+			sent := len(tp.times(isResponse(tt.wantStatus, tt.method)))
+
+			l.HandleMessage(newTestRequest(tt.method, "UDP", MagicCookie+"req1"))
+
+			if requests != 1 {
+				t.Errorf("request handler got %d requests, want 1", requests)
+			}
+			if got := len(tp.times(isResponse(tt.wantStatus, tt.method))); got != sent+1 || sent != 1 {
+				t.Errorf("%d sent %d times, then %d times after retransmission", tt.wantStatus, sent, got)
+			}
+		})
+	}
+}
+
+func TestServerTxTimerJ(t *testing.T) {
+	tests := []struct {
+		transport string
+		wait      time.Duration
+	}{
+		{transport: "UDP", wait: 64 * DefaultTimings.T1},
+		{transport: "TCP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.transport, func(t *testing.T) {
+			l, clock, _ := newTestLayer()
+			req := newTestRequest(message.OPTIONS, tt.transport, MagicCookie+"req1")
+			l.HandleMessage(req)
+			tx := l.FindServerTx(req)
+			if err := tx.Respond(message.NewResponse(req, 200, "")); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wait > 0 {
+				clock.Advance(tt.wait - time.Millisecond)
+				if tx.State() != StateCompleted {
+					t.Errorf("state %s before Timer J, want Completed", tx.State())
+				}
+			}
+			clock.Advance(time.Millisecond)
+			if tx.State() != StateTerminated || l.Len() != 0 {
+				t.Errorf("state %s with %d transactions after Timer J, want Terminated", tx.State(), l.Len())
+			}
+		})
+	}
+}
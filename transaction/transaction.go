@@ -0,0 +1,195 @@
+package transaction
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// MagicCookie starts every RFC 3261 compliant branch
+const MagicCookie = "z9hG4bK"
+
+var (
+	ErrTimeout       = errors.New("transaction timed out")
+	ErrTerminated    = errors.New("transaction terminated")
+	ErrMissingVia    = errors.New("missing Via header")
+	ErrTransactionID = errors.New("transaction already exists")
+)
+
+// State of transaction state machine
+type State int
+
+const (
+	StateCalling State = iota
+	StateTrying
+	StateProceeding
+	StateAccepted
+	StateCompleted
+	StateConfirmed
+	StateTerminated
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCalling:
+		return "Calling"
+	case StateTrying:
+		return "Trying"
+	case StateProceeding:
+		return "Proceeding"
+	case StateAccepted:
+		return "Accepted"
+	case StateCompleted:
+		return "Completed"
+	case StateConfirmed:
+		return "Confirmed"
+	case StateTerminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+// Timings are base timer values of RFC 3261 section 17
+type Timings struct {
+	// T1 is RTT estimate
+	T1 time.Duration
+	// T2 is maximum retransmit interval for non-INVITE requests and INVITE responses
+	T2 time.Duration
+	// T4 is maximum duration a message will remain in the network
+	T4 time.Duration
+}
+
+// DefaultTimings are values recommended by RFC 3261
+var DefaultTimings = Timings{
+	T1: 500 * time.Millisecond,
+	T2: 4 * time.Second,
+	T4: 5 * time.Second,
+}
+
+// TimerD is recommended wait time for response retransmissions over unreliable transport
+const TimerD = 32 * time.Second
+
+// Transport sends messages to network. transport.Layer implements it
+type Transport interface {
+	WriteMsg(msg *message.Message) error
+}
+
+// ResponseHandler receives responses of client transaction. It is called with
+// err set when transaction timed out or failed on transport.
+type ResponseHandler func(res *message.Message, err error)
+
+// IsReliable reports if transport guarantees delivery, so no retransmissions are needed
+func IsReliable(transport string) bool {
+	return !strings.EqualFold(transport, "UDP")
+}
+
+// sentBy returns host:port of Via
+func sentBy(via *sip.Via) string {
+	port := via.Port
+	if port == 0 {
+		port = 5060
+	}
+	return via.Host + ":" + strconv.Itoa(int(port))
+}
+
+// serverKey makes server transaction key of request or response (RFC 3261 17.2.3)
+func serverKey(msg *message.Message) (string, error) {
+	via := msg.Msg.Via
+	if via == nil {
+		return "", ErrMissingVia
+	}
+
+	method := msg.Msg.Method
+	if msg.Msg.IsResponse() {
+		method = msg.Msg.CSeqMethod
+	}
+	if method == string(message.ACK) {
+		method = string(message.INVITE)
+	}
+
+	branch := msg.GetBranch()
+	if strings.HasPrefix(branch, MagicCookie) {
+		return strings.Join([]string{branch, sentBy(via), method}, "|"), nil
+	}
+
+	// RFC 2543 compatible matching
+	return strings.Join([]string{
+		msg.GetCallID(),
+		strconv.Itoa(msg.Msg.CSeq),
+		msg.GetFromTag(),
+		sentBy(via),
+		branch,
+		method,
+	}, "|"), nil
+}
+
+// clientKey makes client transaction key of request or response (RFC 3261 17.1.3)
+func clientKey(msg *message.Message) (string, error) {
+	if msg.Msg.Via == nil {
+		return "", ErrMissingVia
+	}
+
+	method := msg.Msg.Method
+	if msg.Msg.IsResponse() {
+		method = msg.Msg.CSeqMethod
+	}
+
+	return msg.GetBranch() + "|" + method, nil
+}
+
+// ackKey identifies ACK of 2xx response which creates its own transaction
+func ackKey(msg *message.Message) string {
+	return strings.Join([]string{msg.GetCallID(), strconv.Itoa(msg.Msg.CSeq), msg.GetFromTag()}, "|")
+}
+
+// NewCancel creates CANCEL request for INVITE as described in RFC 3261 9.1
+func NewCancel(invite *message.Message) *message.Message {
+	req := invite.Msg
+	cancel := &sip.Msg{
+		Method:     string(message.CANCEL),
+		Request:    req.Request.Copy(),
+		From:       req.From.Copy(),
+		To:         req.To.Copy(),
+		Via:        req.Via.Detach(),
+		Route:      req.Route.Copy(),
+		CallID:     req.CallID,
+		CSeq:       req.CSeq,
+		CSeqMethod: string(message.CANCEL),
+	}
+
+	return &message.Message{
+		Msg:         cancel,
+		Transport:   invite.Transport,
+		Source:      invite.Source,
+		Destination: invite.Destination,
+	}
+}
+
+// newAck creates ACK for non 2xx final response (RFC 3261 17.1.1.3)
+func newAck(invite *message.Message, res *message.Message) *message.Message {
+	req := invite.Msg
+	ack := &sip.Msg{
+		Method:     string(message.ACK),
+		Request:    req.Request.Copy(),
+		From:       req.From.Copy(),
+		To:         res.Msg.To.Copy(),
+		Via:        req.Via.Detach(),
+		Route:      req.Route.Copy(),
+		CallID:     req.CallID,
+		CSeq:       req.CSeq,
+		CSeqMethod: string(message.ACK),
+	}
+
+	return &message.Message{
+		Msg:         ack,
+		Transport:   invite.Transport,
+		Source:      invite.Source,
+		Destination: invite.Destination,
+	}
+}
@@ -0,0 +1,247 @@
+package transaction
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// fakeClock fires timers only when test advances it
+type fakeClock struct {
+	mu     sync.Mutex
+	start  time.Time
+	now    time.Time
+	seq    int
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	seq   int
+	f     func()
+	done  bool
+}
+
+func newFakeClock() *fakeClock {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &fakeClock{start: start, now: start}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &fakeTimer{clock: c, at: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+// elapsed returns time since clock was created
+func (c *fakeClock) elapsed() time.Duration {
+	return c.Now().Sub(c.start)
+}
+
+// Advance moves clock by d and fires due timers in order. Timers set by fired
+// timers fire too when they are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			ti, tj := c.timers[i], c.timers[j]
+			if ti.at.Equal(tj.at) {
+				return ti.seq < tj.seq
+			}
+			return ti.at.Before(tj.at)
+		})
+		var next *fakeTimer
+		for len(c.timers) > 0 && next == nil {
+			t := c.timers[0]
+			c.timers = c.timers[1:]
+			if !t.done {
+				next = t
+			}
+		}
+		if next == nil || next.at.After(end) {
+			if next != nil {
+				c.timers = append(c.timers, next)
+			}
+			break
+		}
+		next.done = true
+		c.now = next.at
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// sentMsg is message written to fake transport and time it was written
+type sentMsg struct {
+	at  time.Duration
+	msg *message.Message
+}
+
+// fakeTransport records written messages
+type fakeTransport struct {
+	clock *fakeClock
+
+	mu   sync.Mutex
+	sent []sentMsg
+}
+
+func (tp *fakeTransport) WriteMsg(msg *message.Message) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.sent = append(tp.sent, sentMsg{at: tp.clock.elapsed(), msg: msg})
+	return nil
+}
+
+// times returns times messages accepted by match were written at
+func (tp *fakeTransport) times(match func(msg *message.Message) bool) []time.Duration {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	var times []time.Duration
+	for _, s := range tp.sent {
+		if match(s.msg) {
+			times = append(times, s.at)
+		}
+	}
+	return times
+}
+
+func isMethod(method message.RequestMethod) func(msg *message.Message) bool {
+	return func(msg *message.Message) bool {
+		return !msg.Msg.IsResponse() && msg.Msg.Method == string(method)
+	}
+}
+
+func isResponse(status int, method message.RequestMethod) func(msg *message.Message) bool {
+	return func(msg *message.Message) bool {
+		return msg.Msg.IsResponse() && msg.Msg.Status == status && msg.Msg.CSeqMethod == string(method)
+	}
+}
+
+func newTestLayer() (*Layer, *fakeClock, *fakeTransport) {
+	clock := newFakeClock()
+	tp := &fakeTransport{clock: clock}
+	l := NewLayer(tp)
+	l.Clock = clock
+	return l, clock, tp
+}
+
+// newTestRequest creates request as received from or sent to 192.0.2.1
+func newTestRequest(method message.RequestMethod, transport string, branch string) *message.Message {
+	msg := &sip.Msg{
+		Method:  string(method),
+		Request: &sip.URI{Scheme: "sip", User: "bob", Host: "example.com"},
+		Via: &sip.Via{
+			Transport: transport,
+			Host:      "192.0.2.1",
+			Port:      5060,
+			Param:     &sip.Param{Name: "branch", Value: branch},
+		},
+		From:       &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.com"}, Param: &sip.Param{Name: "tag", Value: "a1"}},
+		To:         &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "bob", Host: "example.com"}},
+		CallID:     "call-1@192.0.2.1",
+		CSeq:       1,
+		CSeqMethod: string(method),
+	}
+	return &message.Message{
+		Msg:         msg,
+		Transport:   transport,
+		Source:      "192.0.2.1:5060",
+		Destination: "192.0.2.1:5060",
+	}
+}
+
+// seconds converts fractional seconds to durations
+func seconds(s ...float64) []time.Duration {
+	d := make([]time.Duration, len(s))
+	for i, v := range s {
+		d[i] = time.Duration(v * float64(time.Second))
+	}
+	return d
+}
+
+func TestCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		// answer is final response sent to INVITE before CANCEL, 0 for none
+		answer     int
+		invite     bool
+		wantCancel int
+		want487    bool
+		// wantHandler tells if cancel handler is called
+		wantHandler bool
+	}{
+		{name: "pending INVITE", invite: true, wantCancel: 200, want487: true, wantHandler: true},
+		{name: "rejected INVITE", invite: true, answer: 486, wantCancel: 200},
+		{name: "CANCEL after 200", invite: true, answer: 200, wantCancel: 200},
+		{name: "no INVITE", wantCancel: 481},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock, tp := newTestLayer()
+			var requests, cancels int
+			l.OnRequest(func(req *message.Message) { requests++ })
+			l.OnCancel(func(req *message.Message) { cancels++ })
+
+			invite := newTestRequest(message.INVITE, "UDP", MagicCookie+"inv1")
+			if tt.invite {
+				l.HandleMessage(invite)
+				if tt.answer != 0 {
+					if err := l.Respond(message.NewResponse(invite, tt.answer, "")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			l.HandleMessage(newTestRequest(message.CANCEL, "UDP", MagicCookie+"inv1"))
+			clock.Advance(time.Second)
+
+			if got := tp.times(isResponse(tt.wantCancel, message.CANCEL)); len(got) != 1 {
+				t.Errorf("CANCEL answered with %d %d times", tt.wantCancel, len(got))
+			}
+			if got := len(tp.times(isResponse(487, message.INVITE))) > 0; got != tt.want487 {
+				t.Errorf("487 sent %v, want %v", got, tt.want487)
+			}
+			wantRequests := 0
+			if tt.invite {
+				wantRequests = 1
+			}
+			if requests != wantRequests {
+				t.Errorf("request handler got %d requests, want INVITE only", requests)
+			}
+			wantCancels := 0
+			if tt.wantHandler {
+				wantCancels = 1
+			}
+			if cancels != wantCancels {
+				t.Errorf("cancel handler called %d times, want %d", cancels, wantCancels)
+			}
+		})
+	}
+}
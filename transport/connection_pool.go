@@ -1,7 +1,6 @@
 package transport
 
 import (
-	"net"
 	"sync"
 )
 
@@ -42,24 +41,35 @@ func (p *ConnectionPool) Size() int {
 	return l
 }
 
+// All returns a snapshot of pooled connections
+func (p *ConnectionPool) All() []Connection {
+	p.RLock()
+	conns := make([]Connection, 0, len(p.m))
+	for _, c := range p.m {
+		conns = append(conns, c)
+	}
+	p.RUnlock()
+	return conns
+}
+
 type TCPPool struct {
 	sync.RWMutex
-	m map[string]*net.TCPConn
+	m map[string]*TCPConnection
 }
 
 func NewTCPPool() TCPPool {
 	return TCPPool{
-		m: make(map[string]*net.TCPConn),
+		m: make(map[string]*TCPConnection),
 	}
 }
 
-func (p *TCPPool) Add(a string, c *net.TCPConn) {
+func (p *TCPPool) Add(a string, c *TCPConnection) {
 	p.Lock()
 	p.m[a] = c
 	p.Unlock()
 }
 
-func (p *TCPPool) Get(a string) (c *net.TCPConn) {
+func (p *TCPPool) Get(a string) (c *TCPConnection) {
 	p.RLock()
 	c = p.m[a]
 	p.RUnlock()
@@ -71,3 +81,21 @@ func (p *TCPPool) Del(a string) {
 	delete(p.m, a)
 	p.Unlock()
 }
+
+func (p *TCPPool) Size() int {
+	p.RLock()
+	l := len(p.m)
+	p.RUnlock()
+	return l
+}
+
+// All returns a snapshot of pooled connections
+func (p *TCPPool) All() []*TCPConnection {
+	p.RLock()
+	conns := make([]*TCPConnection, 0, len(p.m))
+	for _, c := range p.m {
+		conns = append(conns, c)
+	}
+	p.RUnlock()
+	return conns
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/shend/simplesip/message"
+)
+
+// Default dispatch settings of Layer
+const (
+	DefaultWorkers    = 64
+	DefaultQueueSize  = 256
+	DefaultRetryAfter = 5
+)
+
+// dispatcher handles received requests on bounded pool of workers. Requests of
+// same Call-ID are queued to same worker, so they are handled in order.
+type dispatcher struct {
+	handler func(msg *message.Message)
+	queues  []chan *message.Message
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newDispatcher(workers int, queueSize int, handler func(msg *message.Message)) *dispatcher {
+	d := &dispatcher{
+		handler: handler,
+		queues:  make([]chan *message.Message, workers),
+	}
+	for i := range d.queues {
+		q := make(chan *message.Message, queueSize)
+		d.queues[i] = q
+		d.wg.Add(1)
+		go d.work(q)
+	}
+	return d
+}
+
+func (d *dispatcher) work(q chan *message.Message) {
+	defer d.wg.Done()
+	for msg := range q {
+		d.handler(msg)
+	}
+}
+
+// dispatch queues request to worker of its Call-ID. It returns false when queue is full.
+func (d *dispatcher) dispatch(msg *message.Message) bool {
+	h := fnv.New32a()
+	h.Write([]byte(msg.Msg.CallID))
+	q := d.queues[h.Sum32()%uint32(len(d.queues))]
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false
+	}
+	select {
+	case q <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops workers once queued requests are handled
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
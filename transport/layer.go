@@ -1,9 +1,13 @@
 package transport
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,17 +24,40 @@ var (
 // Layer implementation.
 type Layer struct {
 	udp *UDPTransport
-	//tcp           *TCPTransport
+	tcp *TCPTransport
+	tls *TLSTransport
+	ws  *WSTransport
 
 	transports map[string]Transport
 
 	listenPorts   map[string][]int
 	listenPortsMu sync.Mutex
 
-	handlers []message.RequestHandler
+	// aliases are host names of this server besides its IP addresses
+	aliases   map[string]bool
+	aliasesMu sync.RWMutex
 
-	// Parser used by transport layer. It can be overridden before setting up network transports
+	handlers []func(msg *message.Message)
+	// servers are HTTP servers of WebSocket listeners
+	servers   []*http.Server
+	serversMu sync.Mutex
+
+	// Parser used by transport layer. Use SetParser to change it
 	Parser parser.Parser
+
+	// Workers is number of goroutines handling received requests. Requests of same
+	// Call-ID are handled by same worker in order. Zero handles requests on reading
+	// goroutine. Responses are always handled on reading goroutine, so handler waiting
+	// for response never blocks it. Dispatch settings can be changed before serving.
+	Workers int
+	// QueueSize limits requests waiting for each worker. Request arriving at full
+	// queue is answered with 503, ACK is dropped.
+	QueueSize int
+	// RetryAfter is Retry-After in seconds of 503 answered on full queue
+	RetryAfter int
+
+	dispatcher     *dispatcher
+	dispatcherOnce sync.Once
 }
 
 // NewLayer creates transport layer.
@@ -38,18 +65,43 @@ func NewLayer(parser parser.Parser) *Layer {
 	l := &Layer{
 		transports:  make(map[string]Transport),
 		listenPorts: make(map[string][]int),
+		aliases:     map[string]bool{"localhost": true},
 		Parser:      parser,
+		Workers:     DefaultWorkers,
+		QueueSize:   DefaultQueueSize,
+		RetryAfter:  DefaultRetryAfter,
 	}
 
 	// Make some default transports available.
 	l.udp = NewUDPTransport(parser)
+	l.tcp = NewTCPTransport(parser)
+	l.tls = NewTLSTransport(parser, nil)
+	l.ws = NewWSTransport(parser)
+
+	// Dialed stream connections are read before anything is served, if ever
+	l.tcp.SetHandler(l.handleMessage)
+	l.tls.SetHandler(l.handleMessage)
 
 	// Fill map for fast access
 	l.transports["udp"] = l.udp
+	l.transports["tcp"] = l.tcp
+	l.transports["tls"] = l.tls
+	l.transports["ws"] = l.ws
+	l.transports["wss"] = l.ws
 
 	return l
 }
 
+// SetParser sets parser of all transports, e.g. parser.NewNativeParser for
+// proxies. It must be called before serving.
+func (l *Layer) SetParser(p parser.Parser) {
+	l.Parser = p
+	l.udp.parser = p
+	l.tcp.parser = p
+	l.tls.TCPTransport.parser = p
+	l.ws.parser = p
+}
+
 func ParseAddr(addr string) (host string, port int, err error) {
 	host, pstr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -61,22 +113,53 @@ func ParseAddr(addr string) (host string, port int, err error) {
 }
 
 // AppendHandlers appends handlers to current handlers
-func (l *Layer) AppendHandlers(handlers ...message.RequestHandler) {
+func (l *Layer) AppendHandlers(handlers ...func(msg *message.Message)) {
 	l.handlers = append(l.handlers, handlers...)
 }
 
 // OnMessage is main function which will be called on any new message by transport layer
-func (l *Layer) OnMessage(h message.RequestHandler) {
+func (l *Layer) OnMessage(h func(msg *message.Message)) {
 	l.handlers = append(l.handlers, h)
 }
 
-// handleMessage is transport layer for handling messages
+// handleMessage passes received request to workers
 func (l *Layer) handleMessage(msg *message.Message) {
+	l.dispatcherOnce.Do(func() {
+		if l.Workers > 0 {
+			l.dispatcher = newDispatcher(l.Workers, l.QueueSize, l.runHandlers)
+		}
+	})
+	if l.dispatcher == nil || msg.Msg.IsResponse() {
+		l.runHandlers(msg)
+		return
+	}
+	if !l.dispatcher.dispatch(msg) {
+		l.overloaded(msg)
+	}
+}
+
+// runHandlers calls handlers of message
+func (l *Layer) runHandlers(msg *message.Message) {
 	for _, h := range l.handlers {
 		h(msg)
 	}
 }
 
+// overloaded answers request which did not fit to queue with 503 and Retry-After (RFC 3261 21.5.4)
+func (l *Layer) overloaded(msg *message.Message) {
+	slog.Warn("dispatch queue full, request dropped", "method", msg.Msg.Method, "call-id", msg.Msg.CallID, "src", msg.Source)
+	if msg.Msg.Method == string(message.ACK) {
+		return
+	}
+
+	res := message.NewResponse(msg, 503, "Service Unavailable")
+	// Message.Append writes it under right name
+	res.Msg.RetryAfter = strconv.Itoa(l.RetryAfter)
+	if err := l.WriteMsg(res); err != nil {
+		slog.Error("respond '503 Service Unavailable' failed", "err", err)
+	}
+}
+
 // ServeUDP will listen on udp connection
 func (l *Layer) ServeUDP(c net.PacketConn) error {
 	_, port, err := ParseAddr(c.LocalAddr().String())
@@ -98,13 +181,36 @@ func (l *Layer) ServeTCP(c net.Listener) error {
 
 	l.addListenPort("tcp", port)
 
-	// TODO 实现TCP层
-	return nil
+	return l.tcp.Serve(c, l.handleMessage)
+}
+
+// ServeTLS will listen on tcp connection and wrap it with TLS
+func (l *Layer) ServeTLS(c net.Listener) error {
+	_, port, err := ParseAddr(c.Addr().String())
+	if err != nil {
+		return err
+	}
+
+	l.addListenPort("tls", port)
+
+	return l.tls.Serve(c, l.handleMessage)
 }
 
-// ListenAndServe serve on any network. This function will block
-// Network supported: udp, tcp
-func (l *Layer) ListenAndServe(network string, addr string) error {
+// WSHandler returns http.Handler serving SIP over WebSocket (RFC 7118).
+// Mount it on http.Server, WSS is used when it is served over TLS.
+func (l *Layer) WSHandler() http.Handler {
+	return l.ws.Handler(l.handleMessage)
+}
+
+// SetTLSConfig sets config used by TLS listeners and outbound TLS connections.
+// For mutual TLS set ClientAuth and ClientCAs, peer certificates are available on message
+func (l *Layer) SetTLSConfig(config *tls.Config) {
+	l.tls.SetConfig(config)
+}
+
+// ListenAndServe serve on any network. This function will block until listener
+// is closed by Close or ctx is done. Network supported: udp, tcp, tls, ws, wss
+func (l *Layer) ListenAndServe(ctx context.Context, network string, addr string) error {
 	network = strings.ToLower(network)
 	switch network {
 	case "udp":
@@ -118,11 +224,46 @@ func (l *Layer) ListenAndServe(network string, addr string) error {
 		if err != nil {
 			return fmt.Errorf("listen udp error. err=%w", err)
 		}
+		defer context.AfterFunc(ctx, func() { conn.Close() })()
 
 		return l.ServeUDP(conn)
 	case "tcp":
-		// TODO: 实现TCP
-		return ErrNetworkNotSupported
+		conn, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen tcp error. err=%w", err)
+		}
+		defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+		return l.ServeTCP(conn)
+	case "tls":
+		conn, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen tls error. err=%w", err)
+		}
+		defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+		return l.ServeTLS(conn)
+	case "ws", "wss":
+		hs := &http.Server{
+			Addr:    addr,
+			Handler: l.WSHandler(),
+		}
+		l.serversMu.Lock()
+		l.servers = append(l.servers, hs)
+		l.serversMu.Unlock()
+		defer context.AfterFunc(ctx, func() { hs.Close() })()
+
+		var err error
+		if network == "wss" {
+			hs.TLSConfig = l.tls.Config()
+			err = hs.ListenAndServeTLS("", "")
+		} else {
+			err = hs.ListenAndServe()
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
 	}
 
 	return ErrNetworkNotSupported
@@ -132,20 +273,145 @@ func (l *Layer) addListenPort(network string, port int) {
 	l.listenPortsMu.Lock()
 	defer l.listenPortsMu.Unlock()
 
-	if _, ok := l.listenPorts[network]; !ok {
-		if l.listenPorts[network] == nil {
-			l.listenPorts[network] = make([]int, 0)
+	for _, p := range l.listenPorts[network] {
+		if p == port {
+			return
+		}
+	}
+	l.listenPorts[network] = append(l.listenPorts[network], port)
+}
+
+// ListenPort returns first port network is listening on. Default SIP port is
+// returned when there is no listener.
+func (l *Layer) ListenPort(network string) int {
+	network = NetworkToLower(network)
+
+	l.listenPortsMu.Lock()
+	defer l.listenPortsMu.Unlock()
+
+	if ports := l.listenPorts[network]; len(ports) > 0 {
+		return ports[0]
+	}
+	return defaultPort(network)
+}
+
+// AddAlias adds host name recognized as this server by IsLocal
+func (l *Layer) AddAlias(host string) {
+	l.aliasesMu.Lock()
+	l.aliases[strings.ToLower(host)] = true
+	l.aliasesMu.Unlock()
+}
+
+// IsLocal checks if host and port address this server, e.g. in Route header.
+// Host is local when it is alias or address of network interface, port when
+// any transport listens on it. Zero port means default port.
+func (l *Layer) IsLocal(host string, port int) bool {
+	if !l.isLocalHost(host) {
+		return false
+	}
+
+	l.listenPortsMu.Lock()
+	defer l.listenPortsMu.Unlock()
+
+	if len(l.listenPorts) == 0 {
+		return port == 0 || port == 5060 || port == 5061
+	}
+	for network, ports := range l.listenPorts {
+		for _, p := range ports {
+			if p == port || (port == 0 && p == defaultPort(network)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *Layer) isLocalHost(host string) bool {
+	host = strings.Trim(strings.ToLower(host), "[]")
+
+	l.aliasesMu.RLock()
+	alias := l.aliases[host]
+	l.aliasesMu.RUnlock()
+	if alias {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
 		}
-		l.listenPorts[network] = append(l.listenPorts[network], port)
 	}
+	return false
+}
+
+func defaultPort(network string) int {
+	if network == "tls" || network == "wss" {
+		return 5061
+	}
+	return 5060
+}
+
+// LocalAddr returns local host and port used for sending to raddr over network.
+// It is suitable for Via sent-by and Contact of outbound requests.
+func (l *Layer) LocalAddr(network string, raddr string) (host string, port int, err error) {
+	// Connecting UDP socket sends nothing, only picks outbound interface
+	conn, err := net.Dial("udp", raddr)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+
+	host, _, err = net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, l.ListenPort(network), nil
 }
 
 func (l *Layer) WriteMsg(msg *message.Message) error {
+	if msg.Msg.IsResponse() && msg.Msg.Via != nil {
+		return l.writeResponse(msg)
+	}
 	network := msg.Transport
 	addr := msg.Destination
+	// Requests to sips: URI must be sent over TLS
+	if !msg.Msg.IsResponse() && msg.Msg.Request != nil && msg.Msg.Request.Scheme == "sips" {
+		network = TransportTLS
+	}
 	return l.WriteMsgTo(msg, addr, network)
 }
 
+// writeResponse sends response as RFC 3261 18.2.2 says. Over reliable transport
+// connection request came on is used. Otherwise, or when connection is gone,
+// response is sent to address of top Via.
+func (l *Layer) writeResponse(msg *message.Message) error {
+	network := msg.Transport
+	if !strings.EqualFold(network, TransportUDP) && msg.Destination != "" {
+		conn, err := l.GetConnection(network, msg.Destination)
+		if err == nil {
+			if err = conn.WriteMsg(msg); err == nil {
+				return nil
+			}
+		}
+		slog.Debug("connection of request is gone, response is sent to Via", "dst", msg.Destination, "err", err)
+	}
+
+	msg.Destination = ResponseAddr(msg.Msg.Via)
+	return l.WriteMsgTo(msg, msg.Destination, network)
+}
+
 func (l *Layer) WriteMsgTo(msg *message.Message, addr string, network string) error {
 	var conn Connection
 	var err error
@@ -189,6 +455,8 @@ func (l *Layer) getConnection(network, addr string) (Connection, error) {
 	return c, err
 }
 
+// Close closes transports and listeners. It waits until workers handled queued
+// requests, so it must not be called from message handler.
 func (l *Layer) Close() error {
 	var werr error
 	for _, t := range l.transports {
@@ -197,6 +465,21 @@ func (l *Layer) Close() error {
 			werr = err
 		}
 	}
+
+	l.serversMu.Lock()
+	for _, hs := range l.servers {
+		if err := hs.Close(); err != nil {
+			werr = err
+		}
+	}
+	l.servers = nil
+	l.serversMu.Unlock()
+
+	// Once synchronizes with dispatcher creation and prevents it after close
+	l.dispatcherOnce.Do(func() {})
+	if l.dispatcher != nil {
+		l.dispatcher.close()
+	}
 	return werr
 }
 
@@ -212,6 +495,8 @@ func NetworkToLower(network string) string {
 		return "tls"
 	case "WS":
 		return "ws"
+	case "WSS":
+		return "wss"
 	default:
 		return util.ASCIIToLower(network)
 	}
@@ -0,0 +1,374 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+var (
+	// TCPDialTimeout limits establishing outbound TCP connections
+	TCPDialTimeout = 5 * time.Second
+
+	ErrMessageTooLarge      = errors.New("sip message exceeds buffer size")
+	ErrInvalidContentLength = errors.New("invalid Content-Length header")
+)
+
+// TCPTransport implements Transport interface
+type TCPTransport struct {
+	parser parser.Parser
+
+	// transport is Via transport served by this stream transport
+	transport string
+	dial      func(addr string) (net.Conn, error)
+
+	listeners   []net.Listener
+	listenersMu sync.Mutex
+
+	handler   func(msg *message.Message)
+	handlerMu sync.RWMutex
+
+	dialMu sync.Mutex
+	pool   TCPPool
+}
+
+func NewTCPTransport(parser parser.Parser) *TCPTransport {
+	p := &TCPTransport{
+		parser:    parser,
+		transport: TransportTCP,
+		pool:      NewTCPPool(),
+	}
+	p.dial = p.dialTCP
+	return p
+}
+
+func (t *TCPTransport) Network() string {
+	return TransportTCP
+}
+
+func (t *TCPTransport) String() string {
+	return "transport<TCP>"
+}
+
+// GetConnection returns pooled connection to addr or dials a new one.
+// Connections are keyed by remote address, so responses go back over the
+// connection request came in on.
+func (t *TCPTransport) GetConnection(addr string) (Connection, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	key := raddr.String()
+
+	if c := t.pool.Get(key); c != nil {
+		return c, nil
+	}
+
+	t.dialMu.Lock()
+	defer t.dialMu.Unlock()
+
+	// Someone could dial while we were waiting
+	if c := t.pool.Get(key); c != nil {
+		return c, nil
+	}
+
+	conn, err := t.dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s %s failed. err=%w", t.transport, key, err)
+	}
+
+	c := &TCPConnection{Conn: conn}
+	t.pool.Add(key, c)
+	go t.readConnection(c, t.getHandler())
+
+	return c, nil
+}
+
+func (t *TCPTransport) dialTCP(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, TCPDialTimeout)
+}
+
+func (t *TCPTransport) Close() error {
+	var werr error
+
+	t.listenersMu.Lock()
+	for _, l := range t.listeners {
+		if err := l.Close(); err != nil {
+			werr = err
+		}
+	}
+	t.listeners = nil
+	t.listenersMu.Unlock()
+
+	for _, c := range t.pool.All() {
+		if err := c.Close(); err != nil {
+			werr = err
+		}
+	}
+
+	return werr
+}
+
+func (t *TCPTransport) ListenAndServe(addr string, handler func(msg *message.Message)) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen tcp address. err=%w", err)
+	}
+
+	return t.Serve(l, handler)
+}
+
+// Serve accepts connections on listener until it is closed
+func (t *TCPTransport) Serve(l net.Listener, handler func(msg *message.Message)) error {
+	slog.Debug(fmt.Sprintf("begin listening on %s %s", t.transport, l.Addr().String()))
+
+	t.SetHandler(handler)
+
+	t.listenersMu.Lock()
+	t.listeners = append(t.listeners, l)
+	t.listenersMu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accept %s error. err=%w", t.transport, err)
+		}
+
+		c := &TCPConnection{Conn: conn}
+		t.pool.Add(conn.RemoteAddr().String(), c)
+
+		go t.readConnection(c, handler)
+	}
+}
+
+// SetHandler sets handler of messages received on dialed connections, so transport
+// without listener gets responses too. Serve replaces it with its handler.
+func (t *TCPTransport) SetHandler(handler func(msg *message.Message)) {
+	t.handlerMu.Lock()
+	t.handler = handler
+	t.handlerMu.Unlock()
+}
+
+func (t *TCPTransport) getHandler() func(msg *message.Message) {
+	t.handlerMu.RLock()
+	defer t.handlerMu.RUnlock()
+	if t.handler == nil {
+		return func(msg *message.Message) {
+			slog.Debug("no handler for stream message, dropping", slog.String("src", msg.Source))
+		}
+	}
+	return t.handler
+}
+
+func (t *TCPTransport) readConnection(conn *TCPConnection, handler func(*message.Message)) {
+	laddr := conn.Conn.LocalAddr().String()
+	raddr := conn.Conn.RemoteAddr().String()
+	defer func() {
+		t.pool.Del(raddr)
+		conn.Close()
+	}()
+
+	if err := conn.handshake(); err != nil {
+		slog.Error("tls handshake error", "err", err, "raddr", raddr)
+		return
+	}
+	peerCerts := conn.PeerCertificates()
+
+	r := bufio.NewReaderSize(conn.Conn, int(transportBufferSize))
+	for {
+		data, err := readStreamMessage(r, conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Error("read stream error", "transport", t.transport, "err", err)
+			}
+			return
+		}
+
+		if SIPDebug {
+			slog.Debug(fmt.Sprintf("%s read %s <- %s:\n%s", t.transport, laddr, raddr, string(data)))
+		}
+
+		msg := t.parseAndHandle(data, raddr, laddr, conn.WriteMsg)
+		if msg != nil {
+			msg.PeerCertificates = peerCerts
+			handler(msg)
+		}
+	}
+}
+
+func (t *TCPTransport) parseAndHandle(data []byte, src string, dst string, respond message.RespondFunc) *message.Message {
+	msg, err := t.parser.ParseMsg(data)
+	if err != nil {
+		slog.Debug("failed to parse", slog.String("data", string(data)), slog.String("err", err.Error()))
+		badRequest(err, src, dst, t.transport, respond)
+		return nil
+	}
+
+	if msg.Transport != t.transport {
+		slog.Debug("transport mismatch", slog.String("transport", msg.Msg.Via.Transport))
+		return nil
+	}
+
+	msg.Source = src
+	msg.Destination = dst
+	msg.Respond = respond
+	annotateVia(msg, src)
+
+	return msg
+}
+
+// readStreamMessage reads single SIP message from stream. Messages are framed
+// by empty line after headers and Content-Length of body. CRLF keep alive
+// pings (RFC 5626) are answered with single CRLF pong.
+func readStreamMessage(r *bufio.Reader, pong io.Writer) ([]byte, error) {
+	var buf bytes.Buffer
+	contentLength := 0
+	crlfs := 0
+
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, ErrMessageTooLarge
+			}
+			return nil, err
+		}
+
+		if buf.Len() == 0 {
+			// Empty lines before start line are keep alive
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				crlfs++
+				if crlfs == 2 {
+					slog.Debug("Keep alive CRLF received")
+					if _, err := pong.Write([]byte("\r\n")); err != nil {
+						return nil, err
+					}
+					crlfs = 0
+				}
+				continue
+			}
+		}
+
+		if buf.Len()+len(line) > int(transportBufferSize) {
+			return nil, ErrMessageTooLarge
+		}
+		buf.Write(line)
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			break
+		}
+
+		if n, ok, err := parseContentLength(trimmed); err != nil {
+			return nil, err
+		} else if ok {
+			contentLength = n
+		}
+	}
+
+	if contentLength > 0 {
+		if buf.Len()+contentLength > int(transportBufferSize) {
+			return nil, ErrMessageTooLarge
+		}
+		body := make([]byte, contentLength)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		buf.Write(body)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseContentLength checks if header line is Content-Length (or compact form l)
+func parseContentLength(line []byte) (n int, ok bool, err error) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return 0, false, nil
+	}
+	name := strings.TrimSpace(string(line[:i]))
+	if !strings.EqualFold(name, "Content-Length") && !strings.EqualFold(name, "l") {
+		return 0, false, nil
+	}
+	n, err = strconv.Atoi(strings.TrimSpace(string(line[i+1:])))
+	if err != nil || n < 0 {
+		return 0, false, ErrInvalidContentLength
+	}
+	return n, true, nil
+}
+
+type TCPConnection struct {
+	Conn net.Conn
+
+	mu sync.Mutex
+}
+
+func (c *TCPConnection) Close() error {
+	return c.Conn.Close()
+}
+
+// handshake completes TLS handshake for TLS connections. It is noop for TCP
+func (c *TCPConnection) handshake() error {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TCPDialTimeout)
+	defer cancel()
+	return tc.HandshakeContext(ctx)
+}
+
+// PeerCertificates returns certificates presented by TLS peer. It returns nil for TCP
+func (c *TCPConnection) PeerCertificates() []*x509.Certificate {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return tc.ConnectionState().PeerCertificates
+}
+
+// Write writes raw bytes to connection. Writes are serialized
+func (c *TCPConnection) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	n, err = c.Conn.Write(b)
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *TCPConnection) WriteMsg(msg *message.Message) error {
+	var buf bytes.Buffer
+	msg.Append(&buf)
+	data := buf.Bytes()
+
+	n, err := c.Write(data)
+	if err != nil {
+		return fmt.Errorf("stream conn %s err. %w", c.Conn.LocalAddr().String(), err)
+	}
+
+	if SIPDebug {
+		slog.Debug(fmt.Sprintf("stream write %s -> %s:\n%s", c.Conn.LocalAddr().String(), c.Conn.RemoteAddr().String(), string(data)))
+	}
+
+	if n != len(data) {
+		return fmt.Errorf("fail to write full message")
+	}
+
+	return nil
+}
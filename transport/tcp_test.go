@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+const (
+	streamOptions = "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\nCall-ID: a\r\nContent-Length: 4\r\n\r\nbody"
+	streamBye     = "BYE sip:bob@127.0.0.1 SIP/2.0\r\nl: 0\r\n\r\n"
+	streamNoLen   = "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\nCall-ID: c\r\n\r\n"
+)
+
+func TestReadStreamMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		// err is returned after messages of want
+		err  error
+		pong string
+	}{
+		{name: "pipelined", input: streamOptions + streamBye, want: []string{streamOptions, streamBye}, err: io.EOF},
+		{name: "keep alive", input: "\r\n\r\n" + streamBye, want: []string{streamBye}, err: io.EOF, pong: "\r\n"},
+		{name: "missing Content-Length", input: streamNoLen + streamBye, want: []string{streamNoLen, streamBye}, err: io.EOF},
+		{
+			name:  "oversized Content-Length",
+			input: "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\nContent-Length: 70000\r\n\r\n",
+			err:   ErrMessageTooLarge,
+		},
+		{
+			name:  "invalid Content-Length",
+			input: "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\nContent-Length: -1\r\n\r\n",
+			err:   ErrInvalidContentLength,
+		},
+		{
+			name:  "truncated body",
+			input: "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\nContent-Length: 10\r\n\r\nabc",
+			err:   io.ErrUnexpectedEOF,
+		},
+	}
+
+	readers := []struct {
+		name string
+		wrap func(r io.Reader) io.Reader
+	}{
+		{name: "whole", wrap: func(r io.Reader) io.Reader { return r }},
+		{name: "split", wrap: iotest.OneByteReader},
+	}
+
+	for _, tt := range tests {
+		for _, rd := range readers {
+			t.Run(tt.name+"/"+rd.name, func(t *testing.T) {
+				r := bufio.NewReaderSize(rd.wrap(strings.NewReader(tt.input)), int(transportBufferSize))
+				var pong bytes.Buffer
+				for _, want := range tt.want {
+					got, err := readStreamMessage(r, &pong)
+					if err != nil {
+						t.Fatalf("read message: %v", err)
+					}
+					if string(got) != want {
+						t.Errorf("got %q, want %q", got, want)
+					}
+				}
+				if _, err := readStreamMessage(r, &pong); !errors.Is(err, tt.err) {
+					t.Errorf("last read returned %v, want %v", err, tt.err)
+				}
+				if pong.String() != tt.pong {
+					t.Errorf("pong %q, want %q", pong.String(), tt.pong)
+				}
+			})
+		}
+	}
+}
+
+// newStreamRequest creates OPTIONS sent over network to port of loopback
+func newStreamRequest(network string, port int) *message.Message {
+	return &message.Message{
+		Msg: &sip.Msg{
+			Method:     string(message.OPTIONS),
+			Request:    &sip.URI{Scheme: "sip", User: "bob", Host: "127.0.0.1", Port: uint16(port)},
+			Via:        &sip.Via{Transport: network, Host: "127.0.0.1", Port: 5060, Param: &sip.Param{Name: "branch", Value: "z9hG4bKdial1"}},
+			From:       &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "127.0.0.1"}, Param: &sip.Param{Name: "tag", Value: "a1"}},
+			To:         &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "bob", Host: "127.0.0.1"}},
+			CallID:     "dial-1@127.0.0.1",
+			CSeq:       1,
+			CSeqMethod: string(message.OPTIONS),
+		},
+		Transport:   network,
+		Destination: "127.0.0.1:" + strconv.Itoa(port),
+	}
+}
+
+// answerOK makes layer answer every request with 200
+func answerOK(t *testing.T, l *Layer) {
+	l.OnMessage(func(req *message.Message) {
+		if err := l.WriteMsg(message.NewResponse(req, 200, "OK")); err != nil {
+			t.Errorf("respond failed: %v", err)
+		}
+	})
+}
+
+// expectResponse waits for response delivered to ch
+func expectResponse(t *testing.T, ch <-chan *message.Message, status int) {
+	t.Helper()
+	select {
+	case res := <-ch:
+		if res.Msg.Status != status {
+			t.Errorf("response %d, want %d", res.Msg.Status, status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response was not received on dialed connection")
+	}
+}
+
+func TestTCPDialOnly(t *testing.T) {
+	server := NewLayer(parser.NewParser())
+	answerOK(t, server)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTCP(ln)
+	defer server.Close()
+
+	// Client never serves, responses come on connection it dialed
+	responses := make(chan *message.Message, 1)
+	client := NewLayer(parser.NewParser())
+	client.OnMessage(func(res *message.Message) { responses <- res })
+	defer client.Close()
+
+	if err := client.WriteMsg(newStreamRequest(TransportTCP, ln.Addr().(*net.TCPAddr).Port)); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, responses, 200)
+}
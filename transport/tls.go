@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+var (
+	ErrTLSConfigMissing = errors.New("tls config with certificates is required")
+)
+
+// TLSTransport implements Transport interface. It shares stream handling with TCPTransport
+type TLSTransport struct {
+	*TCPTransport
+
+	config   *tls.Config
+	configMu sync.RWMutex
+}
+
+func NewTLSTransport(parser parser.Parser, config *tls.Config) *TLSTransport {
+	tcp := NewTCPTransport(parser)
+	tcp.transport = TransportTLS
+
+	p := &TLSTransport{
+		TCPTransport: tcp,
+		config:       config,
+	}
+	tcp.dial = p.dialTLS
+	return p
+}
+
+func (t *TLSTransport) Network() string {
+	return TransportTLS
+}
+
+func (t *TLSTransport) String() string {
+	return "transport<TLS>"
+}
+
+// SetConfig replaces TLS config. It is used for new connections only
+func (t *TLSTransport) SetConfig(config *tls.Config) {
+	t.configMu.Lock()
+	t.config = config
+	t.configMu.Unlock()
+}
+
+// Config returns current TLS config
+func (t *TLSTransport) Config() *tls.Config {
+	t.configMu.RLock()
+	defer t.configMu.RUnlock()
+	return t.config
+}
+
+func (t *TLSTransport) ListenAndServe(addr string, handler func(msg *message.Message)) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen tls address. err=%w", err)
+	}
+
+	return t.Serve(l, handler)
+}
+
+// Serve wraps plain listener with TLS and accepts connections until it is closed
+func (t *TLSTransport) Serve(l net.Listener, handler func(msg *message.Message)) error {
+	config := t.Config()
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return ErrTLSConfigMissing
+	}
+
+	return t.TCPTransport.Serve(tls.NewListener(l, config), handler)
+}
+
+func (t *TLSTransport) dialTLS(addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var config *tls.Config
+	if c := t.Config(); c != nil {
+		config = c.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: TCPDialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
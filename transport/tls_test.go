@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+// newCertificate creates self-signed certificate of 127.0.0.1 usable by server and client
+func newCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+// serveTLS serves layer on TLS listener of loopback and returns its port
+func serveTLS(t *testing.T, l *Layer) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.ServeTLS(ln)
+	t.Cleanup(func() { l.Close() })
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	serverCert, serverX509 := newCertificate(t, "server")
+	clientCert, clientX509 := newCertificate(t, "client")
+	serverCAs, clientCAs := x509.NewCertPool(), x509.NewCertPool()
+	serverCAs.AddCert(serverX509)
+	clientCAs.AddCert(clientX509)
+
+	requests := make(chan *message.Message, 1)
+	server := NewLayer(parser.NewParser())
+	server.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	server.OnMessage(func(req *message.Message) {
+		requests <- req
+		if err := server.WriteMsg(message.NewResponse(req, 200, "OK")); err != nil {
+			t.Errorf("respond failed: %v", err)
+		}
+	})
+	serverPort := serveTLS(t, server)
+
+	// Client listens too, so its certificate is presented by both sides
+	responses := make(chan *message.Message, 1)
+	client := NewLayer(parser.NewParser())
+	client.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      serverCAs,
+	})
+	client.OnMessage(func(res *message.Message) { responses <- res })
+	clientPort := serveTLS(t, client)
+
+	req := &message.Message{
+		Msg: &sip.Msg{
+			Method:     string(message.OPTIONS),
+			Request:    &sip.URI{Scheme: "sips", User: "bob", Host: "127.0.0.1", Port: uint16(serverPort)},
+			Via:        &sip.Via{Transport: TransportTLS, Host: "127.0.0.1", Port: uint16(clientPort), Param: &sip.Param{Name: "branch", Value: "z9hG4bKtls1"}},
+			From:       &sip.Addr{Uri: &sip.URI{Scheme: "sips", User: "alice", Host: "127.0.0.1"}, Param: &sip.Param{Name: "tag", Value: "a1"}},
+			To:         &sip.Addr{Uri: &sip.URI{Scheme: "sips", User: "bob", Host: "127.0.0.1"}},
+			CallID:     "tls-1@127.0.0.1",
+			CSeq:       1,
+			CSeqMethod: string(message.OPTIONS),
+		},
+		// sips: Request-URI is sent over TLS whatever transport says
+		Transport:   TransportTCP,
+		Destination: "127.0.0.1:" + strconv.Itoa(serverPort),
+	}
+	if err := client.WriteMsg(req); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-requests:
+		if got.Transport != TransportTLS {
+			t.Errorf("request received over %s", got.Transport)
+		}
+		if len(got.PeerCertificates) == 0 || got.PeerCertificates[0].Subject.CommonName != "client" {
+			t.Errorf("request has peer certificates %v, want client certificate", got.PeerCertificates)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not received")
+	}
+
+	select {
+	case got := <-responses:
+		if got.Msg.Status != 200 {
+			t.Errorf("response %d, want 200", got.Msg.Status)
+		}
+		if len(got.PeerCertificates) == 0 || got.PeerCertificates[0].Subject.CommonName != "server" {
+			t.Errorf("response has peer certificates %v, want server certificate", got.PeerCertificates)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response was not received")
+	}
+}
+
+func TestTLSDialOnly(t *testing.T) {
+	serverCert, serverX509 := newCertificate(t, "server")
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(serverX509)
+
+	server := NewLayer(parser.NewParser())
+	server.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert}})
+	answerOK(t, server)
+	serverPort := serveTLS(t, server)
+
+	// Client never serves, responses come on connection it dialed
+	responses := make(chan *message.Message, 1)
+	client := NewLayer(parser.NewParser())
+	client.SetTLSConfig(&tls.Config{RootCAs: serverCAs})
+	client.OnMessage(func(res *message.Message) { responses <- res })
+	defer client.Close()
+
+	if err := client.WriteMsg(newStreamRequest(TransportTLS, serverPort)); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, responses, 200)
+}
+
+func TestTLSConfigMissing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	l := NewLayer(parser.NewParser())
+	if err := l.ServeTLS(ln); !errors.Is(err, ErrTLSConfigMissing) {
+		t.Errorf("serve without certificates returned %v, want ErrTLSConfigMissing", err)
+	}
+}
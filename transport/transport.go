@@ -1,5 +1,13 @@
 package transport
 
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
 var (
 	SIPDebug bool
 )
@@ -7,6 +15,9 @@ var (
 const (
 	TransportUDP = "UDP"
 	TransportTCP = "TCP"
+	TransportTLS = "TLS"
+	TransportWS  = "WS"
+	TransportWSS = "WSS"
 
 	transportBufferSize uint16 = 65535
 )
@@ -18,3 +29,32 @@ type Transport interface {
 	GetConnection(addr string) (Connection, error)
 	Close() error
 }
+
+// badRequest answers malformed request statelessly with 400 when parser
+// recovered enough of it. Warning names invalid header.
+func badRequest(err error, src string, dst string, network string, respond message.RespondFunc) {
+	var perr *parser.ParseError
+	if !errors.As(err, &perr) || perr.Request == nil || perr.Request.Msg.Method == "ACK" {
+		return
+	}
+
+	req := perr.Request
+	req.Source = src
+	req.Destination = dst
+	req.Respond = respond
+	annotateVia(req, src)
+
+	text := "Malformed message"
+	if perr.Header != "" {
+		text = "Invalid header " + perr.Header
+	} else if errors.Is(err, parser.ErrInvalidStartLine) {
+		text = "Invalid Request-Line"
+	}
+	res := message.NewWarning(req, 400, text)
+	if network == TransportUDP {
+		res.Destination = ResponseAddr(res.Msg.Via)
+	}
+	if err := respond(res); err != nil {
+		slog.Debug("failed to answer malformed request", "src", src, "err", err)
+	}
+}
@@ -48,11 +48,15 @@ func (t *UDPTransport) GetConnection(addr string) (Connection, error) {
 	return t.conn, nil
 }
 
+// Close closes all listening and connected sockets
 func (t *UDPTransport) Close() error {
-	t.pool.RLock()
-	defer t.pool.RUnlock()
-	var err error
-	return err
+	var werr error
+	for _, c := range t.pool.All() {
+		if err := c.Close(); err != nil {
+			werr = err
+		}
+	}
+	return werr
 }
 
 func (t *UDPTransport) ListenAndServe(addr string, handler func(msg *message.Message)) error {
@@ -96,7 +100,10 @@ func (t *UDPTransport) readConnection(conn *UDPConnection, handler func(*message
 		num, raddr, err := conn.ReadFrom(buf)
 
 		if err != nil {
-			slog.Error("read udp error", "err", err)
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("read udp error", "err", err)
+			}
+			t.pool.Del(laddr)
 			return
 		}
 
@@ -104,6 +111,8 @@ func (t *UDPTransport) readConnection(conn *UDPConnection, handler func(*message
 		if len(bytes.Trim(data, "\x00")) == 0 {
 			continue
 		}
+		// buf is reused by next read while message is handled
+		data = bytes.Clone(data)
 
 		msg := t.parseAndHandle(data, raddr.String(), laddr, conn.WriteMsg)
 		if msg != nil {
@@ -133,6 +142,8 @@ func (t *UDPTransport) readConnectedConnection(conn *UDPConnection, handler func
 		if len(bytes.Trim(data, "\x00")) == 0 {
 			continue
 		}
+		// buf is reused by next read while message is handled
+		data = bytes.Clone(data)
 
 		msg := t.parseAndHandle(data, raddr, laddr, conn.WriteMsg)
 		if msg != nil {
@@ -154,6 +165,7 @@ func (t *UDPTransport) parseAndHandle(data []byte, src string, dst string, respo
 	msg, err := t.parser.ParseMsg(data)
 	if err != nil {
 		slog.Debug("failed to parse", slog.String("data", string(data)), slog.String("err", err.Error()))
+		badRequest(err, src, dst, TransportUDP, respond)
 		return nil
 	}
 
@@ -165,6 +177,7 @@ func (t *UDPTransport) parseAndHandle(data []byte, src string, dst string, respo
 	msg.Source = src
 	msg.Destination = dst
 	msg.Respond = respond
+	annotateVia(msg, src)
 
 	return msg
 }
@@ -177,11 +190,11 @@ type UDPConnection struct {
 }
 
 func (c *UDPConnection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.Conn == nil {
-		return nil
+		return c.PacketConn.Close()
 	}
-	c.mu.Lock()
-	c.mu.Unlock()
 	return c.Conn.Close()
 }
 
@@ -194,8 +207,8 @@ func (c *UDPConnection) Read(b []byte) (n int, err error) {
 
 func (c *UDPConnection) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 	n, addr, err = c.PacketConn.ReadFrom(b)
-	if SIPDebug {
-		slog.Debug("UDP read %s <- %s:\n%s", c.PacketConn.LocalAddr().String(), addr.String(), string(b[:n]))
+	if SIPDebug && err == nil {
+		slog.Debug(fmt.Sprintf("UDP read %s <- %s:\n%s", c.PacketConn.LocalAddr().String(), addr.String(), string(b[:n])))
 	}
 	return n, addr, err
 }
@@ -210,7 +223,7 @@ func (c *UDPConnection) WriteTo(b []byte, addr net.Addr) (n int, err error) {
 
 func (c *UDPConnection) WriteMsg(msg *message.Message) error {
 	var buf bytes.Buffer
-	msg.Msg.Append(&buf)
+	msg.Append(&buf)
 	data := buf.Bytes()
 
 	if len(data) > UDPMTUSize-200 {
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+)
+
+// annotateVia adds received to top Via of request when sent-by differs from
+// source address (RFC 3261 18.2.1) and fills empty rport with source port.
+// Requested rport always gets received (RFC 3581 4).
+func annotateVia(msg *message.Message, src string) {
+	via := msg.Msg.Via
+	if via == nil || msg.Msg.IsResponse() {
+		return
+	}
+	host, port, err := net.SplitHostPort(src)
+	if err != nil {
+		return
+	}
+
+	rport := via.Param.Get("rport")
+	if rport != nil {
+		rport.Value = port
+	}
+	if rport == nil && sameHost(via.Host, host) {
+		return
+	}
+
+	if received := via.Param.Get("received"); received != nil {
+		received.Value = host
+		return
+	}
+	// gosip writes params from the last one in list, so received is written last
+	via.Param = &sip.Param{Name: "received", Value: host, Next: via.Param}
+}
+
+// sameHost reports if sent-by host is IP address of source
+func sameHost(sentBy string, src string) bool {
+	a, err := netip.ParseAddr(strings.Trim(sentBy, "[]"))
+	if err != nil {
+		return false
+	}
+	b, err := netip.ParseAddr(src)
+	if err != nil {
+		return false
+	}
+	return a.Unmap() == b.Unmap()
+}
+
+// ResponseAddr returns address responses of Via are sent to over unreliable
+// transport, or when connection of request is gone (RFC 3261 18.2.2). Address
+// is taken from maddr, received or sent-by, port from rport (RFC 3581) or
+// sent-by, defaulting to 5060 or 5061 for TLS.
+func ResponseAddr(via *sip.Via) string {
+	host, port := via.Host, int(via.Port)
+	if p := via.Param.Get("maddr"); p != nil && p.Value != "" {
+		host = p.Value
+	} else {
+		if p := via.Param.Get("received"); p != nil && p.Value != "" {
+			host = p.Value
+		}
+		if p := via.Param.Get("rport"); p != nil && p.Value != "" {
+			if n, err := strconv.Atoi(p.Value); err == nil {
+				port = n
+			}
+		}
+	}
+
+	if port == 0 {
+		port = 5060
+		if strings.EqualFold(via.Transport, TransportTLS) || strings.EqualFold(via.Transport, TransportWSS) {
+			port = 5061
+		}
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
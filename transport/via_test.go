@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+// newVia creates Via of sent-by with params, value "-" is param without value
+func newVia(transport string, host string, port uint16, params ...string) *sip.Via {
+	via := &sip.Via{Transport: transport, Host: host, Port: port}
+	for i := len(params) - 2; i >= 0; i -= 2 {
+		value := params[i+1]
+		if value == "-" {
+			value = ""
+		}
+		via.Param = &sip.Param{Name: params[i], Value: value, Next: via.Param}
+	}
+	return via
+}
+
+func TestAnnotateVia(t *testing.T) {
+	tests := []struct {
+		name string
+		via  *sip.Via
+		src  string
+		// received and rport are values after annotation, "-" for missing param
+		received string
+		rport    string
+	}{
+		{name: "same address", via: newVia("UDP", "192.0.2.1", 5060), src: "192.0.2.1:5060", received: "-", rport: "-"},
+		{name: "other address", via: newVia("UDP", "192.0.2.1", 5060), src: "198.51.100.7:5060", received: "198.51.100.7", rport: "-"},
+		{name: "rport without value", via: newVia("UDP", "192.0.2.1", 5060, "rport", "-"), src: "198.51.100.7:40312", received: "198.51.100.7", rport: "40312"},
+		// Requested rport always gets received (RFC 3581 4)
+		{name: "rport from same address", via: newVia("UDP", "192.0.2.1", 5060, "rport", "-"), src: "192.0.2.1:5060", received: "192.0.2.1", rport: "5060"},
+		{name: "hostname sent-by", via: newVia("TCP", "pc33.example.com", 0), src: "192.0.2.1:49152", received: "192.0.2.1", rport: "-"},
+		{name: "IPv6 sent-by", via: newVia("UDP", "2001:db8::1", 5060), src: "[2001:db8::1]:5060", received: "-", rport: "-"},
+		{name: "IPv6 sent-by with brackets", via: newVia("UDP", "[2001:db8::1]", 5060), src: "[2001:db8::1]:5060", received: "-", rport: "-"},
+		{name: "IPv6 other address", via: newVia("UDP", "2001:db8::1", 5060, "rport", "-"), src: "[2001:db8::2]:5062", received: "2001:db8::2", rport: "5062"},
+		{name: "IPv4-mapped source", via: newVia("UDP", "192.0.2.1", 5060), src: "[::ffff:192.0.2.1]:5060", received: "-", rport: "-"},
+		{name: "stale received", via: newVia("UDP", "10.0.0.1", 5060, "received", "10.9.9.9"), src: "198.51.100.7:5060", received: "198.51.100.7", rport: "-"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &message.Message{Msg: &sip.Msg{Method: string(message.OPTIONS), Via: tt.via}}
+			annotateVia(req, tt.src)
+			for name, want := range map[string]string{"received": tt.received, "rport": tt.rport} {
+				got := "-"
+				if p := tt.via.Param.Get(name); p != nil {
+					got = p.Value
+				}
+				if got != want {
+					t.Errorf("%s %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAnnotateViaResponse(t *testing.T) {
+	via := newVia("UDP", "192.0.2.1", 5060, "rport", "-")
+	res := &message.Message{Msg: &sip.Msg{Status: 200, Via: via}}
+	annotateVia(res, "198.51.100.7:40312")
+	if p := via.Param.Get("rport"); p.Value != "" || via.Param.Get("received") != nil {
+		t.Errorf("Via of response annotated: rport %q received %v", p.Value, via.Param.Get("received"))
+	}
+}
+
+func TestResponseAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		via  *sip.Via
+		want string
+	}{
+		{name: "sent-by", via: newVia("UDP", "192.0.2.1", 5062), want: "192.0.2.1:5062"},
+		{name: "default port", via: newVia("UDP", "192.0.2.1", 0), want: "192.0.2.1:5060"},
+		{name: "default port of TLS", via: newVia("TLS", "192.0.2.1", 0), want: "192.0.2.1:5061"},
+		{name: "default port of WSS", via: newVia("WSS", "df7jal23ls0d.invalid", 0), want: "df7jal23ls0d.invalid:5061"},
+		{name: "hostname", via: newVia("UDP", "pc33.example.com", 0), want: "pc33.example.com:5060"},
+		{name: "received", via: newVia("UDP", "10.0.0.1", 5060, "received", "198.51.100.7"), want: "198.51.100.7:5060"},
+		{name: "received and rport", via: newVia("UDP", "10.0.0.1", 5060, "rport", "40312", "received", "198.51.100.7"), want: "198.51.100.7:40312"},
+		// rport without value was not filled in by transport, sent-by port is used
+		{name: "rport without value", via: newVia("UDP", "192.0.2.1", 5062, "rport", "-"), want: "192.0.2.1:5062"},
+		{name: "maddr", via: newVia("UDP", "192.0.2.1", 5062, "maddr", "239.255.255.1", "received", "198.51.100.7"), want: "239.255.255.1:5062"},
+		{name: "IPv6 sent-by", via: newVia("UDP", "2001:db8::1", 0), want: "[2001:db8::1]:5060"},
+		{name: "IPv6 sent-by with brackets", via: newVia("UDP", "[2001:db8::1]", 5062), want: "[2001:db8::1]:5062"},
+		{name: "IPv6 received", via: newVia("UDP", "2001:db8::1", 5060, "rport", "5070", "received", "2001:db8::2"), want: "[2001:db8::2]:5070"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ResponseAddr(tt.via); got != tt.want {
+				t.Errorf("ResponseAddr = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// rawRequest is OPTIONS with Via of network whose sent-by is not listening
+func rawRequest(network string, params string) []byte {
+	return []byte("OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/" + network + " 127.0.0.1:9;branch=z9hG4bKvia1" + params + "\r\n" +
+		"From: <sip:alice@127.0.0.1>;tag=a1\r\n" +
+		"To: <sip:bob@127.0.0.1>\r\n" +
+		"Call-ID: via-1@127.0.0.1\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Content-Length: 0\r\n\r\n")
+}
+
+func TestResponseRouting(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		params  string
+	}{
+		// Over UDP response goes to received and rport of Via (RFC 3581 4)
+		{name: "UDP with rport", network: TransportUDP, params: ";rport"},
+		// Over TCP response goes on connection of request, not to sent-by (RFC 3261 18.2.2)
+		{name: "TCP without rport", network: TransportTCP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLayer(parser.NewParser())
+			answerOK(t, l)
+			defer l.Close()
+
+			var conn io.ReadWriter
+			if tt.network == TransportUDP {
+				pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				go l.ServeUDP(pc)
+				c, err := net.Dial("udp", pc.LocalAddr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				conn = c
+			} else {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				go l.ServeTCP(ln)
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				conn = c
+			}
+
+			if _, err := conn.Write(rawRequest(tt.network, tt.params)); err != nil {
+				t.Fatal(err)
+			}
+			data, err := readStreamMessage(bufio.NewReader(conn), io.Discard)
+			if err != nil {
+				t.Fatalf("response was not received on socket of request: %v", err)
+			}
+			res, err := parser.NewParser().ParseMsg(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Msg.Status != 200 {
+				t.Errorf("status %d, want 200", res.Msg.Status)
+			}
+			if tt.params != "" {
+				port := conn.(net.Conn).LocalAddr().(*net.UDPAddr).Port
+				if p := res.Msg.Via.Param.Get("rport"); p == nil || p.Value != strconv.Itoa(port) {
+					t.Errorf("rport %v, want %d", p, port)
+				}
+			}
+		})
+	}
+}
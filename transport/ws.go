@@ -0,0 +1,389 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+const (
+	// WSSubprotocol is WebSocket subprotocol negotiated for SIP (RFC 7118)
+	WSSubprotocol = "sip"
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+var (
+	ErrWSProtocol = errors.New("websocket protocol error")
+)
+
+// WSTransport implements Transport interface for SIP over WebSocket.
+// It is mounted as http.Handler, each WebSocket message carries one SIP message.
+type WSTransport struct {
+	parser parser.Parser
+
+	pool ConnectionPool
+}
+
+func NewWSTransport(parser parser.Parser) *WSTransport {
+	p := &WSTransport{
+		parser: parser,
+		pool:   NewConnectionPool(),
+	}
+	return p
+}
+
+func (t *WSTransport) Network() string {
+	return TransportWS
+}
+
+func (t *WSTransport) String() string {
+	return "transport<WS>"
+}
+
+// GetConnection returns WebSocket connection of remote addr. Connections can not be
+// dialed, browser clients always connect to us.
+func (t *WSTransport) GetConnection(addr string) (Connection, error) {
+	c := t.pool.Get(addr)
+	if c == nil {
+		return nil, fmt.Errorf("websocket connection %s does not exist", addr)
+	}
+	return c, nil
+}
+
+func (t *WSTransport) Close() error {
+	var werr error
+	for _, c := range t.pool.All() {
+		if err := c.Close(); err != nil {
+			werr = err
+		}
+	}
+	return werr
+}
+
+// Handler returns http.Handler upgrading requests to WebSocket and passing
+// received SIP messages to handler
+func (t *WSTransport) Handler(handler func(msg *message.Message)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.serveHTTP(w, r, handler)
+	})
+}
+
+func (t *WSTransport) serveHTTP(w http.ResponseWriter, r *http.Request, handler func(msg *message.Message)) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	if !headerContainsToken(r.Header, "Sec-WebSocket-Protocol", WSSubprotocol) {
+		http.Error(w, "sip subprotocol required", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		slog.Error("websocket hijack failed", "err", err)
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	b.WriteString("Upgrade: websocket\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n")
+	b.WriteString("Sec-WebSocket-Protocol: " + WSSubprotocol + "\r\n\r\n")
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		slog.Error("websocket handshake failed", "err", err)
+		conn.Close()
+		return
+	}
+
+	transport := TransportWS
+	if r.TLS != nil {
+		transport = TransportWSS
+	}
+
+	c := &WSConnection{Conn: conn, r: rw.Reader, transport: transport}
+	raddr := conn.RemoteAddr().String()
+	t.pool.Add(raddr, c)
+
+	t.readConnection(c, handler)
+}
+
+func (t *WSTransport) readConnection(conn *WSConnection, handler func(*message.Message)) {
+	laddr := conn.Conn.LocalAddr().String()
+	raddr := conn.Conn.RemoteAddr().String()
+	defer func() {
+		t.pool.Del(raddr)
+		conn.Close()
+	}()
+
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Error("read websocket error", "err", err)
+			}
+			return
+		}
+
+		if SIPDebug {
+			slog.Debug(fmt.Sprintf("%s read %s <- %s:\n%s", conn.transport, laddr, raddr, string(data)))
+		}
+
+		msg := t.parseAndHandle(data, raddr, laddr, conn.WriteMsg)
+		if msg != nil {
+			handler(msg)
+		}
+	}
+}
+
+func (t *WSTransport) parseAndHandle(data []byte, src string, dst string, respond message.RespondFunc) *message.Message {
+	if len(bytes.TrimSpace(data)) == 0 {
+		slog.Debug("Keep alive received")
+		return nil
+	}
+
+	msg, err := t.parser.ParseMsg(data)
+	if err != nil {
+		slog.Debug("failed to parse", slog.String("data", string(data)), slog.String("err", err.Error()))
+		badRequest(err, src, dst, TransportWS, respond)
+		return nil
+	}
+
+	if msg.Transport != TransportWS && msg.Transport != TransportWSS {
+		slog.Debug("transport mismatch", slog.String("transport", msg.Msg.Via.Transport))
+		return nil
+	}
+
+	msg.Source = src
+	msg.Destination = dst
+	msg.Respond = respond
+	annotateVia(msg, src)
+
+	return msg
+}
+
+// WSConnection is server side of WebSocket connection
+type WSConnection struct {
+	Conn net.Conn
+
+	r         *bufio.Reader
+	transport string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// ReadMessage reads frames until complete text or binary message is received.
+// Control frames are answered in place.
+func (c *WSConnection) ReadMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, ErrWSProtocol
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, ErrWSProtocol
+			}
+		default:
+			return nil, ErrWSProtocol
+		}
+
+		if len(msg)+len(payload) > int(transportBufferSize) {
+			return nil, ErrMessageTooLarge
+		}
+		msg = append(msg, payload...)
+
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *WSConnection) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	// Frames sent by client must be masked
+	if !masked {
+		return false, 0, nil, ErrWSProtocol
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > uint64(transportBufferSize) {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (c *WSConnection) writeFrame(opcode byte, payload []byte) error {
+	var b bytes.Buffer
+	b.WriteByte(0x80 | opcode)
+
+	n := len(payload)
+	switch {
+	case n < 126:
+		b.WriteByte(byte(n))
+	case n <= 0xffff:
+		b.WriteByte(126)
+		var ext [2]byte
+		binary.BigEndian.PutUint16(ext[:], uint16(n))
+		b.Write(ext[:])
+	default:
+		b.WriteByte(127)
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		b.Write(ext[:])
+	}
+	b.Write(payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	_, err := c.Conn.Write(b.Bytes())
+	return err
+}
+
+func (c *WSConnection) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *WSConnection) WriteMsg(msg *message.Message) error {
+	var buf bytes.Buffer
+	msg.Append(&buf)
+	data := buf.Bytes()
+
+	if err := c.writeFrame(wsOpText, data); err != nil {
+		return fmt.Errorf("%s conn %s err. %w", c.transport, c.Conn.LocalAddr().String(), err)
+	}
+
+	if SIPDebug {
+		slog.Debug(fmt.Sprintf("%s write %s -> %s:\n%s", c.transport, c.Conn.LocalAddr().String(), c.Conn.RemoteAddr().String(), string(data)))
+	}
+
+	return nil
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken checks comma separated header values for token, case insensitive
+func headerContainsToken(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
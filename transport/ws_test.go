@@ -0,0 +1,273 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shend/simplesip/message"
+	"github.com/shend/simplesip/parser"
+)
+
+// clientFrame creates frame as sent by browser, masked
+func clientFrame(fin bool, opcode byte, payload string) []byte {
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	b := []byte{head}
+	if len(payload) < 126 {
+		b = append(b, 0x80|byte(len(payload)))
+	} else {
+		b = append(b, 0x80|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i := 0; i < len(payload); i++ {
+		b = append(b, payload[i]^mask[i%4])
+	}
+	return b
+}
+
+// serverFrame creates final frame as sent by server, unmasked
+func serverFrame(opcode byte, payload string) []byte {
+	return append([]byte{0x80 | opcode, byte(len(payload))}, payload...)
+}
+
+// recordConn records frames written by WSConnection
+type recordConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+func TestWSReadMessage(t *testing.T) {
+	long := strings.Repeat("x", 300)
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   string
+		err    error
+		// written are frames answered by connection
+		written []byte
+	}{
+		{name: "masked text", frames: [][]byte{clientFrame(true, wsOpText, "OPTIONS")}, want: "OPTIONS"},
+		{name: "binary", frames: [][]byte{clientFrame(true, wsOpBinary, "OPTIONS")}, want: "OPTIONS"},
+		{name: "16-bit length", frames: [][]byte{clientFrame(true, wsOpText, long)}, want: long},
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				clientFrame(false, wsOpText, "OPT"),
+				clientFrame(false, wsOpContinuation, "IO"),
+				clientFrame(true, wsOpContinuation, "NS"),
+			},
+			want: "OPTIONS",
+		},
+		{
+			name: "ping between fragments",
+			frames: [][]byte{
+				clientFrame(false, wsOpText, "OPT"),
+				clientFrame(true, wsOpPing, "hb"),
+				clientFrame(true, wsOpContinuation, "IONS"),
+			},
+			want:    "OPTIONS",
+			written: serverFrame(wsOpPong, "hb"),
+		},
+		{
+			name:   "pong ignored",
+			frames: [][]byte{clientFrame(true, wsOpPong, "hb"), clientFrame(true, wsOpText, "OPTIONS")},
+			want:   "OPTIONS",
+		},
+		{
+			name:    "close",
+			frames:  [][]byte{clientFrame(true, wsOpClose, "\x03\xe8")},
+			err:     io.EOF,
+			written: serverFrame(wsOpClose, "\x03\xe8"),
+		},
+		{name: "unmasked", frames: [][]byte{serverFrame(wsOpText, "OPTIONS")}, err: ErrWSProtocol},
+		{name: "continuation first", frames: [][]byte{clientFrame(true, wsOpContinuation, "NS")}, err: ErrWSProtocol},
+		{
+			name:   "text within fragmented message",
+			frames: [][]byte{clientFrame(false, wsOpText, "OPT"), clientFrame(true, wsOpText, "IONS")},
+			err:    ErrWSProtocol,
+		},
+		{name: "unknown opcode", frames: [][]byte{clientFrame(true, 0x3, "x")}, err: ErrWSProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordConn{}
+			c := &WSConnection{Conn: conn, r: bufio.NewReader(bytes.NewReader(bytes.Join(tt.frames, nil)))}
+
+			got, err := c.ReadMessage()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err %v, want %v", err, tt.err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("message %q, want %q", got, tt.want)
+			}
+			if !bytes.Equal(conn.out.Bytes(), tt.written) {
+				t.Errorf("written % x, want % x", conn.out.Bytes(), tt.written)
+			}
+		})
+	}
+}
+
+// wsHandshake sends upgrade request over conn and returns response
+func wsHandshake(t *testing.T, conn net.Conn, r *bufio.Reader, protocol string) *http.Response {
+	t.Helper()
+	req := "GET / HTTP/1.1\r\n" +
+		"Host: 127.0.0.1\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	if protocol != "" {
+		req += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestWSHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		status   int
+	}{
+		{name: "sip subprotocol", protocol: "sip", status: http.StatusSwitchingProtocols},
+		{name: "sip among others", protocol: "chat, sip", status: http.StatusSwitchingProtocols},
+		{name: "no subprotocol", status: http.StatusBadRequest},
+		{name: "other subprotocol", protocol: "chat", status: http.StatusBadRequest},
+	}
+
+	tp := NewWSTransport(parser.NewParser())
+	srv := httptest.NewServer(tp.Handler(func(msg *message.Message) {}))
+	defer srv.Close()
+	defer tp.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			res := wsHandshake(t, conn, bufio.NewReader(conn), tt.protocol)
+			if res.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", res.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusSwitchingProtocols {
+				return
+			}
+			// Accept key of RFC 6455 1.3 example
+			if got := res.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("Sec-WebSocket-Accept %q", got)
+			}
+			if got := res.Header.Get("Sec-WebSocket-Protocol"); got != WSSubprotocol {
+				t.Errorf("Sec-WebSocket-Protocol %q, want sip", got)
+			}
+		})
+	}
+}
+
+func TestWSRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		via  string
+		// answered tells if request passes transport check and gets response
+		answered bool
+	}{
+		{name: "WS Via", via: "SIP/2.0/WS", answered: true},
+		{name: "TCP Via", via: "SIP/2.0/TCP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := NewWSTransport(parser.NewParser())
+			requests := make(chan *message.Message, 1)
+			srv := httptest.NewServer(tp.Handler(func(req *message.Message) {
+				requests <- req
+				if err := req.Respond(message.NewResponse(req, 200, "OK")); err != nil {
+					t.Errorf("respond failed: %v", err)
+				}
+			}))
+			defer srv.Close()
+			defer tp.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			r := bufio.NewReader(conn)
+			if res := wsHandshake(t, conn, r, "sip"); res.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("handshake status %d", res.StatusCode)
+			}
+
+			options := "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\n" +
+				"Via: " + tt.via + " df7jal23ls0d.invalid;branch=z9hG4bKws1\r\n" +
+				"From: <sip:alice@example.com>;tag=a1\r\n" +
+				"To: <sip:bob@127.0.0.1>\r\n" +
+				"Call-ID: ws-1@df7jal23ls0d.invalid\r\n" +
+				"CSeq: 1 OPTIONS\r\n" +
+				"Content-Length: 0\r\n\r\n"
+			if _, err := conn.Write(clientFrame(true, wsOpText, options)); err != nil {
+				t.Fatal(err)
+			}
+			// Close frame follows request, server echoes it and ends connection
+			if _, err := conn.Write(clientFrame(true, wsOpClose, "")); err != nil {
+				t.Fatal(err)
+			}
+
+			frames, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(frames, serverFrame(wsOpClose, "")) {
+				t.Errorf("close frame was not echoed, got % x", frames)
+			}
+
+			answered := bytes.Contains(frames, []byte("SIP/2.0 200 OK"))
+			if answered != tt.answered {
+				t.Errorf("answered %v, want %v", answered, tt.answered)
+			}
+			if !tt.answered {
+				return
+			}
+			req := <-requests
+			if req.Transport != TransportWS {
+				t.Errorf("request transport %s, want WS", req.Transport)
+			}
+			if frames[0] != 0x80|wsOpText {
+				t.Errorf("response frame header %x, want final text frame", frames[0])
+			}
+		})
+	}
+}